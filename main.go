@@ -4,14 +4,48 @@ package main
 
 import (
 	"context"
+	"flag"
+	"io"
 	"log"
 	"main/v2/server"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 )
 
+var strategy = flag.String("strategy", "best-fit", "car selection strategy, one of: "+strings.Join(server.CarSelectorNames(), ", "))
+var fairness = flag.String("fairness", "asap", "fairness of the waiting list, one of: "+strings.Join(server.FairnessModeNames(), ", "))
+var maxSkips = flag.Int("max-skips", 0, "aging fairness: the first waiting group starves after this many groups are served before it, 0 disables it")
+var maxWait = flag.Duration("max-wait", 0, "aging fairness: the first waiting group starves after waiting this long, 0 disables it")
+var snapshotPath = flag.String("snapshot", "", "file where the state is saved periodically and on shutdown, and restored from on startup. Empty disables the snapshots")
+var snapshotInterval = flag.Duration("snapshot-interval", 30*time.Second, "time between snapshots")
+var walPath = flag.String("wal", "", "write-ahead log where every operation is appended, it is replayed on startup on top of the snapshot and compacted after every snapshot, so it needs -snapshot. Empty disables the log")
+var walSync = flag.String("wal-sync", "always", "when the write-ahead log is flushed to the disk, one of: "+strings.Join(server.SyncPolicyNames(), ", "))
+var walSyncInterval = flag.Duration("wal-sync-interval", time.Second, "time between flushes of the write-ahead log with -wal-sync interval")
+var storeName = flag.String("store", "memory", "storage of the cars and the groups, one of: "+strings.Join(server.StoreNames(), ", ")+". The dispatcher reads the cars and the groups from it, the memory one keeps nothing after a restart")
+var storePath = flag.String("store-path", "carpooling.db", "file of the file store")
+var storeSync = flag.String("store-sync", "always", "when the file store is flushed to the disk, one of: "+strings.Join(server.SyncPolicyNames(), ", "))
+var storeSyncInterval = flag.Duration("store-sync-interval", time.Second, "time between flushes of the file store with -store-sync interval")
+var recordPath = flag.String("record", "", "capture where the requests are recorded for the replay command. Empty disables the recording")
+var recordMaxSize = flag.Int64("record-max-size", 100<<20, "size in bytes that rotates the capture, 0 never rotates it")
+var recordMaxFiles = flag.Int("record-max-files", 5, "rotated captures kept")
+var recordSample = flag.Float64("record-sample", 1, "fraction of the requests recorded, 1 records every request and 0 none")
+var recordRedact = flag.String("record-redact", "", "comma separated json fields and form keys replaced by pseudonyms in the capture, such as id")
+var recordRedactKey = flag.String("record-redact-key", "", "secret of the pseudonyms, empty uses a random one so they change on every start")
+var logLevel = flag.String("log-level", "info", "lowest level of the json access log, one of: "+strings.Join(server.LogLevelNames(), ", ")+". The probes and /metrics are debug, the 4xx warn and the 5xx error")
+var logOutput = flag.String("log-output", "stderr", "where the access log is written, stderr, stdout or the path of a file that is appended to")
+var seed = flag.Int64("seed", 0, "seed of the random strategy, 0 uses the current time. With a fixed seed the same requests always produce the same journeys")
+
 func main() {
+	flag.Parse()
+	// the log is only compacted after a snapshot, without one it would grow
+	// forever and so would the replay on startup
+	if *walPath != "" && *snapshotPath == "" {
+		log.Fatal("-wal needs -snapshot, the log is compacted after every snapshot")
+	}
 	startserver()
 }
 
@@ -23,19 +57,172 @@ func startserver() {
 	serverDoneChan := make(chan os.Signal, 1)
 	signal.Notify(serverDoneChan, os.Interrupt, syscall.SIGTERM)
 
-	srv := server.New(":9091")
+	selector, err := server.CarSelectorByName(*strategy, *seed)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fairnessMode, err := server.FairnessModeByName(*fairness)
+	if err != nil {
+		log.Fatal(err)
+	}
+	options := []server.DispatcherOption{
+		server.WithCarSelector(selector),
+		server.WithFairness(server.FairnessPolicy{Mode: fairnessMode, MaxSkips: *maxSkips, MaxWait: *maxWait}),
+	}
+	storeSyncPolicy, err := server.SyncPolicyByName(*storeSync)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, err := server.OpenStore(*storeName, *storePath, storeSyncPolicy, *storeSyncInterval)
+	if err != nil {
+		log.Fatalf("opening store: %v", err)
+	}
+	options = append(options, server.WithStore(store))
+	if checked, ok := store.(interface{ Err() error }); ok {
+		options = append(options, server.WithHealthCheck("store", checked.Err))
+	}
+	var wal *server.WriteAheadLog
+	if *walPath != "" {
+		syncPolicy, err := server.SyncPolicyByName(*walSync)
+		if err != nil {
+			log.Fatal(err)
+		}
+		wal, err = server.OpenWriteAheadLog(*walPath, syncPolicy, *walSyncInterval)
+		if err != nil {
+			log.Fatalf("opening write-ahead log %s: %v", *walPath, err)
+		}
+		options = append(options, server.WithObserver(wal.Observe), server.WithHealthCheck("wal", wal.Err))
+	}
+	dispatcher := server.NewDispatcher(options...)
+	middlewares := []server.Middleware{}
+	level, err := server.LogLevelByName(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var accessLog io.Writer = os.Stderr
+	switch *logOutput {
+	case "stderr":
+	case "stdout":
+		accessLog = os.Stdout
+	default:
+		file, err := os.OpenFile(*logOutput, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatalf("opening access log %s: %v", *logOutput, err)
+		}
+		defer file.Close()
+		accessLog = file
+	}
+	// the access log is the outermost middleware, so its latency includes
+	// the recording of the request
+	middlewares = append(middlewares, server.NewAccessLogger(server.AccessLogConfig{Output: accessLog, Level: level}).Middleware)
+	var recorder *server.Recorder
+	if *recordPath != "" {
+		config := server.RecorderConfig{
+			Path:      *recordPath,
+			MaxBytes:  *recordMaxSize,
+			MaxFiles:  *recordMaxFiles,
+			Sample:    *recordSample,
+			RedactKey: *recordRedactKey,
+		}
+		if *recordRedact != "" {
+			config.Redact = strings.Split(*recordRedact, ",")
+		}
+		if recorder, err = server.NewRecorder(config); err != nil {
+			log.Fatalf("opening capture %s: %v", *recordPath, err)
+		}
+		middlewares = append(middlewares, recorder.Middleware)
+	}
+	srv := server.New(":9091", dispatcher, middlewares...)
 
+	// the server answers /live and /ready during the recovery, the requests
+	// of the API get a 503 until it ends
+	dispatcher.BeginRecovery()
 	go func() {
 		err := srv.ListenAndServe()
-		if err != nil {
+		if err != nil && err != http.ErrServerClosed {
 			panic(err)
 		}
 	}()
 
+	if err := dispatcher.LoadStore(); err != nil {
+		log.Fatalf("restoring store: %v", err)
+	}
+	// a store that keeps its state is newer than any snapshot
+	if *snapshotPath != "" && dispatcher.LastOperation() == 0 {
+		if err := dispatcher.LoadSnapshot(*snapshotPath); err != nil {
+			log.Fatalf("restoring snapshot %s: %v", *snapshotPath, err)
+		}
+	}
+	if wal != nil {
+		applied, err := dispatcher.ReplayLog(*walPath)
+		if err != nil {
+			log.Fatalf("replaying write-ahead log %s: %v", *walPath, err)
+		}
+		log.Printf("replayed %d operations", applied)
+	}
+	if err := dispatcher.SyncStore(); err != nil {
+		log.Fatalf("writing store: %v", err)
+	}
+	dispatcher.EndRecovery()
+	stopSnapshots, snapshotsDone := make(chan struct{}), make(chan struct{})
+	if *snapshotPath != "" {
+		go saveSnapshots(dispatcher, wal, stopSnapshots, snapshotsDone)
+	} else {
+		close(snapshotsDone)
+	}
+
 	log.Println("server started")
 
 	<-serverDoneChan
 
 	srv.Shutdown(ctx)
+	// a periodic save must not run with the last one or after the log closes
+	close(stopSnapshots)
+	<-snapshotsDone
+	if *snapshotPath != "" {
+		saveSnapshot(dispatcher, wal)
+	}
+	if wal != nil {
+		if err := wal.Close(); err != nil {
+			log.Printf("closing write-ahead log %s: %v", *walPath, err)
+		}
+	}
+	if recorder != nil {
+		recorder.Close()
+	}
+	if err := store.Close(); err != nil {
+		log.Printf("closing store: %v", err)
+	}
 	log.Println("server stopped")
 }
+
+// saveSnapshots saves the state every interval until stop is closed, then it
+// closes done
+func saveSnapshots(dispatcher *server.Dispatcher, wal *server.WriteAheadLog, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(*snapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			saveSnapshot(dispatcher, wal)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// saveSnapshot saves the state and removes from the log the operations that
+// the snapshot already includes
+func saveSnapshot(dispatcher *server.Dispatcher, wal *server.WriteAheadLog) {
+	upTo := dispatcher.LastOperation()
+	if err := dispatcher.SaveSnapshot(*snapshotPath); err != nil {
+		log.Printf("saving snapshot %s: %v", *snapshotPath, err)
+		return
+	}
+	if wal != nil {
+		if err := wal.Compact(upTo); err != nil {
+			log.Printf("compacting write-ahead log %s: %v", *walPath, err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"main/v2/server"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+)
+
+var url = flag.String("url", "", "base url of the server, empty replays the capture against a new dispatcher in this process")
+var strategy = flag.String("strategy", "best-fit", "in process: car selection strategy, one of: "+strings.Join(server.CarSelectorNames(), ", "))
+var fairness = flag.String("fairness", "asap", "in process: fairness of the waiting list, one of: "+strings.Join(server.FairnessModeNames(), ", "))
+var seed = flag.Int64("seed", 1, "in process: seed of the random strategy")
+var speed = flag.Float64("speed", 0, "replay the requests with their captured timing at this speed, 2 is twice as fast. 0 sends them as fast as possible")
+var verbose = flag.Bool("v", false, "print every response")
+
+// handlerTransport serves the requests with a handler instead of a connection
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	t.handler.ServeHTTP(w, req)
+	return w.Result(), nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: replay [flags] capture.jsonl...\nWith no file or with - the capture is read from the standard input\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	requests, err := readCaptures(flag.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+	client, baseURL, err := newClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if mismatches := replay(client, baseURL, requests); mismatches > 0 {
+		os.Exit(1)
+	}
+}
+
+func readCaptures(paths []string) ([]server.CapturedRequest, error) {
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+	requests := []server.CapturedRequest{}
+	for _, path := range paths {
+		var r io.Reader = os.Stdin
+		if path != "-" {
+			file, err := os.Open(path)
+			if err != nil {
+				return nil, err
+			}
+			defer file.Close()
+			r = file
+		}
+		captured, err := server.ReadCapture(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		requests = append(requests, captured...)
+	}
+	return requests, nil
+}
+
+func newClient() (*http.Client, string, error) {
+	if *url != "" {
+		return &http.Client{Timeout: 10 * time.Second}, *url, nil
+	}
+	selector, err := server.CarSelectorByName(*strategy, *seed)
+	if err != nil {
+		return nil, "", err
+	}
+	fairnessMode, err := server.FairnessModeByName(*fairness)
+	if err != nil {
+		return nil, "", err
+	}
+	dispatcher := server.NewDispatcher(
+		server.WithCarSelector(selector),
+		server.WithFairness(server.FairnessPolicy{Mode: fairnessMode}),
+	)
+	handler := server.New("", dispatcher).Handler
+	return &http.Client{Transport: handlerTransport{handler}}, "http://replay", nil
+}
+
+// replay sends the requests in order and reports the ones with an unexpected
+// response, it returns how many there were
+func replay(client *http.Client, baseURL string, requests []server.CapturedRequest) int {
+	mismatches, unchecked, skipped := 0, 0, 0
+	start := time.Now()
+	for idx, captured := range requests {
+		if captured.Streaming() {
+			skipped++
+			if *verbose {
+				fmt.Printf("#%d %s %s skipped, it is a stream\n", idx+1, captured.Method, captured.Path)
+			}
+			continue
+		}
+		if *speed > 0 && !captured.Time.IsZero() && !requests[0].Time.IsZero() {
+			offset := time.Duration(float64(captured.Time.Sub(requests[0].Time)) / *speed)
+			time.Sleep(time.Until(start.Add(offset)))
+		}
+		req, err := captured.NewRequest(baseURL)
+		if err != nil {
+			log.Fatalf("request #%d: %v", idx+1, err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Fatalf("request #%d: %v", idx+1, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if *verbose {
+			fmt.Printf("#%d %s %s -> %d %s\n", idx+1, captured.Method, captured.Path, resp.StatusCode, strings.TrimSpace(string(body)))
+		}
+		if captured.Status == 0 && captured.Response == "" {
+			unchecked++
+		} else if !captured.Matches(resp.StatusCode, string(body)) {
+			mismatches++
+			fmt.Printf("#%d %s %s %s: (Expected) %d %s != %d %s (Returned)\n", idx+1, captured.Method, captured.Path, captured.Body,
+				captured.Status, captured.Response, resp.StatusCode, strings.TrimSpace(string(body)))
+		}
+	}
+	fmt.Printf("replayed %d requests in %s: %d mismatches, %d without expected response, %d streams skipped\n",
+		len(requests)-skipped, time.Since(start).Round(time.Millisecond), mismatches, unchecked, skipped)
+	return mismatches
+}
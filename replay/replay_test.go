@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestReplay_Testdata replays the captures of make replay in process
+func TestReplay_Testdata(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.jsonl"))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no capture in testdata: %v", err)
+	}
+	requests, err := readCaptures(paths)
+	if err != nil {
+		t.Fatalf("readCaptures() error = %v", err)
+	}
+	client, baseURL, err := newClient()
+	if err != nil {
+		t.Fatalf("newClient() error = %v", err)
+	}
+	if mismatches := replay(client, baseURL, requests); mismatches != 0 {
+		t.Fatalf("(Expected) 0 != %d (Returned) mismatches", mismatches)
+	}
+}
+
+func TestReplay_Mismatch(t *testing.T) {
+	var tests = []struct {
+		name       string
+		capture    string
+		mismatches int
+	}{
+		{"Matches", `{"method":"PUT","path":"/cars","content_type":"application/json","body":"[{\"id\":1,\"seats\":4}]","status":200}
+{"method":"POST","path":"/locate","content_type":"application/x-www-form-urlencoded","body":"ID=1","status":404}
+`, 0},
+		{"WrongStatus", `{"method":"PUT","path":"/cars","content_type":"application/json","body":"[{\"id\":1,\"seats\":4}]","status":400}
+{"method":"POST","path":"/locate","content_type":"application/x-www-form-urlencoded","body":"ID=1","status":404}
+`, 1},
+		{"WrongResponse", `{"method":"PUT","path":"/cars","content_type":"application/json","body":"[{\"id\":1,\"seats\":4}]","status":200}
+{"method":"GET","path":"/cars/1","status":200,"response":"{\"id\":1,\"seats\":6}"}
+`, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "capture.jsonl")
+			if err := os.WriteFile(path, []byte(tt.capture), 0644); err != nil {
+				t.Fatal(err)
+			}
+			requests, err := readCaptures([]string{path})
+			if err != nil {
+				t.Fatalf("readCaptures() error = %v", err)
+			}
+			client, baseURL, err := newClient()
+			if err != nil {
+				t.Fatalf("newClient() error = %v", err)
+			}
+			if mismatches := replay(client, baseURL, requests); mismatches != tt.mismatches {
+				t.Fatalf("(Expected) %d != %d (Returned) mismatches", tt.mismatches, mismatches)
+			}
+		})
+	}
+}
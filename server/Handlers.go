@@ -1,94 +1,292 @@
 package server
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 )
 
-func statusHandler(w http.ResponseWriter, r *http.Request) {
+// eventsHeartbeat is the time between the comments that keep an idle
+// /events stream open through proxies
+const eventsHeartbeat = 15 * time.Second
+
+// eventsRetry is the wait of a client before it reconnects to /events
+const eventsRetry = 2 * time.Second
+
+// handlers translates the HTTP requests into calls to the dispatcher
+type handlers struct {
+	dispatcher *Dispatcher
+	metrics    *httpMetrics
+	events     *eventHub
+}
+
+// /status is deprecated in favour of /live and /ready, it is kept for the
+// clients of the challenge and it only tells that the process answers
+func (h *handlers) statusHandler(w http.ResponseWriter, r *http.Request) {
 	if !isSameMethod(w, r, "GET") {
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
-// /cars
-func carsHandler(w http.ResponseWriter, r *http.Request) {
-	if !isSameMethod(w, r, "PUT") || isBodyEmpty(w, r) || !isContentJson(w, r) {
+// /live tells that the process is up, it does not check the components
+func (h *handlers) liveHandler(w http.ResponseWriter, r *http.Request) {
+	if !isSameMethod(w, r, "GET") {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "alive"})
+}
+
+// /ready lists the health of the components, it is a 503 when one of them is
+// not healthy
+func (h *handlers) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if !isSameMethod(w, r, "GET") {
+		return
+	}
+	readiness := h.dispatcher.Readiness()
+	status := http.StatusOK
+	if !readiness.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, readiness)
+}
+
+// /metrics, in the Prometheus text format
+func (h *handlers) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isSameMethod(w, r, "GET") {
+		return
+	}
+	w.Header().Set("Content-Type", ContentTypeMetrics)
+	buffered := bufio.NewWriter(w)
+	if h.metrics != nil {
+		h.metrics.write(buffered)
+	}
+	writeDispatcherMetrics(buffered, h.dispatcher.Stats())
+	buffered.Flush()
+}
+
+// /events?group=, a Server-Sent Events stream of the events of the
+// dispatcher that resumes after the Last-Event-ID header
+func (h *handlers) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isSameMethod(w, r, "GET") {
+		return
+	}
+	groupId, ok := uintFromQuery(w, r, "group")
+	if !ok {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeProblem(w, http.StatusInternalServerError, ProblemInternalError, "the response can not be streamed")
 		return
 	}
-	cleanJourneysAndCars()
-	err := populateCarsList(w, r)
+	subscriber, cursor, found := h.events.subscribe(r.Header.Get("Last-Event-ID"))
+	if subscriber == nil {
+		writeProblem(w, http.StatusServiceUnavailable, ProblemNotReady, "the server is shutting down")
+		return
+	}
+	defer h.events.unsubscribe(subscriber)
+	w.Header().Set("Content-Type", ContentTypeEventStream)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", eventsRetry.Milliseconds())
+	if !found {
+		writeResync(w, h.events.latestId())
+	}
+	flusher.Flush()
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		events, next, lost := h.events.since(cursor)
+		cursor = next
+		if lost {
+			writeResync(w, h.events.latestId())
+		}
+		for _, event := range events {
+			if groupId != 0 && event.Group != groupId && event.Type != EventFleetReset {
+				continue
+			}
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+		}
+		flusher.Flush()
+		select {
+		case <-subscriber.wake:
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-subscriber.done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeResync tells the client that it missed events, it must read the state
+// again. The id of the last event is the one to resume from after that
+func writeResync(w http.ResponseWriter, latestId string) {
+	fmt.Fprintf(w, "id: %s\nevent: resync\ndata: {\"reason\":\"the events after the last event id are no longer kept\"}\n\n", latestId)
+}
+
+// /cars, with ?mode=reconcile the journeys are kept
+func (h *handlers) carsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isSameMethod(w, r, "PUT") || isBodyEmpty(w, r) || !isContentJson(w, r) || !isValidCarsMode(w, r) {
+		return
+	}
+	var carsArr []Car = []Car{}
+	decision := "fleet_reset"
+	err := json.NewDecoder(r.Body).Decode(&carsArr)
+	if err == nil && r.URL.Query().Get("mode") == CarsModeReconcile {
+		decision = "fleet_reconciled"
+		err = h.dispatcher.ReconcileCars(carsArr)
+	} else if err == nil {
+		err = h.dispatcher.ResetCars(carsArr)
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Bad Input(JSON) format, %s", err.Error())
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
+	logDecision(r, decision)
 	w.WriteHeader(http.StatusOK)
 	//PrintMemUsage()
 }
 
+// /cars/{id}
+func (h *handlers) carHandler(w http.ResponseWriter, r *http.Request) {
+	if !isOneOfMethods(w, r, "GET", "POST", "PATCH", "DELETE") {
+		return
+	}
+	if (r.Method == "POST" || r.Method == "PATCH") && (isBodyEmpty(w, r) || !isContentJson(w, r)) {
+		return
+	}
+	carId, ok := carIdFromPath(w, r, "/cars/")
+	if !ok {
+		return
+	}
+	var err error
+	var decision string
+	switch r.Method {
+	case "GET":
+		var car CarDetail
+		if car, err = h.dispatcher.Car(carId); err == nil {
+			writeJSON(w, http.StatusOK, car)
+			return
+		}
+	case "DELETE":
+		decision = "car_removed"
+		err = h.dispatcher.RemoveCar(carId)
+	default:
+		update := CarUpdate{}
+		if err = json.NewDecoder(r.Body).Decode(&update); err == nil {
+			err = isValidCarUpdate(r.Method, update)
+		}
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, ProblemInvalidBody, err.Error())
+			return
+		}
+		if r.Method == "POST" {
+			decision = "car_added"
+			err = h.dispatcher.AddCar(Car{carId, update.Seats})
+			break
+		}
+		decision = "car_updated"
+		err = h.dispatcher.PatchCar(carId, update)
+	}
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	// the decision is only logged once it is done
+	logDecision(r, decision)
+	w.WriteHeader(http.StatusOK)
+}
+
 // /journey
 
-func journeyHandler(w http.ResponseWriter, r *http.Request) {
+func (h *handlers) journeyHandler(w http.ResponseWriter, r *http.Request) {
 	if !isSameMethod(w, r, "POST") || isBodyEmpty(w, r) || !isContentJson(w, r) {
 		return
 	}
 	group := Group{}
 	err := json.NewDecoder(r.Body).Decode(&group)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Bad Input(JSON) format, %s", err.Error())
+		writeProblem(w, http.StatusBadRequest, ProblemInvalidBody, err.Error())
 		return
 	}
-	if _, ok := groupsMap[group.Id]; ok {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Error, group Id already exists")
+	logGroup(r, group.Id)
+	journey, err := h.dispatcher.RequestJourneyDetail(group)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
 		return
 	}
-	status := addNewGroup(group)
-	w.WriteHeader(status)
+	logJourney(r, journey)
+	status := http.StatusOK
+	if journey.Car == nil {
+		status = http.StatusAccepted
+	}
+	if !acceptsJSON(r) {
+		w.WriteHeader(status)
+		return
+	}
+	writeJSON(w, status, journey)
 }
 
 // /dropoff
-func dropoffHandler(w http.ResponseWriter, r *http.Request) {
+func (h *handlers) dropoffHandler(w http.ResponseWriter, r *http.Request) {
 	if !urlEncReqHasValidSettings(w, r) {
 		return
 	}
 	id, _ := strconv.Atoi(r.PostForm["ID"][0])
 	groupId := uint(id)
-	noChangeInJourneys := checkOrDeleteGroupWithoutCar(groupId, w)
-	if noChangeInJourneys {
+	logGroup(r, groupId)
+	travelling, err := h.dispatcher.Dropoff(groupId)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	logDropoff(r, travelling)
+	if !travelling {
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
-	carId, newFreeSeats := removeGroup(groupId)
-	tryAssignWaitingGroupsToCar(carId, newFreeSeats)
 	w.WriteHeader(http.StatusOK)
 }
 
 // /locate
-func locateHandler(w http.ResponseWriter, r *http.Request) {
+func (h *handlers) locateHandler(w http.ResponseWriter, r *http.Request) {
 	if !urlEncReqHasValidSettings(w, r) {
-		w.Header().Set("Content-Type", ContentTypeJSON)
 		return
 	}
 
 	id, _ := strconv.Atoi(r.PostForm["ID"][0])
 	groupId := uint(id)
-	if _, exists := groupsMap[groupId]; !exists {
-		w.WriteHeader(http.StatusNotFound)
-		w.Header().Set("Content-Type", ContentTypeJSON)
+	logGroup(r, groupId)
+	car, assigned, err := h.dispatcher.Locate(groupId)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
 		return
 	}
-	if journeysMap[groupId] == 0 {
+	if !assigned {
+		logDecision(r, "waiting")
 		w.WriteHeader(http.StatusNoContent)
-		w.Header().Set("Content-Type", ContentTypeJSON)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
+	logCar(r, car.Id)
+	logDecision(r, "travelling")
+	writeJSON(w, http.StatusOK, car)
+}
+
+// notFoundHandler answers the paths without a route
+func (h *handlers) notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, http.StatusNotFound, ProblemNotFound, fmt.Sprintf("%s does not exist", r.URL.Path))
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
 	w.Header().Set("Content-Type", ContentTypeJSON)
-	carId := journeysMap[groupId]
-	fmt.Fprintf(w, "{ \"id\": %d, \"seats\": %d }", carId, carsSize[carId])
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
 }
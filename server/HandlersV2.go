@@ -0,0 +1,197 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The v2 API uses json bodies everywhere and a route per resource. It shares
+// the dispatcher with the challenge API, so both see the same state
+
+// /v2/groups
+func (h *handlers) groupsV2Handler(w http.ResponseWriter, r *http.Request) {
+	if !isSameMethod(w, r, "POST") || isBodyEmpty(w, r) || !isContentJson(w, r) {
+		return
+	}
+	group := Group{}
+	if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+		writeProblem(w, http.StatusBadRequest, ProblemInvalidBody, err.Error())
+		return
+	}
+	logGroup(r, group.Id)
+	journey, err := h.dispatcher.RequestJourneyDetail(group)
+	if err == ErrGroupIdRepeated {
+		writeError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	logJourney(r, journey)
+	w.Header().Set("Location", fmt.Sprintf("/v2/groups/%d", group.Id))
+	writeJSON(w, http.StatusCreated, journey)
+}
+
+// /v2/groups/{id}, DELETE is the dropoff of the group
+func (h *handlers) groupV2Handler(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/ws") && h.events != nil {
+		h.groupSocketHandler(w, r)
+		return
+	}
+	if !isOneOfMethods(w, r, "GET", "DELETE") {
+		return
+	}
+	groupId, ok := groupIdFromPath(w, r, "/v2/groups/", "")
+	if !ok {
+		return
+	}
+	if r.Method == "DELETE" {
+		travelling, err := h.dispatcher.Dropoff(groupId)
+		if err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		logDropoff(r, travelling)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	journey, err := h.dispatcher.Journey(groupId)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	logJourney(r, journey)
+	writeJSON(w, http.StatusOK, journey)
+}
+
+// /v2/groups/{id}/ws, a WebSocket with the updates of the group until it is
+// dropped off
+func (h *handlers) groupSocketHandler(w http.ResponseWriter, r *http.Request) {
+	if !isSameMethod(w, r, "GET") {
+		return
+	}
+	groupId, ok := groupIdFromPath(w, r, "/v2/groups/", "/ws")
+	if !ok {
+		return
+	}
+	// the subscription starts before the journey is read, so no change is
+	// missed in between
+	subscriber, cursor, _ := h.events.subscribe("")
+	if subscriber == nil {
+		writeProblem(w, http.StatusServiceUnavailable, ProblemNotReady, "the server is shutting down")
+		return
+	}
+	defer h.events.unsubscribe(subscriber)
+	journey, err := h.dispatcher.Journey(groupId)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	ws, ok := upgradeWebSocket(w, r)
+	if !ok {
+		return
+	}
+	h.streamGroup(ws, subscriber, cursor, groupUpdateOf(journey))
+}
+
+// /v2/cars?min_free_seats=&seats=&status=&sort=&cursor=&limit=
+func (h *handlers) carsV2Handler(w http.ResponseWriter, r *http.Request) {
+	if !isSameMethod(w, r, "GET") {
+		return
+	}
+	list, ok := listQueryFromURL(w, r, CarSortKeys)
+	if !ok {
+		return
+	}
+	filter := CarFilter{Status: CarStatus(r.URL.Query().Get("status"))}
+	if _, valid := carStatusTransitions[filter.Status]; filter.Status != "" && !valid {
+		writeProblem(w, http.StatusBadRequest, ProblemInvalidQuery, fmt.Sprintf("status must be \"%s\", \"%s\" or \"%s\"", CarInService, CarPaused, CarOutOfService))
+		return
+	}
+	if filter.MinFreeSeats, ok = uintFromQuery(w, r, "min_free_seats"); !ok {
+		return
+	}
+	if filter.Seats, ok = uintFromQuery(w, r, "seats"); !ok {
+		return
+	}
+	cars, next := h.dispatcher.ListCars(filter, list.order, list.after, list.limit)
+	writePage(w, r, list, next, cars)
+}
+
+// /v2/journeys?car=&people=&sort=&cursor=&limit=, the travelling groups
+func (h *handlers) journeysV2Handler(w http.ResponseWriter, r *http.Request) {
+	if !isSameMethod(w, r, "GET") {
+		return
+	}
+	list, ok := listQueryFromURL(w, r, JourneySortKeys)
+	if !ok {
+		return
+	}
+	filter := JourneyFilter{}
+	if filter.Car, ok = uintFromQuery(w, r, "car"); !ok {
+		return
+	}
+	if filter.People, ok = uintFromQuery(w, r, "people"); !ok {
+		return
+	}
+	journeys, next := h.dispatcher.ListJourneys(filter, list.order, list.after, list.limit)
+	writePage(w, r, list, next, journeys)
+}
+
+// /v2/waiting?people=&sort=&cursor=&limit=, the waiting list in arrival order
+func (h *handlers) waitingV2Handler(w http.ResponseWriter, r *http.Request) {
+	if !isSameMethod(w, r, "GET") {
+		return
+	}
+	list, ok := listQueryFromURL(w, r, []string{"position"})
+	if !ok {
+		return
+	}
+	people, ok := uintFromQuery(w, r, "people")
+	if !ok {
+		return
+	}
+	journeys, next := h.dispatcher.ListWaiting(people, list.order.Desc, list.after, list.limit)
+	writePage(w, r, list, next, journeys)
+}
+
+// /v2/cars/{id}
+func (h *handlers) carV2Handler(w http.ResponseWriter, r *http.Request) {
+	if !isSameMethod(w, r, "GET") {
+		return
+	}
+	carId, ok := carIdFromPath(w, r, "/v2/cars/")
+	if !ok {
+		return
+	}
+	car, err := h.dispatcher.Car(carId)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, car)
+}
+
+// writePage writes a page of a listing as a json array. The next page is in
+// the Link header and its cursor in X-Next-Cursor, both are left out on the
+// last page. The page is encoded before anything is written, so an error is
+// still a problem and not a truncated page
+func writePage(w http.ResponseWriter, r *http.Request, list listQuery, next *ListCursor, items any) {
+	body, err := json.Marshal(items)
+	if err != nil {
+		writeProblem(w, http.StatusInternalServerError, ProblemInternalError, err.Error())
+		return
+	}
+	if next != nil {
+		cursor := encodeCursor(list.sort, *next)
+		query := r.URL.Query()
+		query.Set("cursor", cursor)
+		w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", r.URL.Path, query.Encode()))
+		w.Header().Set(HeaderNextCursor, cursor)
+	}
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(append(body, '\n'))
+}
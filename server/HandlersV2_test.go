@@ -0,0 +1,73 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test_v2Handlers runs the steps in order through both APIs, they share the
+// dispatcher
+func Test_v2Handlers(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		ctype    string
+		body     string
+		status   int
+		expected string
+	}{
+		{"PutCarsV1", "PUT", "/cars", ContentTypeJSON, `[ { "id": 2, "seats": 6 }, { "id": 1, "seats": 4 } ]`, http.StatusOK, ""},
+		{"ListCars", "GET", "/v2/cars", "", "", http.StatusOK, `[{"id":1,"seats":4,"free_seats":4,"status":"in_service","groups":[]},{"id":2,"seats":6,"free_seats":6,"status":"in_service","groups":[]}]`},
+		{"CreateGroup", "POST", "/v2/groups", ContentTypeJSON, `{ "id": 1, "people": 4 }`, http.StatusCreated, `{"id":1,"people":4,"status":"travelling","car":{"id":1,"seats":4,"free_seats":0}}`},
+		{"CreateGroupNotJSON", "POST", "/v2/groups", ContentTypeURLENCODED, `ID=1`, http.StatusBadRequest, "unsupported_content_type: Content-Type must be \"" + ContentTypeJSON + "\""},
+		{"CreateGroupInvalid", "POST", "/v2/groups", ContentTypeJSON, `{ "id": 2, "people": 9 }`, http.StatusBadRequest, "invalid_body: number of people should be 6 at most"},
+		{"CreateGroupRepeated", "POST", "/v2/groups", ContentTypeJSON, `{ "id": 1, "people": 2 }`, http.StatusConflict, "group_id_repeated: group Id already exists"},
+		{"CreateGroupV1", "POST", "/journey", ContentTypeJSON, `{ "id": 2, "people": 6 }`, http.StatusOK, ""},
+		{"CreateWaitingGroup", "POST", "/v2/groups", ContentTypeJSON, `{ "id": 3, "people": 5 }`, http.StatusCreated, `{"id":3,"people":5,"status":"waiting","position":1,"size_position":1}`},
+		{"GetGroup", "GET", "/v2/groups/2", "", "", http.StatusOK, `{"id":2,"people":6,"status":"travelling","car":{"id":2,"seats":6,"free_seats":0}}`},
+		{"GetWaitingGroup", "GET", "/v2/groups/3", "", "", http.StatusOK, `{"id":3,"people":5,"status":"waiting","position":1,"size_position":1}`},
+		{"GetMissingGroup", "GET", "/v2/groups/9", "", "", http.StatusNotFound, "group_not_found: group not found"},
+		{"GetInvalidGroupId", "GET", "/v2/groups/x", "", "", http.StatusBadRequest, "invalid_group_id: Group ID must be a positive int"},
+		{"DeleteGroup", "DELETE", "/v2/groups/2", "", "", http.StatusNoContent, ""},
+		{"LocateV1", "POST", "/locate", ContentTypeURLENCODED, "ID=3", http.StatusOK, `{"id":2,"seats":6}`},
+		{"DropoffV1", "POST", "/dropoff", ContentTypeURLENCODED, "ID=3", http.StatusOK, ""},
+		{"DeleteMissingGroup", "DELETE", "/v2/groups/3", "", "", http.StatusNotFound, "group_not_found: group not found"},
+		{"GetCar", "GET", "/v2/cars/1", "", "", http.StatusOK, `{"id":1,"seats":4,"free_seats":0,"status":"in_service","groups":[1]}`},
+		{"GetMissingCar", "GET", "/v2/cars/5", "", "", http.StatusNotFound, "car_not_found: car not found"},
+		{"GroupsNotAllowed", "GET", "/v2/groups", "", "", http.StatusMethodNotAllowed, methodNotAllowedMsg},
+		{"GroupNotAllowed", "PUT", "/v2/groups/1", "", "", http.StatusMethodNotAllowed, methodNotAllowedMsg},
+		{"CarsNotAllowed", "PUT", "/v2/cars", ContentTypeJSON, `[]`, http.StatusMethodNotAllowed, methodNotAllowedMsg},
+		{"CarNotAllowed", "DELETE", "/v2/cars/1", "", "", http.StatusMethodNotAllowed, methodNotAllowedMsg},
+	}
+	handler := New("", NewDispatcher()).Handler
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.body != "" {
+				req = httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			}
+			req.Header.Set("Content-Type", tt.ctype)
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("(Expected) %d != %d (Returned)", tt.status, w.Code)
+			}
+			if strings.TrimSpace(responseMessage(w)) != tt.expected {
+				t.Fatalf("(Expected) %s != %s (Returned)", tt.expected, responseMessage(w))
+			}
+			if tt.status != http.StatusCreated {
+				return
+			}
+			journey := JourneyDetail{}
+			json.Unmarshal(w.Body.Bytes(), &journey)
+			if location := fmt.Sprintf("/v2/groups/%d", journey.Id); w.Header().Get("Location") != location {
+				t.Fatalf("(Expected) %s != %s (Returned)", location, w.Header().Get("Location"))
+			}
+		})
+	}
+}
@@ -1,22 +1,29 @@
 package server
 
 import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 )
 
-const methodNotAllowedMsg = "Method not allowed"
-const emptyBodyMsg = "Body Required"
-const contentNotJsonMsg = "Content-Type must be \"" + ContentTypeJSON + "\""
-const unexpectedEOFMsg = "Bad Input(JSON) format, unexpected EOF"
+// the errors are compared as "code: detail"
+const methodNotAllowedMsg = "method_not_allowed: Method not allowed"
+const emptyBodyMsg = "body_required: Body Required"
+const contentNotJsonMsg = "unsupported_content_type: Content-Type must be \"" + ContentTypeJSON + "\""
+const unexpectedEOFMsg = "invalid_body: unexpected EOF"
 
-const contentNotUrlEncMsg = "Content-Type must be \"" + ContentTypeURLENCODED + "\""
-const multipleKeysMsg = "Multiple values detected, the only valid input is 1 \"ID=X\""
-const keyNotIdMsg = "Invalid key detected, the only valid input is 1 \"ID=X\""
-const multipleIdMsg = "Only one ID is allowed, and it must be an int"
-const idNotIntMsg = "ID must be a positive int"
+const contentNotUrlEncMsg = "unsupported_content_type: Content-Type must be \"" + ContentTypeURLENCODED + "\""
+const multipleKeysMsg = "invalid_form: Multiple values detected, the only valid input is 1 \"ID=X\""
+const keyNotIdMsg = "invalid_form: Invalid key detected, the only valid input is 1 \"ID=X\""
+const multipleIdMsg = "invalid_form: Only one ID is allowed, and it must be an int"
+const idNotIntMsg = "invalid_group_id: ID must be a positive int"
+const groupNotFoundMsg = "group_not_found: group not found"
+const carNotFoundMsg = "car_not_found: car not found"
 
 type testReqArgs struct {
 	w       *httptest.ResponseRecorder
@@ -53,7 +60,8 @@ func Test_statusHandler(t *testing.T) {
 		{"MethodGET", args{httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/status", nil)}, http.StatusOK},
 		{"MethodNotGET", args{httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/status", nil)}, http.StatusMethodNotAllowed},
 	}
-	handler := http.HandlerFunc(statusHandler)
+	h := &handlers{dispatcher: NewDispatcher()}
+	handler := http.HandlerFunc(h.statusHandler)
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			handler.ServeHTTP(tt.args.w, tt.args.r)
@@ -65,11 +73,11 @@ func Test_statusHandler(t *testing.T) {
 }
 
 func Test_carsHandler(t *testing.T) {
-	const missingIdOrSeatsMsg = "Bad Input(JSON) format, id and seats are required for all cars"
-	const idIs0Msg = "Bad Input(JSON) format, id must be different from 0"
-	const idNotMinSeatsMsg = "Bad Input(JSON) format, seats must be > 3"
-	const idNotMaxSeatsMsg = "Bad Input(JSON) format, seats must be < 7"
-	const idRepeatedMsg = "Bad Input(JSON) format, cars Ids must be unique"
+	const missingIdOrSeatsMsg = "invalid_body: id and seats are required for all cars"
+	const idIs0Msg = "invalid_body: id must be different from 0"
+	const idNotMinSeatsMsg = "invalid_body: seats must be > 3"
+	const idNotMaxSeatsMsg = "invalid_body: seats must be < 7"
+	const idRepeatedMsg = "car_id_repeated: cars Ids must be unique"
 	tests := []struct {
 		name   string
 		args   testReqArgs
@@ -89,8 +97,8 @@ func Test_carsHandler(t *testing.T) {
 		{"MethodPUTInvalidJson", testReqArgs{httptest.NewRecorder(), `[`, http.MethodPut, ContentTypeJSON}, http.StatusBadRequest, unexpectedEOFMsg},
 		{"MethodPUT", testReqArgs{httptest.NewRecorder(), `[ { "id": 2, "seats": 4 } ]`, http.MethodPut, ContentTypeJSON}, http.StatusOK, ""},
 	}
-	startStorage()
-	handler := http.HandlerFunc(carsHandler)
+	h := &handlers{dispatcher: NewDispatcher()}
+	handler := http.HandlerFunc(h.carsHandler)
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			req := prepareTestRequest(tt.args, "/cars")
@@ -98,18 +106,98 @@ func Test_carsHandler(t *testing.T) {
 			if tt.args.w.Code != tt.status {
 				t.Fatalf("(Expected) %d != %d (Returned)", tt.status, tt.args.w.Code)
 			}
-			if tt.args.w.Body.String() != tt.tstMsg {
-				t.Fatalf("(Expected) %s != %s (Returned)", tt.tstMsg, tt.args.w.Body.String())
+			if responseMessage(tt.args.w) != tt.tstMsg {
+				t.Fatalf("(Expected) %s != %s (Returned)", tt.tstMsg, responseMessage(tt.args.w))
+			}
+		})
+	}
+}
+
+func Test_carsHandlerReconcile(t *testing.T) {
+	const invalidModeMsg = "invalid_cars_mode: Invalid mode, the only valid mode is \"reconcile\""
+	h := &handlers{dispatcher: NewDispatcher()}
+	simulateTestCall(t, reqArgs{`[ { "id": 1, "seats": 4 } ]`, "PUT", "/cars", h.carsHandler, ContentTypeJSON})
+	simulateTestCall(t, reqArgs{`{ "id": 1, "people": 4 }`, "POST", "/journey", h.journeyHandler, ContentTypeJSON})
+	simulateTestCall(t, reqArgs{`{ "id": 2, "people": 6 }`, "POST", "/journey", h.journeyHandler, ContentTypeJSON})
+
+	w := httptest.NewRecorder()
+	h.carsHandler(w, prepareTestRequest(testReqArgs{w, `[]`, http.MethodPut, ContentTypeJSON}, "/cars?mode=merge"))
+	if w.Code != http.StatusBadRequest || responseMessage(w) != invalidModeMsg {
+		t.Fatalf("(Expected) %d %s != %d %s (Returned)", http.StatusBadRequest, invalidModeMsg, w.Code, responseMessage(w))
+	}
+
+	simulateTestCall(t, reqArgs{`[ { "id": 1, "seats": 4 }, { "id": 2, "seats": 6 } ]`, "PUT", "/cars?mode=reconcile", h.carsHandler, ContentTypeJSON})
+	for _, tt := range []struct {
+		body     string
+		expected string
+	}{
+		{"ID=1", `{"id":1,"seats":4}` + "\n"},
+		{"ID=2", `{"id":2,"seats":6}` + "\n"},
+	} {
+		w := simulateTestCall(t, reqArgs{tt.body, "POST", "/locate", h.locateHandler, ContentTypeURLENCODED})
+		if w.Body.String() != tt.expected {
+			t.Fatalf("(Expected) %s != %s (Returned)", tt.expected, w.Body.String())
+		}
+	}
+}
+
+func Test_carHandler(t *testing.T) {
+	const invalidCarIdMsg = "invalid_car_id: Car ID must be a positive int"
+	const missingFieldsMsg = "invalid_body: seats or status is required"
+	const missingSeatsMsg = "invalid_body: seats is required"
+	const invalidStatusMsg = "invalid_body: status must be \"in_service\", \"paused\" or \"out_of_service\""
+	const transitionMsg = "car_status_transition: the car can not move to that status"
+	const carExistsMsg = "car_id_repeated: cars Ids must be unique"
+	tests := []struct {
+		name   string
+		path   string
+		args   testReqArgs
+		status int
+		tstMsg string
+	}{
+		{"MethodNotAllowed", "/cars/3", testReqArgs{httptest.NewRecorder(), "nil", http.MethodPut, ""}, http.StatusMethodNotAllowed, methodNotAllowedMsg},
+		{"PostEmptyBody", "/cars/3", testReqArgs{httptest.NewRecorder(), "nil", http.MethodPost, ContentTypeJSON}, http.StatusBadRequest, emptyBodyMsg},
+		{"PostNotJSON", "/cars/3", testReqArgs{httptest.NewRecorder(), `{ "seats": 4 }`, http.MethodPost, ContentTypeURLENCODED}, http.StatusBadRequest, contentNotJsonMsg},
+		{"PostInvalidId", "/cars/x", testReqArgs{httptest.NewRecorder(), `{ "seats": 4 }`, http.MethodPost, ContentTypeJSON}, http.StatusBadRequest, invalidCarIdMsg},
+		{"PostId0", "/cars/0", testReqArgs{httptest.NewRecorder(), `{ "seats": 4 }`, http.MethodPost, ContentTypeJSON}, http.StatusBadRequest, invalidCarIdMsg},
+		{"PostMissFields", "/cars/3", testReqArgs{httptest.NewRecorder(), `{}`, http.MethodPost, ContentTypeJSON}, http.StatusBadRequest, missingFieldsMsg},
+		{"PostMissSeats", "/cars/3", testReqArgs{httptest.NewRecorder(), `{ "status": "in_service" }`, http.MethodPost, ContentTypeJSON}, http.StatusBadRequest, missingSeatsMsg},
+		{"PostPaused", "/cars/3", testReqArgs{httptest.NewRecorder(), `{ "seats": 4, "status": "paused" }`, http.MethodPost, ContentTypeJSON}, http.StatusBadRequest, "invalid_body: a new car must be \"in_service\""},
+		{"PostTooManySeats", "/cars/3", testReqArgs{httptest.NewRecorder(), `{ "seats": 7 }`, http.MethodPost, ContentTypeJSON}, http.StatusBadRequest, "invalid_body: seats must be < 7"},
+		{"Post", "/cars/3", testReqArgs{httptest.NewRecorder(), `{ "seats": 4 }`, http.MethodPost, ContentTypeJSON}, http.StatusOK, ""},
+		{"PostRepeatedId", "/cars/3", testReqArgs{httptest.NewRecorder(), `{ "seats": 5 }`, http.MethodPost, ContentTypeJSON}, http.StatusConflict, carExistsMsg},
+		{"Patch", "/cars/3", testReqArgs{httptest.NewRecorder(), `{ "seats": 6 }`, http.MethodPatch, ContentTypeJSON}, http.StatusOK, ""},
+		{"PatchNonexistentCar", "/cars/4", testReqArgs{httptest.NewRecorder(), `{ "seats": 6 }`, http.MethodPatch, ContentTypeJSON}, http.StatusNotFound, carNotFoundMsg},
+		{"PatchInvalidStatus", "/cars/3", testReqArgs{httptest.NewRecorder(), `{ "status": "broken" }`, http.MethodPatch, ContentTypeJSON}, http.StatusBadRequest, invalidStatusMsg},
+		{"PatchPaused", "/cars/3", testReqArgs{httptest.NewRecorder(), `{ "status": "paused" }`, http.MethodPatch, ContentTypeJSON}, http.StatusOK, ""},
+		{"GetPaused", "/cars/3", testReqArgs{httptest.NewRecorder(), "nil", http.MethodGet, ""}, http.StatusOK, `{"id":3,"seats":6,"free_seats":6,"status":"paused","groups":[]}` + "\n"},
+		{"PatchOutOfService", "/cars/3", testReqArgs{httptest.NewRecorder(), `{ "status": "out_of_service" }`, http.MethodPatch, ContentTypeJSON}, http.StatusOK, ""},
+		{"PatchInvalidTransition", "/cars/3", testReqArgs{httptest.NewRecorder(), `{ "status": "paused" }`, http.MethodPatch, ContentTypeJSON}, http.StatusConflict, transitionMsg},
+		{"GetNonexistentCar", "/cars/4", testReqArgs{httptest.NewRecorder(), "nil", http.MethodGet, ""}, http.StatusNotFound, carNotFoundMsg},
+		{"Delete", "/cars/3", testReqArgs{httptest.NewRecorder(), "nil", http.MethodDelete, ""}, http.StatusOK, ""},
+		{"DeleteNonexistentCar", "/cars/3", testReqArgs{httptest.NewRecorder(), "nil", http.MethodDelete, ""}, http.StatusNotFound, carNotFoundMsg},
+	}
+	h := &handlers{dispatcher: NewDispatcher()}
+	handler := http.HandlerFunc(h.carHandler)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := prepareTestRequest(tt.args, tt.path)
+			handler.ServeHTTP(tt.args.w, req)
+			if tt.args.w.Code != tt.status {
+				t.Fatalf("(Expected) %d != %d (Returned)", tt.status, tt.args.w.Code)
+			}
+			if responseMessage(tt.args.w) != tt.tstMsg {
+				t.Fatalf("(Expected) %s != %s (Returned)", tt.tstMsg, responseMessage(tt.args.w))
 			}
 		})
 	}
 }
 
 func Test_journeyHandler(t *testing.T) {
-	const MinPeopleMsg = "Bad Input(JSON) format, number of people should be between 1 or 6"
-	const MaxPeopleMsg = "Bad Input(JSON) format, number of people should be 6 at most"
-	const IdOrPeopleMissMsg = "Bad Input(JSON) format, id and people are required for all groups"
-	const repeatedIdMsg = "Error, group Id already exists"
+	const MinPeopleMsg = "invalid_body: number of people should be between 1 or 6"
+	const MaxPeopleMsg = "invalid_body: number of people should be 6 at most"
+	const IdOrPeopleMissMsg = "invalid_body: id and people are required for all groups"
+	const repeatedIdMsg = "group_id_repeated: group Id already exists"
 	tests := []struct {
 		name   string
 		args   testReqArgs
@@ -128,23 +216,23 @@ func Test_journeyHandler(t *testing.T) {
 		{"MethodPostInvalidJson", testReqArgs{httptest.NewRecorder(), `{`, http.MethodPost, ContentTypeJSON}, http.StatusBadRequest, unexpectedEOFMsg},
 		{"MethodPost", testReqArgs{httptest.NewRecorder(), `{ "id": 2, "people": 4 }`, http.MethodPost, ContentTypeJSON}, http.StatusAccepted, ""},
 	}
-	startStorage()
-	handler := http.HandlerFunc(journeyHandler)
+	h := &handlers{dispatcher: NewDispatcher()}
+	handler := http.HandlerFunc(h.journeyHandler)
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			if tt.name == "MethodPostRepeatedId" {
-				simulateTestCall(t, reqArgs{`{ "id": 2, "people": 4 }`, "POST", "/journey", journeyHandler, ContentTypeJSON})
+				simulateTestCall(t, reqArgs{`{ "id": 2, "people": 4 }`, "POST", "/journey", h.journeyHandler, ContentTypeJSON})
 			}
 			req := prepareTestRequest(tt.args, "/journey")
 			handler.ServeHTTP(tt.args.w, req)
 			if tt.args.w.Code != tt.status {
 				t.Fatalf("(Expected) %d != %d (Returned)", tt.status, tt.args.w.Code)
 			}
-			if tt.args.w.Body.String() != tt.tstMsg {
-				t.Fatalf("(Expected) %s != %s (Returned)", tt.tstMsg, tt.args.w.Body.String())
+			if responseMessage(tt.args.w) != tt.tstMsg {
+				t.Fatalf("(Expected) %s != %s (Returned)", tt.tstMsg, responseMessage(tt.args.w))
 			}
 			if tt.name == "MethodPostRepeatedId" {
-				simulateTestCall(t, reqArgs{"ID=2", "POST", "/dropoff", dropoffHandler, ContentTypeURLENCODED})
+				simulateTestCall(t, reqArgs{"ID=2", "POST", "/dropoff", h.dropoffHandler, ContentTypeURLENCODED})
 			}
 		})
 	}
@@ -166,57 +254,57 @@ func Test_dropoffHandler(t *testing.T) {
 		{"PostKeyIsNotId", testReqArgs{httptest.NewRecorder(), "IDX=7", http.MethodPost, ContentTypeURLENCODED}, http.StatusBadRequest, keyNotIdMsg},
 		{"PostMultipleId", testReqArgs{httptest.NewRecorder(), "ID=7&ID=8", http.MethodPost, ContentTypeURLENCODED}, http.StatusBadRequest, multipleIdMsg},
 		{"PostIdNotInt", testReqArgs{httptest.NewRecorder(), "ID=X", http.MethodPost, ContentTypeURLENCODED}, http.StatusBadRequest, idNotIntMsg},
-		{"PostNonexistentGroup", testReqArgs{httptest.NewRecorder(), "ID=7", http.MethodPost, ContentTypeURLENCODED}, http.StatusNotFound, ""},
+		{"PostNonexistentGroup", testReqArgs{httptest.NewRecorder(), "ID=7", http.MethodPost, ContentTypeURLENCODED}, http.StatusNotFound, groupNotFoundMsg},
 		{"PostGroupWithoutCar", testReqArgs{httptest.NewRecorder(), "ID=7", http.MethodPost, ContentTypeURLENCODED}, http.StatusNoContent, ""},
 		{"PostGroupWithCar", testReqArgs{httptest.NewRecorder(), "ID=7", http.MethodPost, ContentTypeURLENCODED}, http.StatusOK, ""},
 		{"PostGroupWithCarAssign", testReqArgs{httptest.NewRecorder(), "ID=7", http.MethodPost, ContentTypeURLENCODED}, http.StatusOK, ""},
 		{"PostGroupWithCarAssignRemoveDropped", testReqArgs{httptest.NewRecorder(), "ID=7", http.MethodPost, ContentTypeURLENCODED}, http.StatusOK, ""},
 	}
-	startStorage()
-	handler := http.HandlerFunc(dropoffHandler)
+	h := &handlers{dispatcher: NewDispatcher()}
+	handler := http.HandlerFunc(h.dropoffHandler)
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			if tt.name == "PostGroupWithoutCar" {
-				simulateTestCall(t, reqArgs{`[]`, "PUT", "/cars", carsHandler, ContentTypeJSON})
-				simulateTestCall(t, reqArgs{`{ "id": 7, "people": 5 }`, "POST", "/journey", journeyHandler, ContentTypeJSON})
+				simulateTestCall(t, reqArgs{`[]`, "PUT", "/cars", h.carsHandler, ContentTypeJSON})
+				simulateTestCall(t, reqArgs{`{ "id": 7, "people": 5 }`, "POST", "/journey", h.journeyHandler, ContentTypeJSON})
 			} else if tt.name == "PostGroupWithCar" {
-				simulateTestCall(t, reqArgs{`[ { "id": 3, "seats": 5 } ]`, "PUT", "/cars", carsHandler, ContentTypeJSON})
-				simulateTestCall(t, reqArgs{`{ "id": 7, "people": 5 }`, "POST", "/journey", journeyHandler, ContentTypeJSON})
+				simulateTestCall(t, reqArgs{`[ { "id": 3, "seats": 5 } ]`, "PUT", "/cars", h.carsHandler, ContentTypeJSON})
+				simulateTestCall(t, reqArgs{`{ "id": 7, "people": 5 }`, "POST", "/journey", h.journeyHandler, ContentTypeJSON})
 			} else if tt.name == "PostGroupWithCarAssign" {
-				simulateTestCall(t, reqArgs{`[ { "id": 3, "seats": 5 } ]`, "PUT", "/cars", carsHandler, ContentTypeJSON})
-				simulateTestCall(t, reqArgs{`{ "id": 7, "people": 4 }`, "POST", "/journey", journeyHandler, ContentTypeJSON})
-				simulateTestCall(t, reqArgs{`{ "id": 4, "people": 4 }`, "POST", "/journey", journeyHandler, ContentTypeJSON})
+				simulateTestCall(t, reqArgs{`[ { "id": 3, "seats": 5 } ]`, "PUT", "/cars", h.carsHandler, ContentTypeJSON})
+				simulateTestCall(t, reqArgs{`{ "id": 7, "people": 4 }`, "POST", "/journey", h.journeyHandler, ContentTypeJSON})
+				simulateTestCall(t, reqArgs{`{ "id": 4, "people": 4 }`, "POST", "/journey", h.journeyHandler, ContentTypeJSON})
 			} else if tt.name == "PostGroupWithCarAssignRemoveDropped" {
-				simulateTestCall(t, reqArgs{`[ { "id": 3, "seats": 5 } ]`, "PUT", "/cars", carsHandler, ContentTypeJSON})
-				simulateTestCall(t, reqArgs{`{ "id": 7, "people": 4 }`, "POST", "/journey", journeyHandler, ContentTypeJSON})
+				simulateTestCall(t, reqArgs{`[ { "id": 3, "seats": 5 } ]`, "PUT", "/cars", h.carsHandler, ContentTypeJSON})
+				simulateTestCall(t, reqArgs{`{ "id": 7, "people": 4 }`, "POST", "/journey", h.journeyHandler, ContentTypeJSON})
 				// add 2 waiting groups
-				simulateTestCall(t, reqArgs{`{ "id": 4, "people": 4 }`, "POST", "/journey", journeyHandler, ContentTypeJSON})
-				simulateTestCall(t, reqArgs{`{ "id": 5, "people": 4 }`, "POST", "/journey", journeyHandler, ContentTypeJSON})
-				// drop a waiting group, waiting list is not updated until we try to assign a new waiting group
-				simulateTestCall(t, reqArgs{"ID=4", "POST", "/dropoff", dropoffHandler, ContentTypeURLENCODED})
+				simulateTestCall(t, reqArgs{`{ "id": 4, "people": 4 }`, "POST", "/journey", h.journeyHandler, ContentTypeJSON})
+				simulateTestCall(t, reqArgs{`{ "id": 5, "people": 4 }`, "POST", "/journey", h.journeyHandler, ContentTypeJSON})
+				// drop a waiting group, it must leave the waiting list
+				simulateTestCall(t, reqArgs{"ID=4", "POST", "/dropoff", h.dropoffHandler, ContentTypeURLENCODED})
 			}
 			req := prepareTestRequest(tt.args, "/dropoff")
 			handler.ServeHTTP(tt.args.w, req)
 			if tt.args.w.Code != tt.status {
 				t.Fatalf("(Expected) %d != %d (Returned)", tt.status, tt.args.w.Code)
 			}
-			if tt.args.w.Body.String() != tt.tstMsg {
-				t.Fatalf("(Expected) %s != %s (Returned)", tt.tstMsg, tt.args.w.Body.String())
+			if responseMessage(tt.args.w) != tt.tstMsg {
+				t.Fatalf("(Expected) %s != %s (Returned)", tt.tstMsg, responseMessage(tt.args.w))
 			}
 			if tt.name == "PostGroupWithCarAssign" {
-				w := simulateTestCall(t, reqArgs{"ID=4", "POST", "/locate", locateHandler, ContentTypeURLENCODED})
-				expected := `{ "id": 3, "seats": 5 }`
+				w := simulateTestCall(t, reqArgs{"ID=4", "POST", "/locate", h.locateHandler, ContentTypeURLENCODED})
+				expected := `{"id":3,"seats":5}` + "\n"
 				if w.Body.String() != expected {
 					t.Fatalf("(Expected) %s != %s (Returned)", expected, w.Body.String())
 				}
 			} else if tt.name == "PostGroupWithCarAssignRemoveDropped" {
-				w := simulateTestCall(t, reqArgs{"ID=5", "POST", "/locate", locateHandler, ContentTypeURLENCODED})
-				expected := `{ "id": 3, "seats": 5 }`
+				w := simulateTestCall(t, reqArgs{"ID=5", "POST", "/locate", h.locateHandler, ContentTypeURLENCODED})
+				expected := `{"id":3,"seats":5}` + "\n"
 				if w.Body.String() != expected {
-					t.Logf("car %v", journeysMap[5])
+					t.Logf("car %v", h.dispatcher.journeysMap[5])
 					t.Fatalf("(Expected) %s != %s (Returned)", expected, w.Body.String())
 				}
-				if len(waitingGroups) != 0 {
+				if h.dispatcher.waitingGroups.len() != 0 {
 					t.Fatalf("Waiting group was not updated")
 				}
 			}
@@ -240,35 +328,41 @@ func Test_locateHandler(t *testing.T) {
 		{"MethodPostKeyIsNotId", testReqArgs{httptest.NewRecorder(), "IDX=7", http.MethodPost, ContentTypeURLENCODED}, http.StatusBadRequest, keyNotIdMsg},
 		{"MethodPostMultipleId", testReqArgs{httptest.NewRecorder(), "ID=7&ID=8", http.MethodPost, ContentTypeURLENCODED}, http.StatusBadRequest, multipleIdMsg},
 		{"MethodPostIdNotInt", testReqArgs{httptest.NewRecorder(), "ID=X", http.MethodPost, ContentTypeURLENCODED}, http.StatusBadRequest, idNotIntMsg},
-		{"MethodPostNonexistentGroup", testReqArgs{httptest.NewRecorder(), "ID=7", http.MethodPost, ContentTypeURLENCODED}, http.StatusNotFound, ""},
+		{"MethodPostNonexistentGroup", testReqArgs{httptest.NewRecorder(), "ID=7", http.MethodPost, ContentTypeURLENCODED}, http.StatusNotFound, groupNotFoundMsg},
 		{"MethodPostGroupWithoutCar", testReqArgs{httptest.NewRecorder(), "ID=7", http.MethodPost, ContentTypeURLENCODED}, http.StatusNoContent, ""},
-		{"MethodPostGroupToSameSizeCar", testReqArgs{httptest.NewRecorder(), "ID=7", http.MethodPost, ContentTypeURLENCODED}, http.StatusOK, "{ \"id\": 3, \"seats\": 5 }"},
-		{"MethodPostGroupToDiffSizeCar", testReqArgs{httptest.NewRecorder(), "ID=8", http.MethodPost, ContentTypeURLENCODED}, http.StatusOK, "{ \"id\": 5, \"seats\": 5 }"},
+		{"MethodPostGroupToSameSizeCar", testReqArgs{httptest.NewRecorder(), "ID=7", http.MethodPost, ContentTypeURLENCODED}, http.StatusOK, `{"id":3,"seats":5}` + "\n"},
+		{"MethodPostGroupToDiffSizeCar", testReqArgs{httptest.NewRecorder(), "ID=8", http.MethodPost, ContentTypeURLENCODED}, http.StatusOK, `{"id":5,"seats":5}` + "\n"},
 	}
-	startStorage()
-	handler := http.HandlerFunc(locateHandler)
+	h := &handlers{dispatcher: NewDispatcher()}
+	handler := http.HandlerFunc(h.locateHandler)
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			if tt.name == "MethodPostGroupWithoutCar" {
-				simulateTestCall(t, reqArgs{`[]`, "PUT", "/cars", carsHandler, ContentTypeJSON})
-				simulateTestCall(t, reqArgs{`{ "id": 7, "people": 3 }`, "POST", "/journey", journeyHandler, ContentTypeJSON})
+				simulateTestCall(t, reqArgs{`[]`, "PUT", "/cars", h.carsHandler, ContentTypeJSON})
+				simulateTestCall(t, reqArgs{`{ "id": 7, "people": 3 }`, "POST", "/journey", h.journeyHandler, ContentTypeJSON})
 			} else if tt.name == "MethodPostGroupToSameSizeCar" {
-				simulateTestCall(t, reqArgs{`[ { "id": 3, "seats": 5 } ]`, "PUT", "/cars", carsHandler, ContentTypeJSON})
-				simulateTestCall(t, reqArgs{`{ "id": 7, "people": 5 }`, "POST", "/journey", journeyHandler, ContentTypeJSON})
+				simulateTestCall(t, reqArgs{`[ { "id": 3, "seats": 5 } ]`, "PUT", "/cars", h.carsHandler, ContentTypeJSON})
+				simulateTestCall(t, reqArgs{`{ "id": 7, "people": 5 }`, "POST", "/journey", h.journeyHandler, ContentTypeJSON})
 			} else if tt.name == "MethodPostGroupToDiffSizeCar" {
-				simulateTestCall(t, reqArgs{`[ { "id": 5, "seats": 5 } ]`, "PUT", "/cars", carsHandler, ContentTypeJSON})
-				simulateTestCall(t, reqArgs{`{ "id": 8, "people": 4 }`, "POST", "/journey", journeyHandler, ContentTypeJSON})
+				simulateTestCall(t, reqArgs{`[ { "id": 5, "seats": 5 } ]`, "PUT", "/cars", h.carsHandler, ContentTypeJSON})
+				simulateTestCall(t, reqArgs{`{ "id": 8, "people": 4 }`, "POST", "/journey", h.journeyHandler, ContentTypeJSON})
 			}
 			req := prepareTestRequest(tt.args, "/locate")
 			handler.ServeHTTP(tt.args.w, req)
 			if tt.args.w.Code != tt.status {
 				t.Fatalf("(Expected) %d != %d (Returned)", tt.status, tt.args.w.Code)
 			}
-			if tt.args.w.Body.String() != tt.tstMsg {
-				t.Fatalf("(Expected) %s != %s (Returned)", tt.tstMsg, tt.args.w.Body.String())
+			if responseMessage(tt.args.w) != tt.tstMsg {
+				t.Fatalf("(Expected) %s != %s (Returned)", tt.tstMsg, responseMessage(tt.args.w))
+			}
+			ctype := ContentTypeProblemJSON
+			if tt.status == http.StatusOK {
+				ctype = ContentTypeJSON
+			} else if tt.status == http.StatusNoContent {
+				ctype = ""
 			}
-			if tt.args.w.Header().Get("Content-Type") != ContentTypeJSON {
-				t.Fatalf("(Expected) %s != %s (Returned)", tt.args.w.Header().Get("Content-Type"), ContentTypeJSON)
+			if tt.args.w.Header().Get("Content-Type") != ctype {
+				t.Fatalf("(Expected) %s != %s (Returned)", ctype, tt.args.w.Header().Get("Content-Type"))
 			}
 		})
 	}
@@ -277,6 +371,65 @@ func Test_locateHandler(t *testing.T) {
 	//cleanJourneysAndCars()
 }
 
+// Run it with "go test -race", it hammers every endpoint from several
+// goroutines at the same time
+func Test_concurrentRequests(t *testing.T) {
+	const workers = 8
+	const requestsPerWorker = 300
+	h := &handlers{dispatcher: NewDispatcher()}
+	simulateTestCall(t, reqArgs{`[ { "id": 1, "seats": 4 }, { "id": 2, "seats": 5 }, { "id": 3, "seats": 6 } ]`, "PUT", "/cars", h.carsHandler, ContentTypeJSON})
+
+	errs := make(chan error, workers*requestsPerWorker)
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(worker)))
+			for i := 0; i < requestsPerWorker; i++ {
+				groupId := worker*requestsPerWorker + i
+				var args reqArgs
+				switch rnd.Intn(10) {
+				case 0:
+					args = reqArgs{`[ { "id": 1, "seats": 4 }, { "id": 2, "seats": 6 } ]`, "PUT", "/cars", h.carsHandler, ContentTypeJSON}
+				case 1, 2, 3:
+					args = reqArgs{fmt.Sprintf(`{ "id": %d, "people": %d }`, groupId, rnd.Intn(6)+1), "POST", "/journey", h.journeyHandler, ContentTypeJSON}
+				case 4, 5, 6:
+					args = reqArgs{fmt.Sprintf("ID=%d", rnd.Intn(groupId+1)), "POST", "/locate", h.locateHandler, ContentTypeURLENCODED}
+				case 7, 8:
+					args = reqArgs{fmt.Sprintf("ID=%d", rnd.Intn(groupId+1)), "POST", "/dropoff", h.dropoffHandler, ContentTypeURLENCODED}
+				default:
+					args = reqArgs{"", "GET", "/status", h.statusHandler, ""}
+				}
+				W := httptest.NewRecorder()
+				req := httptest.NewRequest(args.method, args.path, strings.NewReader(args.body))
+				req.Header.Add("Content-Type", args.ctype)
+				http.HandlerFunc(args.handler).ServeHTTP(W, req)
+				switch W.Code {
+				case http.StatusOK, http.StatusAccepted, http.StatusNoContent, http.StatusNotFound:
+				default:
+					errs <- fmt.Errorf("%s %s returned %d: %s", args.method, args.path, W.Code, W.Body.String())
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// responseMessage returns the body, or "code: detail" for an error
+func responseMessage(w *httptest.ResponseRecorder) string {
+	if w.Header().Get("Content-Type") != ContentTypeProblemJSON {
+		return w.Body.String()
+	}
+	problem := Problem{}
+	json.Unmarshal(w.Body.Bytes(), &problem)
+	return fmt.Sprintf("%s: %s", problem.Code, problem.Detail)
+}
+
 type reqArgs struct {
 	body    string
 	method  string
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HeaderRequestID correlates the log lines of a request, an incoming one is
+// kept and the response always carries it
+const HeaderRequestID = "X-Request-ID"
+
+// maxRequestIDLength is the longest incoming request id that is kept, a
+// longer or unprintable one is replaced by a new one
+const maxRequestIDLength = 128
+
+// LogLevel is the severity of a line of the access log, the level of a
+// request comes from its status and its path
+type LogLevel int
+
+const (
+	// LogDebug is the level of the probes and the scrapes, /status, /live,
+	// /ready and /metrics
+	LogDebug LogLevel = iota
+	// LogInfo is the level of the requests answered with a 1xx, 2xx or 3xx
+	LogInfo
+	// LogWarn is the level of the requests answered with a 4xx
+	LogWarn
+	// LogError is the level of the requests answered with a 5xx
+	LogError
+	// LogOff writes nothing
+	LogOff
+)
+
+var logLevels = map[string]LogLevel{
+	"debug": LogDebug,
+	"info":  LogInfo,
+	"warn":  LogWarn,
+	"error": LogError,
+	"off":   LogOff,
+}
+
+// LogLevelByName returns the level with the given name, it is used to choose
+// the level from the configuration
+func LogLevelByName(name string) (LogLevel, error) {
+	level, ok := logLevels[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %q, valid ones are %v", name, LogLevelNames())
+	}
+	return level, nil
+}
+
+func LogLevelNames() []string {
+	names := make([]string, 0, len(logLevels))
+	for name := range logLevels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (level LogLevel) String() string {
+	for name, known := range logLevels {
+		if known == level {
+			return name
+		}
+	}
+	return strconv.Itoa(int(level))
+}
+
+// AccessLogConfig configures an AccessLogger
+type AccessLogConfig struct {
+	// Output receives a json line per request
+	Output io.Writer
+	// Level is the lowest level written
+	Level LogLevel
+}
+
+// AccessLogger writes a json line for every request with its id, its status,
+// its latency and the groups, the cars and the decision of the dispatcher
+// that the handlers report. Its Middleware is given to New, as the first one
+// so the latency includes the other middlewares
+type AccessLogger struct {
+	mu     sync.Mutex
+	config AccessLogConfig
+}
+
+// NewAccessLogger returns a logger that writes to config.Output
+func NewAccessLogger(config AccessLogConfig) *AccessLogger {
+	return &AccessLogger{config: config}
+}
+
+// AccessLogEntry is a line of the access log
+type AccessLogEntry struct {
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`
+	RequestID string    `json:"request_id"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	LatencyMs float64   `json:"latency_ms"`
+	Bytes     int64     `json:"bytes"`
+	Remote    string    `json:"remote,omitempty"`
+	GroupId   uint      `json:"group_id,omitempty"`
+	CarId     uint      `json:"car_id,omitempty"`
+	// Decision is what the dispatcher did with the request, such as assigned
+	// or waiting for a journey
+	Decision string `json:"decision,omitempty"`
+}
+
+// requestLog collects what the handlers report about a request
+type requestLog struct {
+	groupId  uint
+	carId    uint
+	decision string
+}
+
+type requestLogKey struct{}
+
+// logGroup, logCar and logDecision report to the access log the group, the
+// car and the decision of the dispatcher of a request, they do nothing when
+// the requests are not logged
+func logGroup(r *http.Request, groupId uint) {
+	if fields, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		fields.groupId = groupId
+	}
+}
+
+func logCar(r *http.Request, carId uint) {
+	if fields, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		fields.carId = carId
+	}
+}
+
+func logDecision(r *http.Request, decision string) {
+	if fields, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		fields.decision = decision
+	}
+}
+
+// logJourney reports the car of a journey, a group without one is waiting
+func logJourney(r *http.Request, journey JourneyDetail) {
+	if journey.Car == nil {
+		logDecision(r, "waiting")
+		return
+	}
+	logCar(r, journey.Car.Id)
+	logDecision(r, "assigned")
+}
+
+// logDropoff reports if the group left its car or the waiting list
+func logDropoff(r *http.Request, travelling bool) {
+	if travelling {
+		logDecision(r, "dropped_off")
+		return
+	}
+	logDecision(r, "left_waiting")
+}
+
+// Middleware gives every request an id and logs it once it is answered
+func (l *AccessLogger) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestID := r.Header.Get(HeaderRequestID)
+		if !isValidRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(HeaderRequestID, requestID)
+		fields := &requestLog{}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, fields)))
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := requestLevel(r.URL.Path, status)
+		if level < l.config.Level || l.config.Output == nil {
+			return
+		}
+		l.write(AccessLogEntry{
+			Time:      start.UTC(),
+			Level:     level.String(),
+			RequestID: requestID,
+			Method:    r.Method,
+			Path:      r.URL.RequestURI(),
+			Status:    status,
+			LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+			Bytes:     sw.written,
+			Remote:    r.RemoteAddr,
+			GroupId:   fields.groupId,
+			CarId:     fields.carId,
+			Decision:  fields.decision,
+		})
+	})
+}
+
+func (l *AccessLogger) write(entry AccessLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.config.Output.Write(line)
+}
+
+func requestLevel(path string, status int) LogLevel {
+	switch {
+	case status >= http.StatusInternalServerError:
+		return LogError
+	case status >= http.StatusBadRequest:
+		return LogWarn
+	}
+	if _, ok := operationalPaths[path]; ok {
+		return LogDebug
+	}
+	return LogInfo
+}
+
+// isValidRequestID keeps the incoming ids that are safe to write to a header
+// and to a log
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for idx := 0; idx < len(id); idx++ {
+		if id[idx] <= ' ' || id[idx] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccessLogger(t *testing.T) {
+	output := &bytes.Buffer{}
+	logger := NewAccessLogger(AccessLogConfig{Output: output, Level: LogInfo})
+	handler := New("", NewDispatcher(), logger.Middleware).Handler
+	send := func(method, path, ctype, body, requestID string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", ctype)
+		if requestID != "" {
+			req.Header.Set(HeaderRequestID, requestID)
+		}
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	send("PUT", "/cars", ContentTypeJSON, `[ { "id": 1, "seats": 4 } ]`, "")
+	// the failed changes of the fleet log no decision
+	send("PUT", "/cars", ContentTypeJSON, `[ { "id": 2, "seats": 9 } ]`, "")
+	send("DELETE", "/cars/9", "", "", "")
+	send("GET", "/status", "", "", "")
+	send("POST", "/journey", ContentTypeJSON, `{ "id": 1, "people": 4 }`, "abc-1")
+	send("POST", "/journey", ContentTypeJSON, `{ "id": 2, "people": 2 }`, "with space")
+	send("POST", "/locate", ContentTypeURLENCODED, "ID=1", "")
+	send("POST", "/dropoff", ContentTypeURLENCODED, "ID=2", "")
+	send("GET", "/v2/groups/7", "", "", "")
+	w := send("DELETE", "/v2/groups/1", "", "", strings.Repeat("a", maxRequestIDLength+1))
+	if len(w.Header().Get(HeaderRequestID)) != 16 {
+		t.Fatalf("(Expected) a new request id != %q (Returned)", w.Header().Get(HeaderRequestID))
+	}
+
+	var tests = []struct {
+		level, method, path string
+		status              int
+		groupId, carId      uint
+		decision            string
+	}{
+		// the /status probe is debug
+		{"info", "PUT", "/cars", 200, 0, 0, "fleet_reset"},
+		{"warn", "PUT", "/cars", 400, 0, 0, ""},
+		{"warn", "DELETE", "/cars/9", 404, 0, 9, ""},
+		{"info", "POST", "/journey", 200, 1, 1, "assigned"},
+		{"info", "POST", "/journey", 202, 2, 0, "waiting"},
+		{"info", "POST", "/locate", 200, 1, 1, "travelling"},
+		{"info", "POST", "/dropoff", 204, 2, 0, "left_waiting"},
+		{"warn", "GET", "/v2/groups/7", 404, 7, 0, ""},
+		{"info", "DELETE", "/v2/groups/1", 204, 1, 0, "dropped_off"},
+	}
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != len(tests) {
+		t.Fatalf("(Expected) %d != %d (Returned) lines\n%s", len(tests), len(lines), output.String())
+	}
+	ids := map[string]struct{}{}
+	for idx, test := range tests {
+		entry := AccessLogEntry{}
+		if err := json.Unmarshal([]byte(lines[idx]), &entry); err != nil {
+			t.Fatalf("line %d: %v", idx+1, err)
+		}
+		if entry.Level != test.level || entry.Method != test.method || entry.Path != test.path || entry.Status != test.status ||
+			entry.GroupId != test.groupId || entry.CarId != test.carId || entry.Decision != test.decision {
+			t.Fatalf("line %d: (Expected) %+v != %s (Returned)", idx+1, test, lines[idx])
+		}
+		if entry.RequestID == "" || entry.LatencyMs < 0 || entry.Time.IsZero() {
+			t.Fatalf("line %d: the request id, the latency or the time is missing in %s", idx+1, lines[idx])
+		}
+		ids[entry.RequestID] = struct{}{}
+	}
+	if _, ok := ids["abc-1"]; !ok || len(ids) != len(tests) {
+		t.Fatalf("(Expected) abc-1 and unique ids != %v (Returned)", ids)
+	}
+}
+
+func TestAccessLoggerLevels(t *testing.T) {
+	var tests = []struct {
+		level  LogLevel
+		status int
+		path   string
+		logged bool
+	}{
+		{LogDebug, http.StatusOK, "/status", true},
+		{LogInfo, http.StatusOK, "/status", false},
+		{LogInfo, http.StatusOK, "/journey", true},
+		{LogWarn, http.StatusOK, "/journey", false},
+		{LogWarn, http.StatusNotFound, "/journey", true},
+		{LogError, http.StatusNotFound, "/journey", false},
+		{LogError, http.StatusServiceUnavailable, "/status", true},
+		{LogOff, http.StatusInternalServerError, "/journey", false},
+	}
+	for _, test := range tests {
+		output := &bytes.Buffer{}
+		logger := NewAccessLogger(AccessLogConfig{Output: output, Level: test.level})
+		handler := logger.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", test.path, nil))
+		if (output.Len() > 0) != test.logged {
+			t.Fatalf("%v %d %s: (Expected) %t != %t (Returned)", test.level, test.status, test.path, test.logged, output.Len() > 0)
+		}
+	}
+}
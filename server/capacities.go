@@ -0,0 +1,87 @@
+package server
+
+import "container/heap"
+
+// carSet keeps the ids of the cars with the same amount of free seats. It is
+// a min heap with the position of every id, so the lowest id is found in O(1)
+// and a car is added or removed in O(log n)
+type carSet struct {
+	ids []uint
+	pos map[uint]int
+}
+
+func newCarSet() *carSet {
+	return &carSet{pos: make(map[uint]int)}
+}
+
+func (s *carSet) Len() int           { return len(s.ids) }
+func (s *carSet) Less(i, j int) bool { return s.ids[i] < s.ids[j] }
+
+func (s *carSet) Swap(i, j int) {
+	s.ids[i], s.ids[j] = s.ids[j], s.ids[i]
+	s.pos[s.ids[i]] = i
+	s.pos[s.ids[j]] = j
+}
+
+func (s *carSet) Push(x any) {
+	id := x.(uint)
+	s.pos[id] = len(s.ids)
+	s.ids = append(s.ids, id)
+}
+
+func (s *carSet) Pop() any {
+	last := len(s.ids) - 1
+	id := s.ids[last]
+	s.ids = s.ids[:last]
+	delete(s.pos, id)
+	return id
+}
+
+func (s *carSet) add(carId uint) {
+	if _, ok := s.pos[carId]; !ok {
+		heap.Push(s, carId)
+	}
+}
+
+func (s *carSet) remove(carId uint) {
+	if idx, ok := s.pos[carId]; ok {
+		heap.Remove(s, idx)
+	}
+}
+
+// capacityIndex groups the cars by their amount of free seats
+type capacityIndex map[uint]*carSet
+
+func (c capacityIndex) add(freeSeats uint, carId uint) {
+	if c[freeSeats] == nil {
+		c[freeSeats] = newCarSet()
+	}
+	c[freeSeats].add(carId)
+}
+
+func (c capacityIndex) remove(freeSeats uint, carId uint) {
+	if c[freeSeats] != nil {
+		c[freeSeats].remove(carId)
+	}
+}
+
+func (c capacityIndex) Count(freeSeats uint) int {
+	if c[freeSeats] == nil {
+		return 0
+	}
+	return c[freeSeats].Len()
+}
+
+func (c capacityIndex) Lowest(freeSeats uint) uint {
+	if c.Count(freeSeats) == 0 {
+		return 0
+	}
+	return c[freeSeats].ids[0]
+}
+
+func (c capacityIndex) At(freeSeats uint, i int) uint {
+	if i < 0 || i >= c.Count(freeSeats) {
+		return 0
+	}
+	return c[freeSeats].ids[i]
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// CapturedRequest is a request of a traffic capture, a capture is a file with
+// one json line per request. Status and Response are the expected answer,
+// they are not checked when they are empty
+type CapturedRequest struct {
+	Time        time.Time `json:"time,omitempty"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	ContentType string    `json:"content_type,omitempty"`
+	Accept      string    `json:"accept,omitempty"`
+	Body        string    `json:"body,omitempty"`
+	Status      int       `json:"status,omitempty"`
+	Response    string    `json:"response,omitempty"`
+}
+
+// ReadCapture reads the requests of a capture, the empty lines are skipped
+func ReadCapture(r io.Reader) ([]CapturedRequest, error) {
+	requests := []CapturedRequest{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		request := CapturedRequest{}
+		if err := json.Unmarshal([]byte(line), &request); err != nil {
+			return nil, fmt.Errorf("capture line %d: %v", lineNumber, err)
+		}
+		if request.Method == "" || !strings.HasPrefix(request.Path, "/") {
+			return nil, fmt.Errorf("capture line %d: method and path are required", lineNumber)
+		}
+		requests = append(requests, request)
+	}
+	return requests, scanner.Err()
+}
+
+// Streaming tells if the request opened a stream that only ends with the
+// client, such as /events or a WebSocket, so it can not be replayed
+func (c CapturedRequest) Streaming() bool {
+	if c.Status == http.StatusSwitchingProtocols {
+		return true
+	}
+	path := strings.SplitN(c.Path, "?", 2)[0]
+	return c.Method == http.MethodGet && path == "/events" && (c.Status == 0 || c.Status == http.StatusOK)
+}
+
+// NewRequest builds the request to send it to the server at baseURL
+func (c CapturedRequest) NewRequest(baseURL string) (*http.Request, error) {
+	var body io.Reader = http.NoBody
+	if c.Body != "" {
+		body = strings.NewReader(c.Body)
+	}
+	req, err := http.NewRequest(c.Method, strings.TrimSuffix(baseURL, "/")+c.Path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.ContentType != "" {
+		req.Header.Set("Content-Type", c.ContentType)
+	}
+	if c.Accept != "" {
+		req.Header.Set("Accept", c.Accept)
+	}
+	return req, nil
+}
+
+// Matches tells if the response is the expected one. The bodies are compared
+// as json when both are valid json, so the spacing does not matter
+func (c CapturedRequest) Matches(status int, response string) bool {
+	if c.Status != 0 && c.Status != status {
+		return false
+	}
+	if c.Response == "" {
+		return true
+	}
+	var expected, returned any
+	if json.Unmarshal([]byte(c.Response), &expected) == nil && json.Unmarshal([]byte(response), &returned) == nil {
+		return reflect.DeepEqual(expected, returned)
+	}
+	return strings.TrimSpace(c.Response) == strings.TrimSpace(response)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadCapture(t *testing.T) {
+	tests := []struct {
+		name     string
+		capture  string
+		requests int
+		wantErr  bool
+	}{
+		{"Empty", "", 0, false},
+		{"EmptyLines", "\n{\"method\":\"GET\",\"path\":\"/status\"}\n\n{\"method\":\"GET\",\"path\":\"/status\",\"status\":200}\n", 2, false},
+		{"InvalidJson", "{\"method\":\"GET\"", 0, true},
+		{"MissingPath", "{\"method\":\"GET\"}", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests, err := ReadCapture(strings.NewReader(tt.capture))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadCapture() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(requests) != tt.requests {
+				t.Fatalf("(Expected) %d != %d (Returned)", tt.requests, len(requests))
+			}
+		})
+	}
+}
+
+// TestCapturedRequest_Replay sends a capture to the handler of a server, as
+// the replay command does
+func TestCapturedRequest_Replay(t *testing.T) {
+	capture := `{"method":"PUT","path":"/cars","content_type":"application/json","body":"[{\"id\":1,\"seats\":4}]","status":200}
+{"method":"POST","path":"/journey","content_type":"application/json","body":"{\"id\":1,\"people\":4}","status":200}
+{"method":"POST","path":"/journey","content_type":"application/json","body":"{\"id\":2,\"people\":1}","status":202}
+{"method":"POST","path":"/locate","content_type":"application/x-www-form-urlencoded","body":"ID=1","status":200,"response":"{\"id\":1,\"seats\":4}"}
+{"method":"POST","path":"/journey","content_type":"application/json","status":400}
+{"method":"POST","path":"/dropoff","content_type":"application/x-www-form-urlencoded","body":"ID=1"}`
+	requests, err := ReadCapture(strings.NewReader(capture))
+	if err != nil {
+		t.Fatalf("ReadCapture() error = %v", err)
+	}
+	handler := New("", NewDispatcher()).Handler
+	for idx, captured := range requests {
+		req, err := captured.NewRequest("http://localhost")
+		if err != nil {
+			t.Fatalf("NewRequest() error = %v", err)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		body, _ := io.ReadAll(w.Result().Body)
+		if !captured.Matches(w.Code, string(body)) {
+			t.Fatalf("request %d: (Expected) %d %s != %d %s (Returned)", idx+1, captured.Status, captured.Response, w.Code, body)
+		}
+	}
+}
+
+func TestCapturedRequest_Matches(t *testing.T) {
+	tests := []struct {
+		name     string
+		captured CapturedRequest
+		status   int
+		response string
+		want     bool
+	}{
+		{"NoExpectation", CapturedRequest{}, http.StatusTeapot, "tea", true},
+		{"SameStatus", CapturedRequest{Status: http.StatusOK}, http.StatusOK, "", true},
+		{"OtherStatus", CapturedRequest{Status: http.StatusOK}, http.StatusAccepted, "", false},
+		{"JsonSpacing", CapturedRequest{Status: http.StatusOK, Response: `{"id":1,"seats":4}`}, http.StatusOK, `{ "seats": 4, "id": 1 }`, true},
+		{"OtherJson", CapturedRequest{Response: `{"id":1,"seats":4}`}, http.StatusOK, `{ "id": 2, "seats": 4 }`, false},
+		{"Text", CapturedRequest{Response: "Method not allowed"}, http.StatusMethodNotAllowed, "Method not allowed\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.captured.Matches(tt.status, tt.response); got != tt.want {
+				t.Fatalf("(Expected) %v != %v (Returned)", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCapturedRequest_Streaming(t *testing.T) {
+	tests := []struct {
+		captured CapturedRequest
+		want     bool
+	}{
+		{CapturedRequest{Method: "GET", Path: "/events"}, true},
+		{CapturedRequest{Method: "GET", Path: "/events?group=2", Status: http.StatusOK}, true},
+		{CapturedRequest{Method: "GET", Path: "/events?group=x", Status: http.StatusBadRequest}, false},
+		{CapturedRequest{Method: "POST", Path: "/events", Status: http.StatusMethodNotAllowed}, false},
+		{CapturedRequest{Method: "GET", Path: "/v2/groups/2/ws", Status: http.StatusSwitchingProtocols}, true},
+		{CapturedRequest{Method: "GET", Path: "/status", Status: http.StatusOK}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.captured.Streaming(); got != tt.want {
+			t.Fatalf("%s %s: (Expected) %v != %v (Returned)", tt.captured.Method, tt.captured.Path, tt.want, got)
+		}
+	}
+}
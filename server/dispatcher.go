@@ -0,0 +1,225 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrCarIdRepeated = errors.New("cars Ids must be unique")
+var ErrGroupIdRepeated = errors.New("group Id already exists")
+var ErrGroupNotFound = errors.New("group not found")
+var ErrCarNotFound = errors.New("car not found")
+var ErrCarStatusTransition = errors.New("the car can not move to that status")
+
+// Dispatcher owns the fleet, the groups and the waiting list, and matches
+// groups with cars. The records of the cars and the groups are in its Store,
+// the maps below are the indexes of the dispatch logic. It does not depend on
+// the HTTP layer, and it is safe for concurrent use
+type Dispatcher struct {
+	mu            sync.Mutex
+	carsMap       map[uint]uint
+	carsSize      map[uint]uint
+	carsStatus    map[uint]CarStatus
+	groupsMap     map[uint]uint
+	capacitiesMap capacityIndex
+	// capacitiesBySize splits capacitiesMap by the seats of the cars
+	capacitiesBySize [MaxSeats + 1]capacityIndex
+	journeysMap      map[uint]uint
+	// carGroups keeps the groups travelling in every car in boarding order
+	carGroups     map[uint][]uint
+	waitingGroups *waitingList
+	// lists keeps the cars and the journeys ordered for the listings
+	lists     *listIndex
+	selector  CarSelector
+	fairness  FairnessPolicy
+	now       func() time.Time
+	dropoffs  dropoffRate
+	observers []Observer
+	store     Store
+	// pending keeps the changes of the current operation until it commits
+	pending []Change
+	seq     uint64
+	// assignedOnArrival and assignedFromWaiting count the groups seated when
+	// they arrive and the ones seated from the waiting list
+	assignedOnArrival   uint64
+	assignedFromWaiting uint64
+	healthChecks        []namedHealthCheck
+	// recovering, fleetLoaded and resetting are read by the readiness
+	// without the lock, with atomic operations
+	recovering  int32
+	fleetLoaded int32
+	resetting   int32
+}
+
+// DispatcherOption configures a Dispatcher in NewDispatcher
+type DispatcherOption func(d *Dispatcher)
+
+// WithCarSelector sets the strategy used to choose the car of a group, the
+// default one is BestFit
+func WithCarSelector(selector CarSelector) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.selector = selector
+	}
+}
+
+func NewDispatcher(options ...DispatcherOption) *Dispatcher {
+	d := &Dispatcher{
+		carsMap:       make(map[uint]uint),
+		carsSize:      make(map[uint]uint),
+		carsStatus:    make(map[uint]CarStatus),
+		groupsMap:     make(map[uint]uint),
+		capacitiesMap: make(capacityIndex),
+		journeysMap:   make(map[uint]uint),
+		carGroups:     make(map[uint][]uint),
+		waitingGroups: newWaitingList(),
+		lists:         newListIndex(),
+		store:         NewMemoryStore(),
+		selector:      BestFit{},
+		now:           time.Now,
+	}
+	for seats := range d.capacitiesBySize {
+		d.capacitiesBySize[seats] = make(capacityIndex)
+	}
+	for _, option := range options {
+		option(d)
+	}
+	return d
+}
+
+// ResetCars removes every car, journey and waiting group and loads the given
+// cars. If a car Id is repeated the dispatcher is left empty
+func (d *Dispatcher) ResetCars(cars []Car) error {
+	atomic.AddInt32(&d.resetting, 1)
+	defer atomic.AddInt32(&d.resetting, -1)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.commit("reset_cars")
+	d.cleanJourneysAndCars()
+	if err := d.populateCarsList(cars); err != nil {
+		return err
+	}
+	d.markFleetLoaded()
+	return nil
+}
+
+// RequestJourney registers the group, it returns true if the group got a car
+// and false if it has to wait
+func (d *Dispatcher) RequestJourney(group Group) (bool, error) {
+	journey, err := d.RequestJourneyDetail(group)
+	return journey.Car != nil, err
+}
+
+// RequestJourneyDetail registers the group as RequestJourney does, it returns
+// the car of the group if it got one
+func (d *Dispatcher) RequestJourneyDetail(group Group) (JourneyDetail, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.store.Group(group.Id); ok {
+		return JourneyDetail{}, ErrGroupIdRepeated
+	}
+	d.addNewGroup(group)
+	// the journey is read from the store, that has it once committed
+	d.commit("journey")
+	return d.journeyDetail(group.Id), nil
+}
+
+// journeyDetail reads the group and its car from the store, the free seats
+// and the position from the indexes
+func (d *Dispatcher) journeyDetail(groupId uint) JourneyDetail {
+	group, _ := d.store.Group(groupId)
+	journey := JourneyDetail{Id: groupId, People: group.People, Status: JourneyWaiting}
+	if group.Car != 0 {
+		car, _ := d.store.Car(group.Car)
+		journey.Status = JourneyTravelling
+		journey.Car = &JourneyCar{Id: car.Id, Seats: car.Seats, FreeSeats: d.carsMap[car.Id]}
+		return journey
+	}
+	journey.Position, journey.SizePosition, _ = d.waitingGroups.position(groupId)
+	if wait, ok := d.dropoffs.estimate(journey.Position); ok {
+		journey.EstimatedWait = int((wait + time.Second - 1) / time.Second)
+	}
+	return journey
+}
+
+// Dropoff unregisters the group, it returns true if the group was travelling
+// in a car, in that case the seats are offered to the waiting groups
+func (d *Dispatcher) Dropoff(groupId uint) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.commit("dropoff")
+	if _, exists := d.store.Group(groupId); !exists {
+		return false, ErrGroupNotFound
+	}
+	if d.journeysMap[groupId] == 0 {
+		blocking := d.blockingGroup()
+		d.deleteGroupWithoutCar(groupId)
+		if blocking != nil && blocking.id == groupId {
+			d.serveWaitingGroups()
+		}
+		return false, nil
+	}
+	carId, newFreeSeats := d.removeGroup(groupId)
+	d.dropoffs.observe(d.now())
+	d.tryAssignWaitingGroupsToCar(carId, newFreeSeats)
+	return true, nil
+}
+
+// Journey returns the journey of the group
+func (d *Dispatcher) Journey(groupId uint) (JourneyDetail, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, exists := d.store.Group(groupId); !exists {
+		return JourneyDetail{}, ErrGroupNotFound
+	}
+	return d.journeyDetail(groupId), nil
+}
+
+// Locate returns the car of the group, the bool is false if the group is
+// still waiting for a car
+func (d *Dispatcher) Locate(groupId uint) (Car, bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	group, exists := d.store.Group(groupId)
+	if !exists {
+		return Car{}, false, ErrGroupNotFound
+	}
+	if group.Car == 0 {
+		return Car{}, false, nil
+	}
+	car, _ := d.store.Car(group.Car)
+	return Car{Id: car.Id, Seats: car.Seats}, true, nil
+}
+
+// DispatcherStats is a summary of the state of the dispatcher for the
+// metrics. The assignments are counted since the dispatcher was created, the
+// operations applied from a log are not counted
+type DispatcherStats struct {
+	// CarsByFreeSeats counts the cars in service by their free seats
+	CarsByFreeSeats     [MaxSeats + 1]int
+	Journeys            int
+	WaitingByPeople     [MaxPeople + 1]int
+	AssignedOnArrival   uint64
+	AssignedFromWaiting uint64
+}
+
+// Stats returns the summary of the state of the dispatcher
+func (d *Dispatcher) Stats() DispatcherStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stats := DispatcherStats{
+		Journeys:            len(d.journeysMap) - d.waitingGroups.len(),
+		AssignedOnArrival:   d.assignedOnArrival,
+		AssignedFromWaiting: d.assignedFromWaiting,
+	}
+	for freeSeats, cars := range d.capacitiesMap {
+		if freeSeats <= MaxSeats {
+			stats.CarsByFreeSeats[freeSeats] = cars.Len()
+		}
+	}
+	for people := MinPeople; people <= MaxPeople; people++ {
+		stats.WaitingByPeople[people] = d.waitingGroups.bySize[people].ranks.count
+	}
+	return stats
+}
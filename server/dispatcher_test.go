@@ -0,0 +1,95 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDispatcher_Journeys(t *testing.T) {
+	d := NewDispatcher()
+	if err := d.ResetCars([]Car{{1, 4}, {2, 6}}); err != nil {
+		t.Fatalf("ResetCars() error = %v", err)
+	}
+	requests := []struct {
+		group    Group
+		assigned bool
+	}{
+		{Group{1, 4}, true},
+		{Group{2, 6}, true},
+		{Group{3, 5}, false},
+		{Group{4, 1}, false},
+	}
+	for _, req := range requests {
+		assigned, err := d.RequestJourney(req.group)
+		if err != nil {
+			t.Fatalf("RequestJourney(%v) error = %v", req.group, err)
+		}
+		if assigned != req.assigned {
+			t.Fatalf("RequestJourney(%v) = %v, want %v", req.group, assigned, req.assigned)
+		}
+	}
+	if _, err := d.RequestJourney(Group{1, 2}); err != ErrGroupIdRepeated {
+		t.Fatalf("RequestJourney() with a repeated id error = %v, want %v", err, ErrGroupIdRepeated)
+	}
+
+	// the group of 5 arrived first, so it takes the car of 6
+	if travelling, err := d.Dropoff(2); err != nil || !travelling {
+		t.Fatalf("Dropoff(2) = %v, %v", travelling, err)
+	}
+	if car, assigned, _ := d.Locate(3); !assigned || car != (Car{2, 6}) {
+		t.Fatalf("Locate(3) = %v, %v", car, assigned)
+	}
+	if car, assigned, _ := d.Locate(4); !assigned || car != (Car{2, 6}) {
+		t.Fatalf("Locate(4) = %v, %v", car, assigned)
+	}
+	if _, _, err := d.Locate(2); err != ErrGroupNotFound {
+		t.Fatalf("Locate(2) error = %v, want %v", err, ErrGroupNotFound)
+	}
+	if _, err := d.Dropoff(2); err != ErrGroupNotFound {
+		t.Fatalf("Dropoff(2) error = %v, want %v", err, ErrGroupNotFound)
+	}
+}
+
+func TestDispatcher_ResetCarsRepeatedId(t *testing.T) {
+	d := NewDispatcher()
+	if err := d.ResetCars([]Car{{1, 4}, {1, 5}}); err != ErrCarIdRepeated {
+		t.Fatalf("ResetCars() error = %v, want %v", err, ErrCarIdRepeated)
+	}
+	if assigned, _ := d.RequestJourney(Group{1, 1}); assigned {
+		t.Fatalf("a group got a car from a rejected fleet")
+	}
+}
+
+func TestDispatcher_EstimatedWait(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	d := NewDispatcher(WithClock(func() time.Time { return now }))
+	d.ResetCars([]Car{{1, 4}})
+	for _, group := range []Group{{1, 4}, {2, 4}, {3, 4}, {4, 2}} {
+		d.RequestJourney(group)
+	}
+	assertJourney := func(groupId uint, position, sizePosition, wait int) {
+		t.Helper()
+		journey, err := d.Journey(groupId)
+		if err != nil || journey.Position != position || journey.SizePosition != sizePosition || journey.EstimatedWait != wait {
+			t.Fatalf("Journey(%d): (Expected) %d %d %d != %+v %v (Returned)", groupId, position, sizePosition, wait, journey, err)
+		}
+	}
+	// no estimate until two dropoffs were seen
+	assertJourney(4, 3, 1, 0)
+	d.Dropoff(1)
+	assertJourney(4, 2, 1, 0)
+	now = now.Add(10 * time.Second)
+	d.Dropoff(2)
+	assertJourney(4, 1, 1, 10)
+	d.RequestJourney(Group{5, 4})
+	assertJourney(5, 2, 1, 20)
+	// 20s since the last dropoff move the average of 10s to 12s, the group
+	// of 2 boards and the one of 4 is the first
+	now = now.Add(20 * time.Second)
+	d.Dropoff(3)
+	assertJourney(5, 1, 1, 12)
+	d.ResetCars([]Car{{1, 4}})
+	d.RequestJourney(Group{1, 4})
+	d.RequestJourney(Group{2, 4})
+	assertJourney(2, 1, 1, 0)
+}
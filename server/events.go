@@ -0,0 +1,189 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// eventHistory is the number of events kept to resume a stream with
+// Last-Event-ID, a client that is further behind is told to resync
+const eventHistory = 4096
+
+// EventType is the kind of an event of the /events stream
+type EventType string
+
+const (
+	// EventFleetReset removes every car, journey and waiting group
+	EventFleetReset EventType = "fleet_reset"
+	// EventGroupQueued adds a group to the waiting list, at the start if Front
+	EventGroupQueued EventType = "group_queued"
+	// EventGroupAssigned seats a new or waiting group in a car, Waited is set
+	// for the waiting ones
+	EventGroupAssigned EventType = "group_assigned"
+	// EventGroupDroppedOff unregisters a group, with the car it was in or 0
+	EventGroupDroppedOff EventType = "group_dropped_off"
+	// EventCarFreed follows the dropoff of a travelling group, with the free
+	// seats the car is left with
+	EventCarFreed EventType = "car_freed"
+)
+
+// Event is a domain event of the dispatcher. The id is the sequence number
+// of the operation that caused it and its position in the operation, so it
+// survives a restart with a snapshot or a write-ahead log
+type Event struct {
+	Id        string    `json:"id"`
+	Type      EventType `json:"type"`
+	Time      time.Time `json:"time"`
+	Group     uint      `json:"group,omitempty"`
+	People    uint      `json:"people,omitempty"`
+	Car       uint      `json:"car,omitempty"`
+	FreeSeats uint      `json:"free_seats,omitempty"`
+	Front     bool      `json:"front,omitempty"`
+	Waited    bool      `json:"waited,omitempty"`
+}
+
+// eventsOf translates the changes of an operation into events, the changes
+// of the cars and the unseated groups have no event
+func eventsOf(op Operation) []Event {
+	events := []Event{}
+	add := func(event Event) {
+		event.Id = fmt.Sprintf("%d-%d", op.Seq, len(events))
+		event.Time = op.Time
+		events = append(events, event)
+	}
+	for _, change := range op.Changes {
+		switch change.Kind {
+		case ChangeFleetReset:
+			add(Event{Type: EventFleetReset})
+		case ChangeGroupQueued:
+			add(Event{Type: EventGroupQueued, Group: change.Group, People: change.People, Front: change.Front})
+		case ChangeGroupAssigned:
+			add(Event{Type: EventGroupAssigned, Group: change.Group, People: change.People, Car: change.Car, Waited: change.Waited})
+		case ChangeGroupDroppedOff:
+			add(Event{Type: EventGroupDroppedOff, Group: change.Group, People: change.People, Car: change.Car})
+			if change.Car != 0 {
+				add(Event{Type: EventCarFreed, Group: change.Group, People: change.People, Car: change.Car, FreeSeats: change.Seats})
+			}
+		}
+	}
+	return events
+}
+
+// eventSubscriber is a stream of /events. It is woken up when there are new
+// events and it reads them from the history, so a slow client never blocks
+// the dispatcher
+type eventSubscriber struct {
+	wake chan struct{}
+	done chan struct{}
+}
+
+// eventHub keeps the last events in a ring and wakes up the subscribers. Its
+// observe method is an observer of the dispatcher
+type eventHub struct {
+	mu          sync.Mutex
+	history     []Event
+	next        uint64
+	subscribers map[*eventSubscriber]struct{}
+	closed      bool
+}
+
+func newEventHub(size int) *eventHub {
+	return &eventHub{history: make([]Event, size), subscribers: map[*eventSubscriber]struct{}{}}
+}
+
+func (hub *eventHub) observe(op Operation) {
+	events := eventsOf(op)
+	if len(events) == 0 {
+		return
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for _, event := range events {
+		hub.history[hub.next%uint64(len(hub.history))] = event
+		hub.next++
+	}
+	for subscriber := range hub.subscribers {
+		select {
+		case subscriber.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// oldest is the position of the oldest event in the history
+func (hub *eventHub) oldest() uint64 {
+	if hub.next < uint64(len(hub.history)) {
+		return 0
+	}
+	return hub.next - uint64(len(hub.history))
+}
+
+// latestId is the id of the last event, empty when there is none
+func (hub *eventHub) latestId() string {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if hub.next == 0 {
+		return ""
+	}
+	return hub.history[(hub.next-1)%uint64(len(hub.history))].Id
+}
+
+// subscribe starts a stream after the event lastEventId, or after the last
+// event when it is empty. found is false when lastEventId is not in the
+// history, the stream starts after the last event and the client must resync.
+// The subscriber is nil once the hub is closed
+func (hub *eventHub) subscribe(lastEventId string) (subscriber *eventSubscriber, cursor uint64, found bool) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if hub.closed {
+		return nil, 0, false
+	}
+	subscriber = &eventSubscriber{wake: make(chan struct{}, 1), done: make(chan struct{})}
+	hub.subscribers[subscriber] = struct{}{}
+	if lastEventId == "" {
+		return subscriber, hub.next, true
+	}
+	for position := hub.next; position > hub.oldest(); position-- {
+		if hub.history[(position-1)%uint64(len(hub.history))].Id == lastEventId {
+			return subscriber, position, true
+		}
+	}
+	return subscriber, hub.next, false
+}
+
+func (hub *eventHub) unsubscribe(subscriber *eventSubscriber) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	delete(hub.subscribers, subscriber)
+}
+
+// since returns the events from the position cursor on and the position
+// after them. lost is true when some of them already left the history, the
+// stream then goes on after the last event and the client must resync
+func (hub *eventHub) since(cursor uint64) (events []Event, next uint64, lost bool) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if cursor < hub.oldest() {
+		return nil, hub.next, true
+	}
+	for position := cursor; position < hub.next; position++ {
+		events = append(events, hub.history[position%uint64(len(hub.history))])
+	}
+	return events, hub.next, false
+}
+
+// close ends the streams, so the shutdown of the server does not wait for
+// them
+func (hub *eventHub) close() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if hub.closed {
+		return
+	}
+	hub.closed = true
+	for subscriber := range hub.subscribers {
+		close(subscriber.done)
+	}
+	hub.subscribers = map[*eventSubscriber]struct{}{}
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sseEvent struct {
+	id, event, data string
+}
+
+// eventStream reads the events of a /events response, it is read up to the
+// first block so the subscription exists when it returns
+type eventStream struct {
+	reader *bufio.Reader
+	cancel context.CancelFunc
+}
+
+func openEventStream(t *testing.T, url, lastEventId string) *eventStream {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if lastEventId != "" {
+		req.Header.Set("Last-Event-ID", lastEventId)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != ContentTypeEventStream {
+		cancel()
+		t.Fatalf("(Expected) %d %s != %d %s (Returned)", http.StatusOK, ContentTypeEventStream, resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	stream := &eventStream{reader: bufio.NewReader(resp.Body), cancel: cancel}
+	if retry := stream.next(t); retry.data != "2000" {
+		t.Fatalf("(Expected) retry 2000 != %+v (Returned)", retry)
+	}
+	return stream
+}
+
+// next reads a block, the retry block is returned in data
+func (stream *eventStream) next(t *testing.T) sseEvent {
+	t.Helper()
+	event := sseEvent{}
+	for {
+		line, err := stream.reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading the stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return event
+		}
+		field, value, _ := strings.Cut(line, ": ")
+		switch field {
+		case "id":
+			event.id = value
+		case "event":
+			event.event = value
+		default:
+			event.data = value
+		}
+	}
+}
+
+func (stream *eventStream) expect(t *testing.T, expected ...sseEvent) {
+	t.Helper()
+	for _, exp := range expected {
+		if event := stream.next(t); event.id != exp.id || event.event != exp.event || !strings.Contains(event.data, exp.data) {
+			t.Fatalf("(Expected) %+v != %+v (Returned)", exp, event)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	h := &handlers{dispatcher: NewDispatcher(), events: newEventHub(eventHistory)}
+	h.dispatcher.addObserver(h.events.observe)
+	ts := httptest.NewServer(initRoutes(h))
+	defer ts.Close()
+	defer h.events.close()
+	send := func(method, path, ctype, body string) {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", ctype)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	send("PUT", "/cars", ContentTypeJSON, `[ { "id": 1, "seats": 4 } ]`)
+	all := openEventStream(t, ts.URL+"/events", "")
+	defer all.cancel()
+	group2 := openEventStream(t, ts.URL+"/events?group=2", "")
+	defer group2.cancel()
+	send("POST", "/journey", ContentTypeJSON, `{ "id": 1, "people": 4 }`)
+	send("POST", "/journey", ContentTypeJSON, `{ "id": 2, "people": 4 }`)
+	send("POST", "/dropoff", ContentTypeURLENCODED, "ID=1")
+
+	all.expect(t,
+		sseEvent{"2-0", "group_assigned", `"group":1,"people":4,"car":1}`},
+		sseEvent{"3-0", "group_queued", `"group":2,"people":4}`},
+		sseEvent{"4-0", "group_dropped_off", `"group":1,"people":4,"car":1}`},
+		sseEvent{"4-1", "car_freed", `"group":1,"people":4,"car":1,"free_seats":4}`},
+		sseEvent{"4-2", "group_assigned", `"group":2,"people":4,"car":1,"waited":true}`},
+	)
+	group2.expect(t,
+		sseEvent{"3-0", "group_queued", `"group":2`},
+		sseEvent{"4-2", "group_assigned", `"group":2`},
+	)
+
+	resumed := openEventStream(t, ts.URL+"/events", "3-0")
+	defer resumed.cancel()
+	resumed.expect(t,
+		sseEvent{"4-0", "group_dropped_off", `"group":1`},
+		sseEvent{"4-1", "car_freed", `"car":1`},
+		sseEvent{"4-2", "group_assigned", `"group":2`},
+	)
+
+	unknown := openEventStream(t, ts.URL+"/events", "99-0")
+	defer unknown.cancel()
+	unknown.expect(t, sseEvent{"4-2", "resync", `"reason"`})
+
+	// the streams end with the server
+	h.events.close()
+	if _, err := all.reader.ReadString('\n'); err == nil {
+		t.Fatalf("(Expected) the end of the stream != a new line (Returned)")
+	}
+}
+
+func TestEventHub_Lost(t *testing.T) {
+	hub := newEventHub(2)
+	subscriber, cursor, found := hub.subscribe("")
+	if subscriber == nil || cursor != 0 || !found {
+		t.Fatalf("(Expected) a subscription at 0 != %d %t (Returned)", cursor, found)
+	}
+	for seq := uint64(1); seq <= 3; seq++ {
+		hub.observe(Operation{Seq: seq, Changes: []Change{{Kind: ChangeGroupQueued, Group: uint(seq), People: 2}}})
+	}
+	// the first event left the history
+	if events, next, lost := hub.since(cursor); !lost || len(events) != 0 || next != 3 {
+		t.Fatalf("(Expected) lost 3 != %t %d (Returned)", lost, next)
+	}
+	if _, cursor, found = hub.subscribe("2-0"); !found || cursor != 2 {
+		t.Fatalf("(Expected) 2 != %d %t (Returned)", cursor, found)
+	}
+	if _, _, found = hub.subscribe("1-0"); found {
+		t.Fatalf("(Expected) 1-0 is not kept")
+	}
+	if events, _, lost := hub.since(cursor); lost || len(events) != 1 || events[0].Id != "3-0" {
+		t.Fatalf("(Expected) 3-0 != %+v (Returned)", events)
+	}
+	hub.close()
+	if subscriber, _, _ := hub.subscribe(""); subscriber != nil {
+		t.Fatalf("(Expected) no subscription after the close")
+	}
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// FairnessMode decides when a group may be served before a group that
+// arrived earlier
+type FairnessMode int
+
+const (
+	// ServeASAP seats a group as soon as there is a car for it, a group that
+	// arrived later can take seats that an earlier group does not fit in
+	ServeASAP FairnessMode = iota
+	// StrictFIFO only serves the first group of the waiting list, the groups
+	// that arrive later wait even if there are free seats for them
+	StrictFIFO
+	// Aging behaves as ServeASAP until the first group of the waiting list
+	// starves, then the groups that arrived later can not take seats in the
+	// cars that are big enough for the starving group
+	Aging
+)
+
+var fairnessModes = map[string]FairnessMode{
+	"asap":  ServeASAP,
+	"fifo":  StrictFIFO,
+	"aging": Aging,
+}
+
+// FairnessPolicy configures the fairness of the waiting list. MaxSkips and
+// MaxWait are only used by Aging: the first waiting group starves once
+// MaxSkips groups took seats while it was first, or once it waited MaxWait.
+// A zero value disables that limit
+type FairnessPolicy struct {
+	Mode     FairnessMode
+	MaxSkips int
+	MaxWait  time.Duration
+}
+
+// WithFairness sets the fairness policy, the default one serves the groups
+// as soon as possible
+func WithFairness(policy FairnessPolicy) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.fairness = policy
+	}
+}
+
+// WithClock replaces time.Now, it is used to measure how long the groups wait
+func WithClock(now func() time.Time) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.now = now
+	}
+}
+
+// FairnessModeByName returns the mode with the given name, it is used to
+// choose the mode from the configuration
+func FairnessModeByName(name string) (FairnessMode, error) {
+	mode, ok := fairnessModes[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown fairness mode %q, valid ones are %v", name, FairnessModeNames())
+	}
+	return mode, nil
+}
+
+func FairnessModeNames() []string {
+	names := make([]string, 0, len(fairnessModes))
+	for name := range fairnessModes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// blockingGroup returns the first waiting group if it does not allow later
+// groups to take its seats, or nil
+func (d *Dispatcher) blockingGroup() *waitingGroup {
+	first := d.waitingGroups.head
+	if first == nil {
+		return nil
+	}
+	switch d.fairness.Mode {
+	case StrictFIFO:
+		return first
+	case Aging:
+		if d.fairness.MaxSkips > 0 && first.skips >= d.fairness.MaxSkips {
+			return first
+		}
+		if d.fairness.MaxWait > 0 && d.now().Sub(first.since) >= d.fairness.MaxWait {
+			return first
+		}
+	}
+	return nil
+}
+
+// seatsReservedFor tells if the seats of the car can only be taken by the
+// blocking group
+func (d *Dispatcher) seatsReservedFor(blocking *waitingGroup, carId uint) bool {
+	return d.fairness.Mode == StrictFIFO || d.carsSize[carId] >= blocking.people
+}
+
+// fleetView joins the cars of several sizes in a single FreeSeats
+type fleetView []capacityIndex
+
+func (v fleetView) Count(freeSeats uint) int {
+	count := 0
+	for _, cars := range v {
+		count += cars.Count(freeSeats)
+	}
+	return count
+}
+
+func (v fleetView) Lowest(freeSeats uint) uint {
+	var lowest uint
+	for _, cars := range v {
+		if carId := cars.Lowest(freeSeats); carId != 0 && (lowest == 0 || carId < lowest) {
+			lowest = carId
+		}
+	}
+	return lowest
+}
+
+func (v fleetView) At(freeSeats uint, i int) uint {
+	for _, cars := range v {
+		if i < cars.Count(freeSeats) {
+			return cars.At(freeSeats, i)
+		}
+		i -= cars.Count(freeSeats)
+	}
+	return 0
+}
+
+// availableCars returns the cars a group that is not the first of the
+// waiting list may take
+func (d *Dispatcher) availableCars() FreeSeats {
+	blocking := d.blockingGroup()
+	if blocking == nil {
+		return d.capacitiesMap
+	}
+	if d.fairness.Mode == StrictFIFO {
+		return fleetView{}
+	}
+	return fleetView(d.capacitiesBySize[:blocking.people])
+}
+
+// serveWaitingGroups offers every car to the waiting groups in arrival
+// order. Seats can stay free while a group blocks the waiting list, so it is
+// called when the blocking group leaves the list. The free seats only shrink
+// while it runs, so a group that did not fit is never tried again and the
+// next group to serve is the earliest one of the sizes that still fit, found
+// in the queues by size without walking the list
+func (d *Dispatcher) serveWaitingGroups() {
+	var triedHead *waitingGroup
+	for {
+		head := d.waitingGroups.head
+		if head == nil || d.mostFreeSeats() == 0 {
+			return
+		}
+		// the first group may take any car
+		if head != triedHead {
+			triedHead = head
+			if d.serveWaitingGroup(head, d.capacitiesMap) {
+				continue
+			}
+			if d.fairness.Mode == StrictFIFO {
+				return
+			}
+		}
+		cars := d.availableCars()
+		next := d.waitingGroups.earliestFitting(mostFreeSeatsOf(cars))
+		if next == nil || next == head || !d.serveWaitingGroup(next, cars) {
+			return
+		}
+	}
+}
+
+// serveWaitingGroup seats the waiting group in one of the cars, it returns
+// false if none can take it
+func (d *Dispatcher) serveWaitingGroup(group *waitingGroup, cars FreeSeats) bool {
+	carId := d.selector.SelectCar(cars, group.people)
+	if carId == 0 {
+		return false
+	}
+	d.skipFirstWaitingGroup(group.id)
+	d.waitingGroups.remove(group.id)
+	d.assignCar(carId, Group{group.id, group.people})
+	d.assignedFromWaiting++
+	return true
+}
+
+// skipFirstWaitingGroup counts that groupId takes seats while the first
+// waiting group is still waiting
+func (d *Dispatcher) skipFirstWaitingGroup(groupId uint) {
+	if first := d.waitingGroups.head; first != nil && first.id != groupId {
+		first.skips++
+	}
+}
+
+func (d *Dispatcher) mostFreeSeats() uint {
+	return mostFreeSeatsOf(d.capacitiesMap)
+}
+
+func mostFreeSeatsOf(cars FreeSeats) uint {
+	for freeSeats := MaxSeats; freeSeats > 0; freeSeats-- {
+		if cars.Count(freeSeats) > 0 {
+			return freeSeats
+		}
+	}
+	return 0
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+type fairnessStep struct {
+	action   string // "journey", "dropoff" or "wait"
+	group    Group
+	assigned bool
+	wait     time.Duration
+}
+
+func runFairnessSteps(t *testing.T, policy FairnessPolicy, fleet []Car, steps []fairnessStep) *Dispatcher {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	d := NewDispatcher(WithFairness(policy), WithClock(func() time.Time { return now }))
+	d.ResetCars(fleet)
+	for idx, step := range steps {
+		switch step.action {
+		case "journey":
+			if assigned, _ := d.RequestJourney(step.group); assigned != step.assigned {
+				t.Fatalf("step %d: RequestJourney(%v) = %v, want %v", idx, step.group, assigned, step.assigned)
+			}
+		case "dropoff":
+			if _, err := d.Dropoff(step.group.Id); err != nil {
+				t.Fatalf("step %d: Dropoff(%d) error = %v", idx, step.group.Id, err)
+			}
+		case "wait":
+			now = now.Add(step.wait)
+		}
+	}
+	return d
+}
+
+func assertLocate(t *testing.T, d *Dispatcher, groupId uint, carId uint) {
+	t.Helper()
+	car, assigned, err := d.Locate(groupId)
+	if err != nil || car.Id != carId || assigned != (carId != 0) {
+		t.Fatalf("Locate(%d) = %v, %v, %v want car %d", groupId, car, assigned, err, carId)
+	}
+}
+
+func TestFairness_ServeASAP(t *testing.T) {
+	d := runFairnessSteps(t, FairnessPolicy{Mode: ServeASAP}, []Car{{1, 6}}, []fairnessStep{
+		{action: "journey", group: Group{1, 4}, assigned: true},
+		{action: "journey", group: Group{2, 6}, assigned: false},
+		{action: "journey", group: Group{3, 2}, assigned: true},
+	})
+	assertLocate(t, d, 3, 1)
+}
+
+func TestFairness_StrictFIFO(t *testing.T) {
+	d := runFairnessSteps(t, FairnessPolicy{Mode: StrictFIFO}, []Car{{1, 6}, {2, 4}}, []fairnessStep{
+		{action: "journey", group: Group{1, 4}, assigned: true},
+		{action: "journey", group: Group{2, 4}, assigned: true},
+		{action: "journey", group: Group{3, 6}, assigned: false},
+		// there are free seats, but the group of 6 arrived first
+		{action: "journey", group: Group{4, 2}, assigned: false},
+		{action: "dropoff", group: Group{Id: 2}},
+		{action: "dropoff", group: Group{Id: 1}},
+	})
+	assertLocate(t, d, 3, 1)
+	assertLocate(t, d, 4, 2)
+
+	// dropping the first waiting group lets the next one take the free seats
+	d = runFairnessSteps(t, FairnessPolicy{Mode: StrictFIFO}, []Car{{1, 6}}, []fairnessStep{
+		{action: "journey", group: Group{1, 4}, assigned: true},
+		{action: "journey", group: Group{2, 6}, assigned: false},
+		{action: "journey", group: Group{3, 2}, assigned: false},
+		{action: "dropoff", group: Group{Id: 2}},
+	})
+	assertLocate(t, d, 3, 1)
+}
+
+func TestFairness_AgingBySkips(t *testing.T) {
+	d := runFairnessSteps(t, FairnessPolicy{Mode: Aging, MaxSkips: 1}, []Car{{1, 6}, {2, 4}}, []fairnessStep{
+		{action: "journey", group: Group{1, 4}, assigned: true},
+		{action: "journey", group: Group{2, 4}, assigned: true},
+		{action: "journey", group: Group{3, 6}, assigned: false},
+		// it skips the group of 6 once, then the seats of car 1 are reserved
+		{action: "journey", group: Group{4, 1}, assigned: true},
+		{action: "journey", group: Group{5, 1}, assigned: false},
+		// car 2 is too small for the group of 6, so group 5 can take it
+		{action: "dropoff", group: Group{Id: 1}},
+	})
+	assertLocate(t, d, 2, 1)
+	assertLocate(t, d, 4, 1)
+	assertLocate(t, d, 5, 2)
+
+	// the seats of car 1 are not given to anybody else until the group of 6 fits
+	d.RequestJourney(Group{6, 4})
+	d.Dropoff(2)
+	assertLocate(t, d, 3, 0)
+	assertLocate(t, d, 6, 0)
+	d.Dropoff(4)
+	assertLocate(t, d, 3, 1)
+	assertLocate(t, d, 6, 0)
+}
+
+func TestFairness_AgingByWait(t *testing.T) {
+	d := runFairnessSteps(t, FairnessPolicy{Mode: Aging, MaxWait: time.Minute}, []Car{{1, 6}}, []fairnessStep{
+		{action: "journey", group: Group{1, 4}, assigned: true},
+		{action: "journey", group: Group{2, 6}, assigned: false},
+		{action: "journey", group: Group{3, 1}, assigned: true},
+		{action: "wait", wait: time.Minute},
+		{action: "journey", group: Group{4, 1}, assigned: false},
+		{action: "dropoff", group: Group{Id: 1}},
+		{action: "dropoff", group: Group{Id: 3}},
+	})
+	assertLocate(t, d, 2, 1)
+	assertLocate(t, d, 4, 0)
+}
+
+// countingSelector counts the cars it is asked for
+type countingSelector struct {
+	BestFit
+	calls int
+}
+
+func (s *countingSelector) SelectCar(cars FreeSeats, people uint) uint {
+	s.calls++
+	return s.BestFit.SelectCar(cars, people)
+}
+
+// TestServeWaitingGroups_Seek checks that the groups that do not fit are not
+// tried one by one
+func TestServeWaitingGroups_Seek(t *testing.T) {
+	selector := &countingSelector{}
+	d := NewDispatcher(WithCarSelector(selector))
+	d.ResetCars([]Car{{1, 6}, {2, 2}})
+	d.RequestJourney(Group{1, 2})
+	for groupId := uint(2); groupId <= 1002; groupId++ {
+		d.RequestJourney(Group{groupId, 6})
+	}
+	d.RequestJourney(Group{1003, 2})
+
+	d.mu.Lock()
+	d.removeGroup(1)
+	selector.calls = 0
+	d.serveWaitingGroups()
+	d.commit("serve")
+	d.mu.Unlock()
+	if selector.calls != 2 {
+		t.Fatalf("(Expected) 2 != %d (Returned) cars selected", selector.calls)
+	}
+	assertLocate(t, d, 1003, 2)
+}
+
+func TestFairnessModeByName(t *testing.T) {
+	for _, name := range FairnessModeNames() {
+		if _, err := FairnessModeByName(name); err != nil {
+			t.Errorf("FairnessModeByName(%q) error = %v", name, err)
+		}
+	}
+	if _, err := FairnessModeByName("lifo"); err == nil {
+		t.Errorf("FairnessModeByName() accepted an unknown mode")
+	}
+}
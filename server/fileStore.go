@@ -0,0 +1,257 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// compactMinRecords is the size under which the file is never compacted
+const compactMinRecords = 1024
+
+// FileStore is an embedded key-value store. It keeps the records in memory
+// and appends every batch to a file as a json line, the file is replayed when
+// it is opened. When most of the lines are old versions of the records, the
+// file is rewritten with a single batch by a goroutine of the store, so the
+// dispatcher never waits for a compaction
+type FileStore struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	policy  SyncPolicy
+	dirty   bool
+	records *MemoryStore
+	// written counts the records written to the file, deleted ones included
+	written int
+	// compacting is true while the file is rewritten, the lines written in
+	// the meantime are kept in tail to append them to the new file
+	compacting  bool
+	tail        [][]byte
+	tailWritten int
+	// err is the first write error, the store stops writing after it so the
+	// file never misses a batch
+	err     error
+	compact chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// OpenFileStore opens the store saved at path, creating it if it does not
+// exist. A line cut by a crash at the end of the file is removed. The policy
+// decides when the file is flushed to the disk as in the write-ahead log, the
+// interval is only used by SyncInterval
+func OpenFileStore(path string, policy SyncPolicy, interval time.Duration) (*FileStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileStore{path: path, file: file, policy: policy, records: NewMemoryStore()}
+	if err = truncateTornLine(file); err == nil {
+		err = s.replay()
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekEnd)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	s.compact = make(chan struct{}, 1)
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.background(interval)
+	return s, nil
+}
+
+func (s *FileStore) replay() error {
+	reader := bufio.NewReader(s.file)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		batch := StoreBatch{}
+		if err := json.Unmarshal(line, &batch); err != nil {
+			return fmt.Errorf("store %s is corrupted at line %d", s.path, lineNumber)
+		}
+		s.records.Update(batch)
+		s.written += batch.size()
+	}
+}
+
+func (batch StoreBatch) size() int {
+	return len(batch.Cars) + len(batch.DeletedCars) + len(batch.Groups) + len(batch.DeletedGroups)
+}
+
+// Update appends the batch to the file, it is flushed to the disk right away
+// only with SyncAlways
+func (s *FileStore) Update(batch StoreBatch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// the records are the state of the dispatcher, they are kept when the
+	// file fails and the error is reported by Err
+	s.records.Update(batch)
+	if s.err != nil {
+		return s.err
+	}
+	line, err := json.Marshal(batch)
+	if err == nil {
+		line = append(line, '\n')
+		_, err = s.file.Write(line)
+	}
+	if err == nil && s.policy == SyncAlways {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		s.err = err
+		return err
+	}
+	s.dirty = true
+	s.written += batch.size()
+	if s.compacting {
+		s.tail = append(s.tail, line)
+		s.tailWritten += batch.size()
+	} else if records := s.records.records(); s.written > compactMinRecords && s.written > 2*records {
+		select {
+		case s.compact <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// background compacts the file when Update asks for it and flushes it with
+// SyncInterval
+func (s *FileStore) background(interval time.Duration) {
+	defer close(s.done)
+	var tick <-chan time.Time
+	if s.policy == SyncInterval {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-s.compact:
+			if err := s.Compact(); err != nil {
+				log.Printf("compacting store %s: %v", s.path, err)
+			}
+		case <-tick:
+			s.Sync()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Sync flushes the batches written since the last flush to the disk
+func (s *FileStore) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty || s.err != nil {
+		return s.err
+	}
+	s.dirty = false
+	return s.file.Sync()
+}
+
+// Compact rewrites the file with the current records through a temporary
+// file, so a crash while compacting leaves the old file. The records are
+// written without the lock of the store, the batches written meanwhile are
+// appended to the new file before it replaces the old one
+func (s *FileStore) Compact() error {
+	s.mu.Lock()
+	if s.err != nil || s.compacting {
+		s.mu.Unlock()
+		return s.err
+	}
+	state, _ := s.records.Load()
+	s.compacting = true
+	s.mu.Unlock()
+
+	batch := StoreBatch{Reset: true, Cars: state.Cars, Groups: state.Groups, LastOperation: state.LastOperation}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err == nil {
+		defer os.Remove(tmp.Name())
+		var line []byte
+		if line, err = json.Marshal(batch); err == nil {
+			_, err = tmp.Write(append(line, '\n'))
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tail, tailWritten := s.tail, s.tailWritten
+	s.compacting, s.tail, s.tailWritten = false, nil, 0
+	for _, line := range tail {
+		if err == nil {
+			_, err = tmp.Write(line)
+		}
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if tmp != nil {
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	s.file.Close()
+	s.dirty = false
+	s.written = batch.size() + tailWritten
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		s.err = err
+	}
+	return err
+}
+
+// Car and Group read the records without the lock of the store, so they never
+// wait for a flush of the file
+func (s *FileStore) Car(carId uint) (StoredCar, bool) {
+	return s.records.Car(carId)
+}
+
+func (s *FileStore) Group(groupId uint) (StoredGroup, bool) {
+	return s.records.Group(groupId)
+}
+
+func (s *FileStore) Load() (StoreState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.records.Load()
+}
+
+// Close stops the goroutine of the store, flushes the file and closes it
+func (s *FileStore) Close() error {
+	close(s.stop)
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.file.Sync()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Err returns the error that stopped the store, if any
+func (s *FileStore) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// ReconcileCars replaces the fleet without resetting the journeys. The groups
+// travelling in cars that are kept keep their car, the groups of the removed
+// cars go back to the start of the waiting list, and the new seats are offered
+// to the waiting groups. If a car Id is repeated nothing changes
+func (d *Dispatcher) ReconcileCars(cars []Car) error {
+	kept := make(map[uint]struct{}, len(cars))
+	for _, car := range cars {
+		if _, ok := kept[car.Id]; ok {
+			return ErrCarIdRepeated
+		}
+		kept[car.Id] = struct{}{}
+	}
+	atomic.AddInt32(&d.resetting, 1)
+	defer atomic.AddInt32(&d.resetting, -1)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.commit("reconcile_cars")
+	removed := []uint{}
+	for carId := range d.carsSize {
+		if _, ok := kept[carId]; !ok {
+			removed = append(removed, carId)
+		}
+	}
+	// sorted, so the order of the groups that go back to the waiting list
+	// does not depend on the map
+	sort.Slice(removed, func(i, j int) bool { return removed[i] < removed[j] })
+	ejected := []uint{}
+	for _, carId := range removed {
+		ejected = append(ejected, d.removeCar(carId)...)
+	}
+	for _, car := range cars {
+		if _, exists := d.carsSize[car.Id]; exists {
+			ejected = append(ejected, d.resizeCar(car.Id, car.Seats)...)
+		} else {
+			d.addCar(car)
+		}
+	}
+	d.requeueGroups(ejected)
+	d.serveWaitingGroups()
+	d.markFleetLoaded()
+	return nil
+}
+
+// AddCar puts a new car in service, its seats are offered to the waiting
+// groups
+func (d *Dispatcher) AddCar(car Car) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.commit("add_car")
+	if _, exists := d.store.Car(car.Id); exists {
+		return ErrCarIdRepeated
+	}
+	d.addCar(car)
+	d.tryAssignWaitingGroupsToCar(car.Id, car.Seats)
+	d.markFleetLoaded()
+	return nil
+}
+
+// UpdateCar changes the seats of a car. If the groups travelling in it do not
+// fit anymore, the last ones to board go back to the start of the waiting list
+func (d *Dispatcher) UpdateCar(car Car) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.commit("update_car")
+	if _, exists := d.store.Car(car.Id); !exists {
+		return ErrCarNotFound
+	}
+	d.serveAfterCarChange(car.Id, d.resizeCar(car.Id, car.Seats))
+	return nil
+}
+
+// RemoveCar takes a car out of service, its groups go back to the start of
+// the waiting list
+func (d *Dispatcher) RemoveCar(carId uint) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.commit("remove_car")
+	if _, exists := d.store.Car(carId); !exists {
+		return ErrCarNotFound
+	}
+	ejected := d.removeCar(carId)
+	d.requeueGroups(ejected)
+	if len(ejected) > 0 {
+		d.serveWaitingGroups()
+	}
+	return nil
+}
+
+// SetCarStatus moves the car to a new status. A paused car keeps its groups
+// but it does not take new ones, and the groups of a car that goes out of
+// service go back to the start of the waiting list
+func (d *Dispatcher) SetCarStatus(carId uint, status CarStatus) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.commit("set_car_status")
+	car, exists := d.store.Car(carId)
+	if !exists {
+		return ErrCarNotFound
+	}
+	current := car.Status
+	if !current.canMoveTo(status) {
+		return ErrCarStatusTransition
+	}
+	if current == status {
+		return nil
+	}
+	d.serveAfterCarChange(carId, d.setCarStatus(carId, status))
+	return nil
+}
+
+// PatchCar changes the seats and the status of a car as a single operation,
+// a zero value leaves the field as it is. The status transition is checked
+// before anything changes, so an invalid one changes nothing
+func (d *Dispatcher) PatchCar(carId uint, update CarUpdate) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.commit("patch_car")
+	car, exists := d.store.Car(carId)
+	if !exists {
+		return ErrCarNotFound
+	}
+	current := car.Status
+	if update.Status != "" && !current.canMoveTo(update.Status) {
+		return ErrCarStatusTransition
+	}
+	ejected := []uint{}
+	if update.Seats != 0 {
+		ejected = d.resizeCar(carId, update.Seats)
+	}
+	if update.Status != "" && update.Status != current {
+		// the groups still in the car boarded before the ones that did not
+		// fit anymore
+		ejected = append(d.setCarStatus(carId, update.Status), ejected...)
+	}
+	if update.Seats != 0 || (update.Status != "" && update.Status != current) {
+		d.serveAfterCarChange(carId, ejected)
+	}
+	return nil
+}
+
+// setCarStatus moves the car to a new status, it returns the groups of a car
+// that goes out of service, they are left without car but they are not added
+// to the waiting list
+func (d *Dispatcher) setCarStatus(carId uint, status CarStatus) []uint {
+	ejected := []uint{}
+	if status == CarOutOfService {
+		ejected = append(ejected, d.carGroups[carId]...)
+		for _, groupId := range ejected {
+			d.unseatGroup(carId, groupId)
+		}
+	}
+	d.unindexCar(carId, d.carsMap[carId])
+	d.carsStatus[carId] = status
+	d.indexCar(carId, d.carsMap[carId])
+	d.record(Change{Kind: ChangeCarUpdated, Car: carId, Seats: d.carsSize[carId], Status: status})
+	return ejected
+}
+
+// serveAfterCarChange requeues the groups that left the car and offers the
+// free seats to the waiting groups
+func (d *Dispatcher) serveAfterCarChange(carId uint, ejected []uint) {
+	d.requeueGroups(ejected)
+	if len(ejected) > 0 {
+		// other cars may have seats for the groups that left this one
+		d.serveWaitingGroups()
+	} else {
+		d.tryAssignWaitingGroupsToCar(carId, d.carsMap[carId])
+	}
+}
+
+// Car returns the state of the car
+func (d *Dispatcher) Car(carId uint) (CarDetail, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, exists := d.store.Car(carId); !exists {
+		return CarDetail{}, ErrCarNotFound
+	}
+	return d.carDetail(carId), nil
+}
+
+// carDetail reads the car from the store, the free seats and the groups in
+// boarding order from the indexes
+func (d *Dispatcher) carDetail(carId uint) CarDetail {
+	car, _ := d.store.Car(carId)
+	groups := append([]uint{}, d.carGroups[carId]...)
+	return CarDetail{carId, car.Seats, d.carsMap[carId], car.Status, groups}
+}
+
+func (d *Dispatcher) addCar(car Car) {
+	d.record(Change{Kind: ChangeCarAdded, Car: car.Id, Seats: car.Seats})
+	d.carsMap[car.Id] = car.Seats
+	d.carsSize[car.Id] = car.Seats
+	d.carsStatus[car.Id] = CarInService
+	d.indexCar(car.Id, car.Seats)
+}
+
+// removeCar deletes the car, it returns the groups that were travelling in it,
+// they are left without car but they are not added to the waiting list
+func (d *Dispatcher) removeCar(carId uint) []uint {
+	ejected := append([]uint{}, d.carGroups[carId]...)
+	for _, groupId := range ejected {
+		d.unseatGroup(carId, groupId)
+	}
+	d.record(Change{Kind: ChangeCarRemoved, Car: carId})
+	d.unindexCar(carId, d.carsMap[carId])
+	delete(d.carsMap, carId)
+	delete(d.carsSize, carId)
+	delete(d.carsStatus, carId)
+	delete(d.carGroups, carId)
+	return ejected
+}
+
+// resizeCar changes the seats of the car, if the groups do not fit anymore
+// the last ones to board are taken out of the car and returned
+func (d *Dispatcher) resizeCar(carId uint, seats uint) []uint {
+	ejected := []uint{}
+	for d.carsSize[carId]-d.carsMap[carId] > seats {
+		groups := d.carGroups[carId]
+		groupId := groups[len(groups)-1]
+		d.unseatGroup(carId, groupId)
+		ejected = append([]uint{groupId}, ejected...)
+	}
+	occupied := d.carsSize[carId] - d.carsMap[carId]
+	d.unindexCar(carId, d.carsMap[carId])
+	d.carsSize[carId] = seats
+	d.carsMap[carId] = seats - occupied
+	d.indexCar(carId, d.carsMap[carId])
+	d.record(Change{Kind: ChangeCarUpdated, Car: carId, Seats: seats, Status: d.carsStatus[carId]})
+	return ejected
+}
+
+// requeueGroups puts the groups at the start of the waiting list keeping
+// their order, they were already served so they go before the groups that
+// never had a car
+func (d *Dispatcher) requeueGroups(groupIds []uint) {
+	for idx := len(groupIds) - 1; idx >= 0; idx-- {
+		d.record(Change{Kind: ChangeGroupQueued, Group: groupIds[idx], People: d.groupsMap[groupIds[idx]], Front: true})
+		d.waitingGroups.pushFront(groupIds[idx], d.groupsMap[groupIds[idx]], d.now())
+	}
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestDispatcher_ReconcileCars(t *testing.T) {
+	d := NewDispatcher()
+	d.ResetCars([]Car{{1, 4}, {2, 6}, {3, 5}})
+	d.RequestJourney(Group{1, 4}) // car 1
+	d.RequestJourney(Group{2, 2}) // car 3
+	d.RequestJourney(Group{3, 2}) // car 3
+	d.RequestJourney(Group{4, 6}) // car 2
+	d.RequestJourney(Group{5, 5}) // waiting
+	d.RequestJourney(Group{6, 3}) // waiting
+	assertLocate(t, d, 2, 3)
+	assertLocate(t, d, 3, 3)
+
+	// car 1 leaves, car 3 has 3 seats less and car 4 joins
+	if err := d.ReconcileCars([]Car{{2, 6}, {3, 4}, {4, 6}}); err != nil {
+		t.Fatalf("ReconcileCars() error = %v", err)
+	}
+	assertLocate(t, d, 4, 2)
+	assertLocate(t, d, 2, 3)
+	assertLocate(t, d, 3, 3)
+	// the group of car 1 goes before the groups that were already waiting
+	assertLocate(t, d, 1, 4)
+	assertLocate(t, d, 5, 0)
+	assertLocate(t, d, 6, 0)
+
+	// car 3 can only take 1 group of 2 now, the last one to board leaves it
+	if err := d.ReconcileCars([]Car{{2, 6}, {3, 2}, {4, 6}}); err != nil {
+		t.Fatalf("ReconcileCars() error = %v", err)
+	}
+	assertLocate(t, d, 2, 3)
+	assertLocate(t, d, 3, 4)
+	if d.carsMap[3] != 0 || d.carsMap[4] != 0 {
+		t.Fatalf("free seats = %d, %d want 0, 0", d.carsMap[3], d.carsMap[4])
+	}
+
+	if err := d.ReconcileCars([]Car{{2, 6}, {2, 4}}); err != ErrCarIdRepeated {
+		t.Fatalf("ReconcileCars() error = %v, want %v", err, ErrCarIdRepeated)
+	}
+	assertLocate(t, d, 4, 2)
+	assertLocate(t, d, 3, 4)
+}
+
+func TestDispatcher_AddUpdateRemoveCar(t *testing.T) {
+	d := NewDispatcher()
+	d.ResetCars([]Car{{1, 6}})
+	d.RequestJourney(Group{1, 2}) // car 1
+	d.RequestJourney(Group{2, 4}) // car 1
+	d.RequestJourney(Group{3, 5}) // waiting
+	d.RequestJourney(Group{4, 1}) // waiting
+
+	if err := d.AddCar(Car{1, 4}); err != ErrCarIdRepeated {
+		t.Fatalf("AddCar() error = %v, want %v", err, ErrCarIdRepeated)
+	}
+	// the new car is offered to the waiting groups
+	if err := d.AddCar(Car{2, 5}); err != nil {
+		t.Fatalf("AddCar() error = %v", err)
+	}
+	assertLocate(t, d, 3, 2)
+	assertLocate(t, d, 4, 0)
+
+	// the group of 4 boarded last, it leaves the car and goes first in the
+	// waiting list
+	d.RequestJourney(Group{5, 4}) // waiting
+	if err := d.UpdateCar(Car{1, 4}); err != nil {
+		t.Fatalf("UpdateCar() error = %v", err)
+	}
+	assertLocate(t, d, 1, 1)
+	assertLocate(t, d, 4, 1)
+	assertLocate(t, d, 2, 0)
+	if first := d.waitingGroups.head; first == nil || first.id != 2 {
+		t.Fatalf("the group that left the car is not the first waiting group")
+	}
+	if err := d.UpdateCar(Car{3, 4}); err != ErrCarNotFound {
+		t.Fatalf("UpdateCar() error = %v, want %v", err, ErrCarNotFound)
+	}
+
+	// the group of 5 goes back to the start of the waiting list
+	if err := d.RemoveCar(2); err != nil {
+		t.Fatalf("RemoveCar() error = %v", err)
+	}
+	assertLocate(t, d, 3, 0)
+	if first := d.waitingGroups.head; first == nil || first.id != 3 {
+		t.Fatalf("the group of the removed car is not the first waiting group")
+	}
+	// car 1 grows to 3 free seats, still not enough for anybody, then the
+	// group of 1 leaves and the group of 4 that waited first takes the seats
+	if err := d.UpdateCar(Car{1, 6}); err != nil {
+		t.Fatalf("UpdateCar() error = %v", err)
+	}
+	assertLocate(t, d, 2, 0)
+	d.Dropoff(4)
+	assertLocate(t, d, 2, 1)
+	assertLocate(t, d, 5, 0)
+	if err := d.RemoveCar(2); err != ErrCarNotFound {
+		t.Fatalf("RemoveCar() error = %v, want %v", err, ErrCarNotFound)
+	}
+}
+
+func TestDispatcher_SetCarStatus(t *testing.T) {
+	d := NewDispatcher()
+	d.ResetCars([]Car{{1, 6}, {2, 4}})
+	d.RequestJourney(Group{1, 2}) // car 2
+	d.RequestJourney(Group{2, 3}) // car 1
+
+	if err := d.SetCarStatus(1, CarPaused); err != nil {
+		t.Fatalf("SetCarStatus() error = %v", err)
+	}
+	// a paused car keeps its groups but it does not take new ones
+	d.RequestJourney(Group{3, 3})
+	assertLocate(t, d, 2, 1)
+	assertLocate(t, d, 3, 0)
+	d.Dropoff(2)
+	assertLocate(t, d, 3, 0)
+	if car, _ := d.Car(1); car.FreeSeats != 6 || car.Status != CarPaused {
+		t.Fatalf("Car(1) = %v", car)
+	}
+
+	// back in service, it takes the waiting group
+	if err := d.SetCarStatus(1, CarInService); err != nil {
+		t.Fatalf("SetCarStatus() error = %v", err)
+	}
+	assertLocate(t, d, 3, 1)
+
+	// out of service, its groups go back to the waiting list and take the
+	// free seats of other cars
+	d.RequestJourney(Group{4, 4}) // waiting
+	if err := d.SetCarStatus(1, CarOutOfService); err != nil {
+		t.Fatalf("SetCarStatus() error = %v", err)
+	}
+	assertLocate(t, d, 3, 0)
+	assertLocate(t, d, 4, 0)
+	if first := d.waitingGroups.head; first == nil || first.id != 3 {
+		t.Fatalf("the group of the car out of service is not the first waiting group")
+	}
+	d.Dropoff(1)
+	assertLocate(t, d, 3, 2)
+	if car, _ := d.Car(1); car.FreeSeats != 6 || len(car.Groups) != 0 {
+		t.Fatalf("Car(1) = %v", car)
+	}
+
+	if err := d.SetCarStatus(1, CarPaused); err != ErrCarStatusTransition {
+		t.Fatalf("SetCarStatus() error = %v, want %v", err, ErrCarStatusTransition)
+	}
+	if err := d.SetCarStatus(3, CarPaused); err != ErrCarNotFound {
+		t.Fatalf("SetCarStatus() error = %v, want %v", err, ErrCarNotFound)
+	}
+	if _, err := d.Car(3); err != ErrCarNotFound {
+		t.Fatalf("Car() error = %v, want %v", err, ErrCarNotFound)
+	}
+}
+
+func TestDispatcher_PatchCar(t *testing.T) {
+	operations := []Operation{}
+	d := NewDispatcher(WithObserver(func(op Operation) { operations = append(operations, op) }))
+	d.ResetCars([]Car{{1, 6}, {2, 4}})
+	d.RequestJourney(Group{1, 4}) // car 2
+	d.SetCarStatus(1, CarOutOfService)
+	operations = operations[:0]
+
+	// out of service can not be paused, the seats do not change either
+	if err := d.PatchCar(1, CarUpdate{Seats: 5, Status: CarPaused}); err != ErrCarStatusTransition {
+		t.Fatalf("PatchCar() error = %v, want %v", err, ErrCarStatusTransition)
+	}
+	if car, _ := d.Car(1); car.Seats != 6 || car.Status != CarOutOfService || len(operations) != 0 {
+		t.Fatalf("Car(1) = %v with %d operations, want it unchanged", car, len(operations))
+	}
+
+	// seats and status in one operation
+	if err := d.PatchCar(2, CarUpdate{Seats: 5, Status: CarOutOfService}); err != nil {
+		t.Fatalf("PatchCar() error = %v", err)
+	}
+	if car, _ := d.Car(2); car.Seats != 5 || car.Status != CarOutOfService || len(car.Groups) != 0 {
+		t.Fatalf("Car(2) = %v", car)
+	}
+	assertLocate(t, d, 1, 0)
+	if len(operations) != 1 || operations[0].Name != "patch_car" {
+		t.Fatalf("(Expected) 1 patch_car != %v (Returned)", operations)
+	}
+	if err := d.PatchCar(3, CarUpdate{Seats: 5}); err != ErrCarNotFound {
+		t.Fatalf("PatchCar() error = %v, want %v", err, ErrCarNotFound)
+	}
+}
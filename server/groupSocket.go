@@ -0,0 +1,142 @@
+package server
+
+import "time"
+
+// GroupUpdateStatus is the status of a group in the messages of its
+// WebSocket
+type GroupUpdateStatus string
+
+const (
+	GroupUpdateWaiting    GroupUpdateStatus = "waiting"
+	GroupUpdateAssigned   GroupUpdateStatus = "assigned"
+	GroupUpdateDroppedOff GroupUpdateStatus = "dropped_off"
+)
+
+// GroupUpdate is a message of the WebSocket of a group, it is sent when the
+// socket opens and every time the status, the position or the car of the
+// group change. Reason tells why a group was dropped off, dropoff or
+// fleet_reset
+type GroupUpdate struct {
+	Group         uint              `json:"group"`
+	Status        GroupUpdateStatus `json:"status"`
+	Position      int               `json:"position,omitempty"`
+	EstimatedWait int               `json:"estimated_wait_seconds,omitempty"`
+	Car           uint              `json:"car,omitempty"`
+	Reason        string            `json:"reason,omitempty"`
+}
+
+func groupUpdateOf(journey JourneyDetail) GroupUpdate {
+	if journey.Car != nil {
+		return GroupUpdate{Group: journey.Id, Status: GroupUpdateAssigned, Car: journey.Car.Id}
+	}
+	return GroupUpdate{Group: journey.Id, Status: GroupUpdateWaiting, Position: journey.Position, EstimatedWait: journey.EstimatedWait}
+}
+
+// groupWatch tells which events can change the update of a group. A waiting
+// group only moves when a waiting group ahead of it leaves the list or a
+// group is queued at the start, so the groups that arrive after it are kept
+// in behind and do not read the journey again when they leave. Its estimated
+// wait changes with the dropoff rate, on every car freed by a dropoff
+type groupWatch struct {
+	group  uint
+	behind map[uint]struct{}
+}
+
+func newGroupWatch(groupId uint) *groupWatch {
+	return &groupWatch{group: groupId, behind: map[uint]struct{}{}}
+}
+
+// moves tells if the event can change the update of the group, whose status
+// is waiting when waiting is set
+func (gw *groupWatch) moves(event Event, waiting bool) bool {
+	if event.Group == gw.group {
+		return true
+	}
+	_, behind := gw.behind[event.Group]
+	switch {
+	case event.Type == EventGroupQueued && !event.Front:
+		gw.behind[event.Group] = struct{}{}
+		return false
+	case event.Type == EventGroupQueued, event.Type == EventCarFreed:
+		return waiting
+	case event.Type == EventGroupAssigned && event.Waited,
+		event.Type == EventGroupDroppedOff && event.Car == 0:
+		delete(gw.behind, event.Group)
+		return waiting && !behind
+	}
+	return false
+}
+
+// lost forgets the groups behind, some events were missed
+func (gw *groupWatch) lost() {
+	gw.behind = map[uint]struct{}{}
+}
+
+// streamGroup sends the updates of a group until it is dropped off, the fleet
+// is reset, the client leaves or the server shuts down. The events of the
+// subscriber tell when the journey of the group must be read again, see
+// groupWatch
+func (h *handlers) streamGroup(ws *webSocket, subscriber *eventSubscriber, cursor uint64, update GroupUpdate) {
+	go ws.readLoop(3 * eventsHeartbeat)
+	if ws.writeJSON(update) != nil {
+		ws.conn.Close()
+		return
+	}
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	groupId := update.Group
+	watch := newGroupWatch(groupId)
+	for {
+		select {
+		case <-subscriber.wake:
+		case <-heartbeat.C:
+			if ws.writeFrame(wsPing, nil) != nil {
+				ws.conn.Close()
+				return
+			}
+			continue
+		case <-subscriber.done:
+			ws.close(wsCloseGoingAway, "the server is shutting down")
+			return
+		case <-ws.closed:
+			ws.conn.Close()
+			return
+		}
+		events, next, refresh := h.events.since(cursor)
+		cursor = next
+		if refresh {
+			watch.lost()
+		}
+		var last *GroupUpdate
+		for _, event := range events {
+			if event.Type == EventFleetReset {
+				last = &GroupUpdate{Group: groupId, Status: GroupUpdateDroppedOff, Reason: "fleet_reset"}
+				break
+			}
+			if event.Group == groupId && event.Type == EventGroupDroppedOff {
+				last = &GroupUpdate{Group: groupId, Status: GroupUpdateDroppedOff, Reason: "dropoff"}
+				break
+			}
+			if watch.moves(event, update.Status == GroupUpdateWaiting) {
+				refresh = true
+			}
+		}
+		if last == nil && refresh {
+			journey, err := h.dispatcher.Journey(groupId)
+			if err != nil {
+				last = &GroupUpdate{Group: groupId, Status: GroupUpdateDroppedOff}
+			} else if current := groupUpdateOf(journey); current != update {
+				update = current
+				if ws.writeJSON(update) != nil {
+					ws.conn.Close()
+					return
+				}
+			}
+		}
+		if last != nil {
+			ws.writeJSON(last)
+			ws.close(wsCloseNormal, "the group was dropped off")
+			return
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSocket is the client side of a WebSocket
+type testSocket struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialGroupSocket(t *testing.T, addr string, path string, headers ...string) (*testSocket, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	request := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n", path, addr)
+	for _, header := range headers {
+		if header != "" {
+			request += header + "\r\n"
+		}
+	}
+	fmt.Fprint(conn, request+"\r\n")
+	socket := &testSocket{conn: conn, reader: bufio.NewReader(conn)}
+	resp, err := http.ReadResponse(socket.reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return socket, resp
+}
+
+// next reads a frame of the server, they are never masked
+func (socket *testSocket) next(t *testing.T) (byte, []byte) {
+	t.Helper()
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(socket.reader, header); err != nil {
+		t.Fatalf("reading the socket: %v", err)
+	}
+	length := uint64(header[1] & 0x7F)
+	if length == 126 {
+		extended := make([]byte, 2)
+		io.ReadFull(socket.reader, extended)
+		length = uint64(binary.BigEndian.Uint16(extended))
+	}
+	payload := make([]byte, length)
+	io.ReadFull(socket.reader, payload)
+	return header[0] & 0x0F, payload
+}
+
+func (socket *testSocket) expect(t *testing.T, expected GroupUpdate) {
+	t.Helper()
+	opcode, payload := socket.next(t)
+	update := GroupUpdate{}
+	json.Unmarshal(payload, &update)
+	if opcode != wsText || update != expected {
+		t.Fatalf("(Expected) %+v != %d %s (Returned)", expected, opcode, payload)
+	}
+}
+
+func (socket *testSocket) expectClose(t *testing.T, code uint16) {
+	t.Helper()
+	opcode, payload := socket.next(t)
+	if opcode != wsClose || len(payload) < 2 || binary.BigEndian.Uint16(payload) != code {
+		t.Fatalf("(Expected) close %d != %d %v (Returned)", code, opcode, payload)
+	}
+}
+
+// send writes a masked frame, as the clients do
+func (socket *testSocket) send(opcode byte, payload []byte) {
+	mask := []byte{1, 2, 3, 4}
+	frame := append([]byte{0x80 | opcode, 0x80 | byte(len(payload))}, mask...)
+	for idx, b := range payload {
+		frame = append(frame, b^mask[idx%4])
+	}
+	socket.conn.Write(frame)
+}
+
+func TestGroupSocket(t *testing.T) {
+	h := &handlers{dispatcher: NewDispatcher(), events: newEventHub(eventHistory)}
+	h.dispatcher.addObserver(h.events.observe)
+	ts := httptest.NewServer(initRoutes(h))
+	defer ts.Close()
+	defer h.events.close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+	send := func(method, path, ctype, body string) {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", ctype)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	send("PUT", "/cars", ContentTypeJSON, `[ { "id": 1, "seats": 4 } ]`)
+	send("POST", "/journey", ContentTypeJSON, `{ "id": 1, "people": 4 }`)
+	send("POST", "/journey", ContentTypeJSON, `{ "id": 2, "people": 4 }`)
+	send("POST", "/journey", ContentTypeJSON, `{ "id": 3, "people": 4 }`)
+
+	var tests = []struct {
+		path   string
+		origin string
+		status int
+		code   string
+	}{
+		{"/v2/groups/9/ws", "", http.StatusNotFound, "group_not_found"},
+		{"/v2/groups/x/ws", "", http.StatusBadRequest, "invalid_group_id"},
+		{"/v2/groups/2/ws", "Origin: https://example.com", http.StatusForbidden, "origin_not_allowed"},
+		{"/v2/groups/2/ws", "", http.StatusForbidden, "origin_not_allowed"},
+	}
+	for _, test := range tests {
+		socket, resp := dialGroupSocket(t, addr, test.path, test.origin)
+		problem := Problem{}
+		json.NewDecoder(resp.Body).Decode(&problem)
+		socket.conn.Close()
+		if resp.StatusCode != test.status || string(problem.Code) != test.code {
+			t.Fatalf("%s: (Expected) %d %s != %d %s (Returned)", test.path, test.status, test.code, resp.StatusCode, problem.Code)
+		}
+	}
+	resp, err := http.Get(ts.URL + "/v2/groups/2/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired || resp.Header.Get("Upgrade") != "websocket" {
+		t.Fatalf("(Expected) %d != %d (Returned)", http.StatusUpgradeRequired, resp.StatusCode)
+	}
+
+	second, resp := dialGroupSocket(t, addr, "/v2/groups/2/ws", "Origin: http://"+addr)
+	defer second.conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("(Expected) %d != %d %s (Returned)", http.StatusSwitchingProtocols, resp.StatusCode, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+	second.expect(t, GroupUpdate{Group: 2, Status: GroupUpdateWaiting, Position: 1})
+	third, _ := dialGroupSocket(t, addr, "/v2/groups/3/ws", "Origin: http://"+addr)
+	defer third.conn.Close()
+	third.expect(t, GroupUpdate{Group: 3, Status: GroupUpdateWaiting, Position: 2})
+
+	second.send(wsPing, []byte("hi"))
+	if opcode, payload := second.next(t); opcode != wsPong || string(payload) != "hi" {
+		t.Fatalf("(Expected) pong hi != %d %s (Returned)", opcode, payload)
+	}
+
+	// the group 2 takes the car and the group 3 moves up
+	send("POST", "/dropoff", ContentTypeURLENCODED, "ID=1")
+	second.expect(t, GroupUpdate{Group: 2, Status: GroupUpdateAssigned, Car: 1})
+	third.expect(t, GroupUpdate{Group: 3, Status: GroupUpdateWaiting, Position: 1})
+
+	send("POST", "/dropoff", ContentTypeURLENCODED, "ID=2")
+	second.expect(t, GroupUpdate{Group: 2, Status: GroupUpdateDroppedOff, Reason: "dropoff"})
+	second.expectClose(t, wsCloseNormal)
+	second.send(wsClose, []byte{0x03, 0xE8})
+	third.expect(t, GroupUpdate{Group: 3, Status: GroupUpdateAssigned, Car: 1})
+
+	send("PUT", "/cars", ContentTypeJSON, `[ { "id": 1, "seats": 4 } ]`)
+	third.expect(t, GroupUpdate{Group: 3, Status: GroupUpdateDroppedOff, Reason: "fleet_reset"})
+	third.expectClose(t, wsCloseNormal)
+	third.send(wsClose, []byte{0x03, 0xE8})
+	if _, err := third.reader.ReadByte(); err == nil {
+		t.Fatalf("(Expected) the connection is closed")
+	}
+
+	// the subscriptions of the sockets are removed
+	time.Sleep(10 * time.Millisecond)
+	h.events.mu.Lock()
+	subscribers := len(h.events.subscribers)
+	h.events.mu.Unlock()
+	if subscribers != 0 {
+		t.Fatalf("(Expected) 0 != %d (Returned) subscribers", subscribers)
+	}
+}
+
+func Test_groupWatch(t *testing.T) {
+	watch := newGroupWatch(2)
+	var tests = []struct {
+		name    string
+		event   Event
+		waiting bool
+		moves   bool
+	}{
+		{"ItsOwnEvent", Event{Type: EventGroupQueued, Group: 2}, true, true},
+		{"QueuedBehind", Event{Type: EventGroupQueued, Group: 3}, true, false},
+		{"AssignedOnArrival", Event{Type: EventGroupAssigned, Group: 4, Car: 1}, true, false},
+		{"BehindLeaves", Event{Type: EventGroupAssigned, Group: 3, Car: 1, Waited: true}, true, false},
+		{"AheadLeaves", Event{Type: EventGroupAssigned, Group: 1, Car: 1, Waited: true}, true, true},
+		{"AheadDroppedOff", Event{Type: EventGroupDroppedOff, Group: 5}, true, true},
+		{"TravellingDroppedOff", Event{Type: EventGroupDroppedOff, Group: 4, Car: 1}, true, false},
+		{"DropoffRateChanges", Event{Type: EventCarFreed, Group: 4, Car: 1, FreeSeats: 4}, true, true},
+		{"QueuedAtTheStart", Event{Type: EventGroupQueued, Group: 6, Front: true}, true, true},
+		{"Travelling", Event{Type: EventGroupAssigned, Group: 6, Car: 1, Waited: true}, false, false},
+		{"TravellingItsOwnEvent", Event{Type: EventGroupDroppedOff, Group: 2, Car: 1}, false, true},
+	}
+	for _, tt := range tests {
+		if moves := watch.moves(tt.event, tt.waiting); moves != tt.moves {
+			t.Fatalf("%s: (Expected) %t != %t (Returned)", tt.name, tt.moves, moves)
+		}
+	}
+	// the groups behind are forgotten when some events are lost
+	watch.moves(Event{Type: EventGroupQueued, Group: 7}, true)
+	watch.lost()
+	if !watch.moves(Event{Type: EventGroupDroppedOff, Group: 7}, true) {
+		t.Fatalf("(Expected) a group that is not known to be behind moves the group")
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// overloadLatency is the longest wait for the lock of the dispatcher before
+// it is reported as overloaded
+const overloadLatency = 250 * time.Millisecond
+
+// lockPollInterval is the time between two tries of the lock of lockLatency
+const lockPollInterval = time.Millisecond
+
+// HealthCheck returns an error when the component is not healthy, such as the
+// sticky error of the write-ahead log
+type HealthCheck func() error
+
+type namedHealthCheck struct {
+	name  string
+	check HealthCheck
+}
+
+// WithHealthCheck adds a component to the readiness of the dispatcher
+func WithHealthCheck(name string, check HealthCheck) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.healthChecks = append(d.healthChecks, namedHealthCheck{name, check})
+	}
+}
+
+// ComponentHealth is the state of a component of the readiness
+type ComponentHealth struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// Readiness tells if the dispatcher can serve requests, it is ready when
+// every component is healthy
+type Readiness struct {
+	Ready      bool              `json:"ready"`
+	Components []ComponentHealth `json:"components"`
+}
+
+// BeginRecovery marks the dispatcher as not ready while its state is restored
+// from the store, the snapshot and the write-ahead log
+func (d *Dispatcher) BeginRecovery() {
+	atomic.StoreInt32(&d.recovering, 1)
+}
+
+// EndRecovery marks the end of the recovery started by BeginRecovery
+func (d *Dispatcher) EndRecovery() {
+	atomic.StoreInt32(&d.recovering, 0)
+}
+
+// Recovering tells if the state is being restored
+func (d *Dispatcher) Recovering() bool {
+	return atomic.LoadInt32(&d.recovering) == 1
+}
+
+func (d *Dispatcher) markFleetLoaded() {
+	atomic.StoreInt32(&d.fleetLoaded, 1)
+}
+
+// Readiness checks every component. It never waits for the lock of the
+// dispatcher longer than overloadLatency, so it answers during a long reset
+// of the cars
+func (d *Dispatcher) Readiness() Readiness {
+	readiness := Readiness{Ready: true}
+	add := func(name string, err error) {
+		component := ComponentHealth{Name: name, Healthy: err == nil}
+		if err != nil {
+			component.Detail = err.Error()
+			readiness.Ready = false
+		}
+		readiness.Components = append(readiness.Components, component)
+	}
+	var err error
+	if d.Recovering() {
+		err = fmt.Errorf("restoring the state")
+	}
+	add("recovery", err)
+	err = nil
+	if atomic.LoadInt32(&d.resetting) > 0 {
+		err = fmt.Errorf("the cars are being reset")
+	} else if atomic.LoadInt32(&d.fleetLoaded) == 0 {
+		err = fmt.Errorf("no fleet loaded yet, PUT /cars loads it")
+	}
+	add("fleet", err)
+	err = nil
+	if latency, ok := d.lockLatency(overloadLatency); !ok {
+		err = fmt.Errorf("overloaded, the dispatcher was busy for more than %v", latency)
+	}
+	add("dispatcher", err)
+	for _, health := range d.healthChecks {
+		add(health.name, health.check())
+	}
+	return readiness
+}
+
+// lockLatency measures the wait for the lock of the dispatcher, it gives up
+// after timeout. The lock is tried every lockPollInterval, so a probe that
+// gives up leaves nothing waiting in the queue of the lock
+func (d *Dispatcher) lockLatency(timeout time.Duration) (time.Duration, bool) {
+	start := time.Now()
+	for !d.mu.TryLock() {
+		if time.Since(start) >= timeout {
+			return timeout, false
+		}
+		time.Sleep(lockPollInterval)
+	}
+	d.mu.Unlock()
+	return time.Since(start), true
+}
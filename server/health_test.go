@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// unhealthy returns the components of the readiness that are not healthy
+func unhealthy(readiness Readiness) string {
+	names := []string{}
+	for _, component := range readiness.Components {
+		if !component.Healthy {
+			names = append(names, component.Name+": "+component.Detail)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+func TestReadiness(t *testing.T) {
+	var walErr error
+	d := NewDispatcher(WithHealthCheck("wal", func() error { return walErr }))
+	handler := New("", d).Handler
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", ContentTypeJSON)
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	ready := func(status int, expected string) {
+		t.Helper()
+		w := send("GET", "/ready", "")
+		readiness := Readiness{}
+		json.Unmarshal(w.Body.Bytes(), &readiness)
+		if w.Code != status || unhealthy(readiness) != expected || readiness.Ready != (status == http.StatusOK) {
+			t.Fatalf("(Expected) %d %s != %d %s (Returned)", status, expected, w.Code, w.Body.String())
+		}
+		if len(readiness.Components) != 4 {
+			t.Fatalf("(Expected) 4 != %d (Returned) components", len(readiness.Components))
+		}
+	}
+
+	ready(http.StatusServiceUnavailable, "fleet: no fleet loaded yet, PUT /cars loads it")
+	if w := send("GET", "/status", ""); w.Code != http.StatusOK {
+		t.Fatalf("/status must stay 200 for the challenge, got %d", w.Code)
+	}
+	send("PUT", "/cars", `[]`)
+	ready(http.StatusOK, "")
+
+	d.BeginRecovery()
+	ready(http.StatusServiceUnavailable, "recovery: restoring the state")
+	if w := send("POST", "/journey", `{ "id": 1, "people": 4 }`); w.Code != http.StatusServiceUnavailable || responseMessage(w) != "not_ready: the state is being recovered" {
+		t.Fatalf("(Expected) %d != %d %s (Returned)", http.StatusServiceUnavailable, w.Code, responseMessage(w))
+	}
+	for _, path := range []string{"/status", "/live", "/metrics"} {
+		if w := send("GET", path, ""); w.Code != http.StatusOK {
+			t.Fatalf("%s: (Expected) %d != %d (Returned) while recovering", path, http.StatusOK, w.Code)
+		}
+	}
+	d.EndRecovery()
+
+	atomic.AddInt32(&d.resetting, 1)
+	walErr = fmt.Errorf("disk full")
+	ready(http.StatusServiceUnavailable, "fleet: the cars are being reset, wal: disk full")
+	atomic.AddInt32(&d.resetting, -1)
+	walErr = nil
+
+	// a request that holds the lock makes the dispatcher overloaded, and the
+	// probe leaves no goroutine waiting for the lock
+	d.mu.Lock()
+	goroutines := runtime.NumGoroutine()
+	readiness := d.Readiness()
+	leaked := runtime.NumGoroutine() - goroutines
+	d.mu.Unlock()
+	if leaked > 0 {
+		t.Fatalf("(Expected) 0 != %d (Returned) goroutines left by the probe", leaked)
+	}
+	if readiness.Ready || !strings.HasPrefix(unhealthy(readiness), "dispatcher: overloaded") {
+		t.Fatalf("(Expected) dispatcher overloaded != %s (Returned)", unhealthy(readiness))
+	}
+	ready(http.StatusOK, "")
+
+	if w := send("GET", "/live", ""); w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"status":"alive"}` {
+		t.Fatalf("(Expected) %d != %d %s (Returned)", http.StatusOK, w.Code, w.Body.String())
+	}
+}
+
+func TestReadiness_FleetLoaded(t *testing.T) {
+	repeated := []Car{{1, 4}, {1, 6}}
+	tests := []struct {
+		name   string
+		load   func(d *Dispatcher) error
+		loaded bool
+	}{
+		{"Reset", func(d *Dispatcher) error { return d.ResetCars([]Car{{1, 4}}) }, true},
+		{"EmptyReset", func(d *Dispatcher) error { return d.ResetCars([]Car{}) }, true},
+		{"RepeatedReset", func(d *Dispatcher) error { return d.ResetCars(repeated) }, false},
+		{"Reconcile", func(d *Dispatcher) error { return d.ReconcileCars([]Car{{1, 4}}) }, true},
+		{"RepeatedReconcile", func(d *Dispatcher) error { return d.ReconcileCars(repeated) }, false},
+		{"AddCar", func(d *Dispatcher) error { return d.AddCar(Car{1, 4}) }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the replica applies the operations of the dispatcher
+			replica := NewDispatcher()
+			d := NewDispatcher(WithObserver(replica.Apply))
+			err := tt.load(d)
+			if (err == nil) != tt.loaded {
+				t.Fatalf("(Expected) loaded %v != error %v (Returned)", tt.loaded, err)
+			}
+			for _, dispatcher := range []*Dispatcher{d, replica} {
+				if loaded := atomic.LoadInt32(&dispatcher.fleetLoaded) == 1; loaded != tt.loaded {
+					t.Fatalf("(Expected) loaded %v != %v (Returned)", tt.loaded, loaded)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// The listings read their pages from indexes kept ordered by id, split by the
+// values of the sort keys and of the filters, that are small: the status, the
+// seats and the free seats of the cars and the people of the groups. A page
+// seeks the cursor in the indexes that match the filters and merges them, so
+// it reads only the rows of the page whatever the size of the fleet
+
+// idsBlock is the size of the blocks of an orderedIds, a block is split when
+// it doubles
+const idsBlock = 256
+
+// orderedIds is a set of ids kept in order in sorted blocks, an id is added
+// or removed moving at most a block and the position of an id is found with
+// two binary searches
+type orderedIds struct {
+	blocks [][]uint
+	count  int
+}
+
+// find returns the first position with an id not lower than id, the block
+// is len(blocks) when every id is lower
+func (s *orderedIds) find(id uint) (int, int) {
+	block := sort.Search(len(s.blocks), func(i int) bool {
+		ids := s.blocks[i]
+		return ids[len(ids)-1] >= id
+	})
+	if block == len(s.blocks) {
+		return block, 0
+	}
+	ids := s.blocks[block]
+	return block, sort.Search(len(ids), func(i int) bool { return ids[i] >= id })
+}
+
+func (s *orderedIds) add(id uint) {
+	block, idx := s.find(id)
+	if block == len(s.blocks) {
+		// the highest id goes at the end of the last block
+		if block == 0 {
+			s.blocks = append(s.blocks, nil)
+		}
+		block = len(s.blocks) - 1
+		idx = len(s.blocks[block])
+	} else if s.blocks[block][idx] == id {
+		return
+	}
+	ids := append(s.blocks[block], 0)
+	copy(ids[idx+1:], ids[idx:])
+	ids[idx] = id
+	s.blocks[block] = ids
+	s.count++
+	if len(ids) >= 2*idsBlock {
+		half := append([]uint{}, ids[idsBlock:]...)
+		s.blocks[block] = ids[:idsBlock:idsBlock]
+		s.blocks = append(s.blocks, nil)
+		copy(s.blocks[block+2:], s.blocks[block+1:])
+		s.blocks[block+1] = half
+	}
+}
+
+func (s *orderedIds) remove(id uint) {
+	block, idx := s.find(id)
+	if block == len(s.blocks) || s.blocks[block][idx] != id {
+		return
+	}
+	ids := s.blocks[block]
+	s.blocks[block] = append(ids[:idx], ids[idx+1:]...)
+	s.count--
+	if len(s.blocks[block]) == 0 {
+		s.blocks = append(s.blocks[:block], s.blocks[block+1:]...)
+	}
+}
+
+// idIterator reads an orderedIds in one direction, the set must not change
+// while it is read
+type idIterator struct {
+	set         *orderedIds
+	block, idx  int
+	desc, ended bool
+}
+
+// after returns an iterator over the ids after id in the direction of desc.
+// Going up every id is after 0, going down 0 starts at the highest id
+func (s *orderedIds) after(id uint, desc bool) *idIterator {
+	it := &idIterator{set: s, desc: desc}
+	switch {
+	case !desc:
+		it.block, it.idx = s.find(id + 1)
+		it.ended = id+1 == 0 || it.block == len(s.blocks)
+	case id == 0:
+		it.block = len(s.blocks) - 1
+		it.ended = it.block < 0
+		if !it.ended {
+			it.idx = len(s.blocks[it.block]) - 1
+		}
+	default:
+		// the position before the first id not lower than id
+		it.block, it.idx = s.find(id)
+		it.step()
+	}
+	return it
+}
+
+func (it *idIterator) next() (uint, bool) {
+	if it.ended {
+		return 0, false
+	}
+	id := it.set.blocks[it.block][it.idx]
+	it.step()
+	return id, true
+}
+
+func (it *idIterator) step() {
+	if !it.desc {
+		if it.idx++; it.idx == len(it.set.blocks[it.block]) {
+			it.block, it.idx = it.block+1, 0
+			it.ended = it.block == len(it.set.blocks)
+		}
+		return
+	}
+	if it.idx--; it.idx < 0 {
+		it.block--
+		it.ended = it.block < 0
+		if !it.ended {
+			it.idx = len(it.set.blocks[it.block]) - 1
+		}
+	}
+}
+
+// rowStream reads the rows of an index whose ids all have the same sort key,
+// or whose key is the id when byId is set
+type rowStream struct {
+	ids  *idIterator
+	key  int64
+	byId bool
+	row  ListCursor
+}
+
+func (s *rowStream) advance() bool {
+	id, ok := s.ids.next()
+	if !ok {
+		return false
+	}
+	s.row = ListCursor{s.key, id}
+	if s.byId {
+		s.row.Key = int64(id)
+	}
+	return true
+}
+
+// rowMerge joins the streams of several indexes in the order of the listing,
+// starting after the cursor
+type rowMerge struct {
+	streams []*rowStream
+	desc    bool
+	after   *ListCursor
+}
+
+func newRowMerge(desc bool, after *ListCursor) *rowMerge {
+	return &rowMerge{desc: desc, after: after}
+}
+
+// add reads the index, key is the sort key of its ids or -1 when the listing
+// is sorted by id. An index that is before the cursor is left out
+func (m *rowMerge) add(set *orderedIds, key int64) {
+	stream := &rowStream{key: key, byId: key < 0}
+	var from uint
+	if m.after != nil {
+		if stream.byId || key == m.after.Key {
+			from = m.after.Id
+		} else if (key < m.after.Key) != m.desc {
+			return
+		}
+	}
+	stream.ids = set.after(from, m.desc)
+	if stream.advance() {
+		m.streams = append(m.streams, stream)
+	}
+}
+
+// rows returns up to limit rows, and the cursor of the next page or nil when
+// there are no more rows
+func (m *rowMerge) rows(limit int) ([]ListCursor, *ListCursor) {
+	heap.Init(m)
+	rows := []ListCursor{}
+	for m.Len() > 0 && len(rows) <= limit {
+		stream := m.streams[0]
+		rows = append(rows, stream.row)
+		if stream.advance() {
+			heap.Fix(m, 0)
+		} else {
+			heap.Pop(m)
+		}
+	}
+	return pageOf(rows, limit)
+}
+
+// pageOf cuts the rows read to the page, the row after the limit tells that
+// there is a next page
+func pageOf(rows []ListCursor, limit int) ([]ListCursor, *ListCursor) {
+	if len(rows) <= limit {
+		return rows, nil
+	}
+	rows = rows[:limit]
+	if len(rows) == 0 {
+		return rows, nil
+	}
+	next := rows[len(rows)-1]
+	return rows, &next
+}
+
+func (m *rowMerge) Len() int { return len(m.streams) }
+
+func (m *rowMerge) Less(i, j int) bool {
+	return listRowAfter(m.streams[j].row, m.streams[i].row, m.desc)
+}
+
+func (m *rowMerge) Swap(i, j int) { m.streams[i], m.streams[j] = m.streams[j], m.streams[i] }
+
+func (m *rowMerge) Push(x any) { m.streams = append(m.streams, x.(*rowStream)) }
+
+func (m *rowMerge) Pop() any {
+	last := m.streams[len(m.streams)-1]
+	m.streams = m.streams[:len(m.streams)-1]
+	return last
+}
+
+// carListKey is the index of the cars with the same status, seats and free
+// seats
+type carListKey struct {
+	status      CarStatus
+	seats, free uint
+}
+
+// listIndex keeps the cars and the travelling groups ordered for the
+// listings. travelling has every travelling group at 0 and the groups of n
+// people at n, busyCars the cars with groups the same way
+type listIndex struct {
+	cars       map[carListKey]*orderedIds
+	travelling [MaxPeople + 1]orderedIds
+	busyCars   [MaxPeople + 1]orderedIds
+}
+
+func newListIndex() *listIndex {
+	return &listIndex{cars: make(map[carListKey]*orderedIds)}
+}
+
+func (x *listIndex) addCar(key carListKey, carId uint) {
+	if x.cars[key] == nil {
+		x.cars[key] = &orderedIds{}
+	}
+	x.cars[key].add(carId)
+}
+
+func (x *listIndex) removeCar(key carListKey, carId uint) {
+	if set := x.cars[key]; set != nil {
+		set.remove(carId)
+		if set.count == 0 {
+			delete(x.cars, key)
+		}
+	}
+}
+
+// board adds the group to the listings of the travelling groups
+func (x *listIndex) board(carId uint, groupId uint, people uint) {
+	x.travelling[0].add(groupId)
+	x.travelling[people].add(groupId)
+	x.busyCars[0].add(carId)
+	x.busyCars[people].add(carId)
+}
+
+// leave takes the group out of the listings, groups are the ones left in the
+// car and peopleOf gives their people
+func (x *listIndex) leave(carId uint, groupId uint, people uint, groups []uint, peopleOf map[uint]uint) {
+	x.travelling[0].remove(groupId)
+	x.travelling[people].remove(groupId)
+	if len(groups) == 0 {
+		x.busyCars[0].remove(carId)
+	}
+	for _, other := range groups {
+		if peopleOf[other] == people {
+			return
+		}
+	}
+	x.busyCars[people].remove(carId)
+}
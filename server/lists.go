@@ -0,0 +1,201 @@
+package server
+
+import "sort"
+
+// The listings are paginated with a cursor, that is the sort key and the id
+// of the last row of the page. A page seeks the cursor in the indexes of
+// listIndex, so the rows added or removed between two pages do not move the
+// following ones
+
+// ListOrder sorts a listing by Key, the ties are sorted by id in the same
+// direction
+type ListOrder struct {
+	Key  string
+	Desc bool
+}
+
+// ListCursor is the sort key and the id of the last row of a page
+type ListCursor struct {
+	Key int64
+	Id  uint
+}
+
+// CarFilter selects the cars of ListCars, the zero fields do not filter
+type CarFilter struct {
+	MinFreeSeats uint
+	Seats        uint
+	Status       CarStatus
+}
+
+// JourneyFilter selects the groups of ListJourneys, the zero fields do not
+// filter
+type JourneyFilter struct {
+	Car    uint
+	People uint
+}
+
+// CarSortKeys and JourneySortKeys are the keys ListCars and ListJourneys
+// sort by
+var CarSortKeys = []string{"id", "seats", "free_seats"}
+var JourneySortKeys = []string{"id", "people", "car"}
+
+// carListSortKey is the sort key of the cars of an index, -1 when the cars
+// are sorted by id
+func carListSortKey(key string, cars carListKey) int64 {
+	switch key {
+	case "seats":
+		return int64(cars.seats)
+	case "free_seats":
+		return int64(cars.free)
+	}
+	return -1
+}
+
+func (d *Dispatcher) journeySortKey(key string, groupId uint) int64 {
+	switch key {
+	case "people":
+		return int64(d.groupsMap[groupId])
+	case "car":
+		return int64(d.journeysMap[groupId])
+	}
+	return int64(groupId)
+}
+
+// ListCars returns up to limit cars after the cursor, and the cursor of the
+// next page or nil when there are no more cars
+func (d *Dispatcher) ListCars(filter CarFilter, order ListOrder, after *ListCursor, limit int) ([]CarDetail, *ListCursor) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	merge := newRowMerge(order.Desc, after)
+	for key, cars := range d.lists.cars {
+		if key.free < filter.MinFreeSeats ||
+			(filter.Seats != 0 && key.seats != filter.Seats) ||
+			(filter.Status != "" && key.status != filter.Status) {
+			continue
+		}
+		merge.add(cars, carListSortKey(order.Key, key))
+	}
+	rows, next := merge.rows(limit)
+	cars := make([]CarDetail, 0, len(rows))
+	for _, row := range rows {
+		cars = append(cars, d.carDetail(row.Id))
+	}
+	return cars, next
+}
+
+// ListJourneys returns up to limit travelling groups after the cursor, and
+// the cursor of the next page or nil when there are no more groups
+func (d *Dispatcher) ListJourneys(filter JourneyFilter, order ListOrder, after *ListCursor, limit int) ([]JourneyDetail, *ListCursor) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var rows []ListCursor
+	var next *ListCursor
+	switch {
+	case filter.Car != 0:
+		rows, next = pageOf(d.carJourneyRows(filter.Car, filter.People, order, after, nil), limit)
+	case order.Key == "car":
+		rows, next = d.journeyRowsByCar(filter.People, order, after, limit)
+	default:
+		merge := newRowMerge(order.Desc, after)
+		if filter.People != 0 || order.Key != "people" {
+			key := int64(-1)
+			if order.Key == "people" {
+				key = int64(filter.People)
+			}
+			merge.add(&d.lists.travelling[filter.People], key)
+		} else {
+			for people := MinPeople; people <= MaxPeople; people++ {
+				merge.add(&d.lists.travelling[people], int64(people))
+			}
+		}
+		rows, next = merge.rows(limit)
+	}
+	journeys := make([]JourneyDetail, 0, len(rows))
+	for _, row := range rows {
+		journeys = append(journeys, d.journeyDetail(row.Id))
+	}
+	return journeys, next
+}
+
+// journeyRowsByCar reads the cars with groups from the car of the cursor,
+// the groups of a car are sorted by id
+func (d *Dispatcher) journeyRowsByCar(people uint, order ListOrder, after *ListCursor, limit int) ([]ListCursor, *ListCursor) {
+	rows := []ListCursor{}
+	var from uint
+	if after != nil && after.Key > 0 {
+		from = uint(after.Key)
+		rows = d.carJourneyRows(from, people, order, after, rows)
+	}
+	cars := d.lists.busyCars[people].after(from, order.Desc)
+	for len(rows) <= limit {
+		carId, ok := cars.next()
+		if !ok {
+			break
+		}
+		rows = d.carJourneyRows(carId, people, order, after, rows)
+	}
+	return pageOf(rows, limit)
+}
+
+// carJourneyRows appends the groups of the car after the cursor to rows in
+// the order of the listing, a car has a few groups so they are sorted here
+func (d *Dispatcher) carJourneyRows(carId uint, people uint, order ListOrder, after *ListCursor, rows []ListCursor) []ListCursor {
+	first := len(rows)
+	for _, groupId := range d.carGroups[carId] {
+		row := ListCursor{d.journeySortKey(order.Key, groupId), groupId}
+		if (people == 0 || d.groupsMap[groupId] == people) && (after == nil || listRowAfter(row, *after, order.Desc)) {
+			rows = append(rows, row)
+		}
+	}
+	added := rows[first:]
+	sort.Slice(added, func(i, j int) bool { return listRowAfter(added[j], added[i], order.Desc) })
+	return rows
+}
+
+// ListWaiting returns up to limit waiting groups after the cursor in arrival
+// order, only the groups of the given people when it is not 0. The key of the
+// cursor is the arrival of the group, the page is read following the list
+func (d *Dispatcher) ListWaiting(people uint, desc bool, after *ListCursor, limit int) ([]JourneyDetail, *ListCursor) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	l := d.waitingGroups
+	first, step := l.head, func(node *waitingGroup) *waitingGroup { return node.next }
+	if people != 0 {
+		first, step = l.bySize[people].head, func(node *waitingGroup) *waitingGroup { return node.nextSize }
+	}
+	if desc {
+		first, step = l.tail, func(node *waitingGroup) *waitingGroup { return node.prev }
+		if people != 0 {
+			first, step = l.bySize[people].tail, func(node *waitingGroup) *waitingGroup { return node.prevSize }
+		}
+	}
+	node := first
+	if after != nil {
+		if last, ok := l.groups[after.Id]; ok && last.arrival == after.Key && (people == 0 || last.people == people) {
+			node = step(last)
+		} else {
+			// the last group of the page left the list, the page starts at
+			// the first group that arrived after it
+			for node != nil && !listRowAfter(ListCursor{node.arrival, node.id}, *after, desc) {
+				node = step(node)
+			}
+		}
+	}
+	journeys := []JourneyDetail{}
+	for ; node != nil && len(journeys) < limit; node = step(node) {
+		journeys = append(journeys, d.journeyDetail(node.id))
+	}
+	if node == nil || len(journeys) == 0 {
+		return journeys, nil
+	}
+	last := l.groups[journeys[len(journeys)-1].Id]
+	return journeys, &ListCursor{last.arrival, last.id}
+}
+
+// listRowAfter tells if the row goes after the cursor in the order
+func listRowAfter(row, cursor ListCursor, desc bool) bool {
+	if row.Key != cursor.Key {
+		return (row.Key > cursor.Key) != desc
+	}
+	return row.Id != cursor.Id && (row.Id > cursor.Id) != desc
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDispatcher_ListCars(t *testing.T) {
+	d := NewDispatcher()
+	fleet := []Car{}
+	for carId := uint(1); carId <= 25; carId++ {
+		fleet = append(fleet, Car{carId, 4 + carId%3})
+	}
+	d.ResetCars(fleet)
+	// the groups fill the cars of 4 seats 3, 6 and 9
+	for groupId := uint(1); groupId <= 3; groupId++ {
+		d.RequestJourney(Group{groupId, 4})
+	}
+	tests := []struct {
+		name     string
+		filter   CarFilter
+		order    ListOrder
+		limit    int
+		expected []uint
+	}{
+		{"ById", CarFilter{}, ListOrder{"id", false}, 10, []uint{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25}},
+		{"ByIdDesc", CarFilter{}, ListOrder{"id", true}, 7, []uint{25, 24, 23, 22, 21, 20, 19, 18, 17, 16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1}},
+		{"SixSeats", CarFilter{Seats: 6}, ListOrder{"id", false}, 3, []uint{2, 5, 8, 11, 14, 17, 20, 23}},
+		{"ByFreeSeats", CarFilter{MinFreeSeats: 1}, ListOrder{"free_seats", false}, 4, []uint{12, 15, 18, 21, 24, 1, 4, 7, 10, 13, 16, 19, 22, 25, 2, 5, 8, 11, 14, 17, 20, 23}},
+		{"MinFreeSeats", CarFilter{MinFreeSeats: 5}, ListOrder{"free_seats", true}, 100, []uint{23, 20, 17, 14, 11, 8, 5, 2, 25, 22, 19, 16, 13, 10, 7, 4, 1}},
+		{"Paused", CarFilter{Status: CarPaused}, ListOrder{"id", false}, 10, []uint{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids := []uint{}
+			var after *ListCursor
+			for pages := 0; pages == 0 || after != nil; pages++ {
+				var cars []CarDetail
+				cars, after = d.ListCars(tt.filter, tt.order, after, tt.limit)
+				if len(cars) > tt.limit || (after != nil && len(cars) != tt.limit) {
+					t.Fatalf("page %d has %d cars with a limit of %d", pages, len(cars), tt.limit)
+				}
+				for _, car := range cars {
+					ids = append(ids, car.Id)
+				}
+			}
+			if len(ids) != len(tt.expected) {
+				t.Fatalf("(Expected) %v != %v (Returned)", tt.expected, ids)
+			}
+			for idx := range ids {
+				if ids[idx] != tt.expected[idx] {
+					t.Fatalf("(Expected) %v != %v (Returned)", tt.expected, ids)
+				}
+			}
+		})
+	}
+}
+
+// TestDispatcher_ListIndex pages the listings after random changes and
+// compares them with the rows sorted from the maps of the dispatcher
+func TestDispatcher_ListIndex(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	d := NewDispatcher()
+	fleet := []Car{}
+	for carId := uint(1); carId <= 300; carId++ {
+		fleet = append(fleet, Car{carId, MinSeats + uint(rnd.Intn(int(MaxSeats-MinSeats+1)))})
+	}
+	d.ResetCars(fleet)
+	statuses := []CarStatus{CarInService, CarPaused, CarOutOfService}
+	nextGroup := uint(1)
+	for step := 0; step < 3000; step++ {
+		switch n := rnd.Intn(10); {
+		case n < 5:
+			d.RequestJourney(Group{nextGroup, MinPeople + uint(rnd.Intn(int(MaxPeople)))})
+			nextGroup++
+		case n < 8:
+			d.Dropoff(uint(1 + rnd.Intn(int(nextGroup))))
+		case n == 8:
+			d.SetCarStatus(uint(1+rnd.Intn(len(fleet))), statuses[rnd.Intn(len(statuses))])
+		default:
+			carId := uint(1 + rnd.Intn(len(fleet)))
+			if rnd.Intn(2) == 0 {
+				d.RemoveCar(carId)
+			} else {
+				d.AddCar(Car{carId, MinSeats + uint(rnd.Intn(int(MaxSeats-MinSeats+1)))})
+				d.UpdateCar(Car{carId, MinSeats + uint(rnd.Intn(int(MaxSeats-MinSeats+1)))})
+			}
+		}
+		if step%500 != 499 {
+			continue
+		}
+		if step == 1999 {
+			// a restored dispatcher rebuilds the indexes
+			restored := NewDispatcher()
+			if err := restored.Restore(d.Snapshot()); err != nil {
+				t.Fatal(err)
+			}
+			d = restored
+		}
+		for _, key := range CarSortKeys {
+			for _, filter := range []CarFilter{{}, {MinFreeSeats: 2}, {Seats: 5}, {Status: CarPaused}} {
+				order := ListOrder{key, step%1000 == 499}
+				expected := []ListCursor{}
+				for carId, seats := range d.carsSize {
+					free := d.carsMap[carId]
+					if free < filter.MinFreeSeats || (filter.Seats != 0 && seats != filter.Seats) ||
+						(filter.Status != "" && d.carsStatus[carId] != filter.Status) {
+						continue
+					}
+					row := ListCursor{int64(carId), carId}
+					if key != "id" {
+						row.Key = carListSortKey(key, carListKey{seats: seats, free: free})
+					}
+					expected = append(expected, row)
+				}
+				returned := []uint{}
+				var after *ListCursor
+				for pages := 0; pages == 0 || after != nil; pages++ {
+					var cars []CarDetail
+					cars, after = d.ListCars(filter, order, after, 7)
+					for _, car := range cars {
+						returned = append(returned, car.Id)
+					}
+				}
+				compareListRows(t, fmt.Sprintf("cars %+v %+v", filter, order), expected, order.Desc, returned)
+			}
+		}
+		for _, key := range JourneySortKeys {
+			for _, filter := range []JourneyFilter{{}, {People: 3}, {Car: uint(1 + rnd.Intn(len(fleet)))}} {
+				order := ListOrder{key, step%1000 == 999}
+				expected := []ListCursor{}
+				for groupId, carId := range d.journeysMap {
+					if carId == 0 || (filter.People != 0 && d.groupsMap[groupId] != filter.People) ||
+						(filter.Car != 0 && carId != filter.Car) {
+						continue
+					}
+					expected = append(expected, ListCursor{d.journeySortKey(key, groupId), groupId})
+				}
+				returned := []uint{}
+				var after *ListCursor
+				for pages := 0; pages == 0 || after != nil; pages++ {
+					var journeys []JourneyDetail
+					journeys, after = d.ListJourneys(filter, order, after, 7)
+					for _, journey := range journeys {
+						returned = append(returned, journey.Id)
+					}
+				}
+				compareListRows(t, fmt.Sprintf("journeys %+v %+v", filter, order), expected, order.Desc, returned)
+			}
+		}
+	}
+}
+
+func compareListRows(t *testing.T, name string, expected []ListCursor, desc bool, returned []uint) {
+	t.Helper()
+	sort.Slice(expected, func(i, j int) bool { return listRowAfter(expected[j], expected[i], desc) })
+	ids := []uint{}
+	for _, row := range expected {
+		ids = append(ids, row.Id)
+	}
+	if fmt.Sprint(ids) != fmt.Sprint(returned) {
+		t.Fatalf("%s: (Expected) %v != %v (Returned)", name, ids, returned)
+	}
+}
+
+func TestDispatcher_ListWaiting(t *testing.T) {
+	d := NewDispatcher()
+	d.ResetCars([]Car{{1, 5}})
+	for groupId := uint(1); groupId <= 9; groupId++ {
+		d.RequestJourney(Group{groupId, 4 + groupId%2})
+	}
+	// group 1 travels, the groups 2 to 9 wait
+	journeys, next := d.ListWaiting(0, false, nil, 3)
+	if len(journeys) != 3 || journeys[0].Id != 2 || journeys[0].Position != 1 || journeys[2].Id != 4 || next == nil {
+		t.Fatalf("first page %+v, %v", journeys, next)
+	}
+	// the last group of the page leaves, the next page starts after it
+	d.Dropoff(4)
+	journeys, next = d.ListWaiting(0, false, next, 3)
+	if len(journeys) != 3 || journeys[0].Id != 5 || journeys[0].Position != 3 || next == nil {
+		t.Fatalf("second page %+v, %v", journeys, next)
+	}
+	journeys, next = d.ListWaiting(0, false, next, 3)
+	if len(journeys) != 2 || journeys[1].Id != 9 || next != nil {
+		t.Fatalf("last page %+v, %v", journeys, next)
+	}
+	journeys, next = d.ListWaiting(5, true, nil, 2)
+	if len(journeys) != 2 || journeys[0].Id != 9 || journeys[1].Id != 7 || journeys[1].SizePosition != 3 || next == nil {
+		t.Fatalf("groups of 5 %+v, %v", journeys, next)
+	}
+	journeys, next = d.ListWaiting(5, true, next, 2)
+	if len(journeys) != 2 || journeys[0].Id != 5 || journeys[1].Id != 3 || next != nil {
+		t.Fatalf("last groups of 5 %+v, %v", journeys, next)
+	}
+	if journeys, _ := d.ListJourneys(JourneyFilter{Car: 1}, ListOrder{"id", false}, nil, 10); len(journeys) != 1 || journeys[0].Id != 1 {
+		t.Fatalf("ListJourneys() = %+v", journeys)
+	}
+}
+
+func Test_listHandlers(t *testing.T) {
+	d := NewDispatcher()
+	d.ResetCars([]Car{{1, 4}, {2, 5}, {3, 6}})
+	for groupId := uint(1); groupId <= 5; groupId++ {
+		d.RequestJourney(Group{groupId, 3})
+	}
+	handler := New("", d).Handler
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	tests := []struct {
+		name     string
+		path     string
+		status   int
+		expected string
+	}{
+		{"Journeys", "/v2/journeys?sort=-car&people=3&limit=10", http.StatusOK, `[{"id":4,"people":3,"status":"travelling","car":{"id":3,"seats":6,"free_seats":0}},{"id":3,"people":3,"status":"travelling","car":{"id":3,"seats":6,"free_seats":0}},{"id":2,"people":3,"status":"travelling","car":{"id":2,"seats":5,"free_seats":2}},{"id":1,"people":3,"status":"travelling","car":{"id":1,"seats":4,"free_seats":1}}]`},
+		{"Waiting", "/v2/waiting", http.StatusOK, `[{"id":5,"people":3,"status":"waiting","position":1,"size_position":1}]`},
+		{"InvalidSort", "/v2/cars?sort=people", http.StatusBadRequest, `invalid_query: sort must be one of id, seats, free_seats, with a "-" prefix to reverse it`},
+		{"InvalidLimit", "/v2/cars?limit=0", http.StatusBadRequest, "invalid_query: limit must be between 1 and 10000"},
+		{"InvalidFilter", "/v2/cars?min_free_seats=x", http.StatusBadRequest, "invalid_query: min_free_seats must be a positive int"},
+		{"InvalidStatus", "/v2/cars?status=broken", http.StatusBadRequest, `invalid_query: status must be "in_service", "paused" or "out_of_service"`},
+		{"InvalidCursor", "/v2/cars?cursor=x", http.StatusBadRequest, "invalid_cursor: the cursor is not valid"},
+		{"CursorOfOtherSort", "/v2/cars?sort=seats&cursor=" + encodeCursor("id", ListCursor{1, 1}), http.StatusBadRequest, "invalid_cursor: the cursor belongs to a listing sorted by id"},
+		{"WaitingNotAllowed", "/v2/waiting?sort=id", http.StatusBadRequest, `invalid_query: sort must be one of position, with a "-" prefix to reverse it`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get(tt.path)
+			if w.Code != tt.status || strings.TrimSpace(responseMessage(w)) != tt.expected {
+				t.Fatalf("(Expected) %d %s != %d %s (Returned)", tt.status, tt.expected, w.Code, responseMessage(w))
+			}
+		})
+	}
+
+	// the Link header and X-Next-Cursor give the same next page
+	w := get("/v2/cars?sort=-free_seats&limit=2")
+	page := []CarDetail{}
+	json.Unmarshal(w.Body.Bytes(), &page)
+	cursor := w.Header().Get(HeaderNextCursor)
+	link := "</v2/cars?cursor=" + cursor + "&limit=2&sort=-free_seats>; rel=\"next\""
+	if len(page) != 2 || page[0].Id != 2 || page[1].Id != 1 || cursor == "" || w.Header().Get("Link") != link {
+		t.Fatalf("first page %s, Link %s", w.Body.String(), w.Header().Get("Link"))
+	}
+	w = get("/v2/cars?sort=-free_seats&limit=2&cursor=" + cursor)
+	page = []CarDetail{}
+	json.Unmarshal(w.Body.Bytes(), &page)
+	if len(page) != 1 || page[0].Id != 3 || w.Header().Get(HeaderNextCursor) != "" || w.Header().Get("Link") != "" {
+		t.Fatalf("last page %s, Link %s", w.Body.String(), w.Header().Get("Link"))
+	}
+	// without a limit the cars come in pages of defaultListLimit too
+	fleet := []Car{}
+	for carId := uint(1); carId <= defaultListLimit+1; carId++ {
+		fleet = append(fleet, Car{carId, 4})
+	}
+	d.ResetCars(fleet)
+	w = get("/v2/cars")
+	page = []CarDetail{}
+	json.Unmarshal(w.Body.Bytes(), &page)
+	if len(page) != defaultListLimit || w.Header().Get(HeaderNextCursor) == "" {
+		t.Fatalf("(Expected) %d cars and a next page != %d %q (Returned)", defaultListLimit, len(page), w.Header().Get(HeaderNextCursor))
+	}
+}
+
+// A page of 100 cars out of the 10^5 of the stress test, sorted by free seats
+func BenchmarkDispatcher_ListCars(b *testing.B) {
+	d := NewDispatcher()
+	fleet := make([]Car, 0, 100000)
+	for carId := uint(1); carId <= 100000; carId++ {
+		fleet = append(fleet, Car{carId, 4 + carId%3})
+	}
+	d.ResetCars(fleet)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.ListCars(CarFilter{MinFreeSeats: 5}, ListOrder{"free_seats", true}, &ListCursor{6, uint(i % 100000)}, 100)
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The metrics are written by hand in the Prometheus text format, so the
+// service keeps no dependencies. Every series is created on its first use
+// and the labels come from a bounded set, the routes of the mux, the known
+// methods and the status codes
+
+const ContentTypeMetrics = "text/plain; version=0.0.4; charset=utf-8"
+
+// latencyBuckets are the upper bounds in seconds of the latency histograms
+var latencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+var knownMethods = map[string]struct{}{
+	"GET": {}, "HEAD": {}, "POST": {}, "PUT": {}, "PATCH": {}, "DELETE": {}, "OPTIONS": {},
+}
+
+type requestLabels struct {
+	route  string
+	method string
+	status int
+}
+
+type latencyHistogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// httpMetrics counts the requests and their latency by route, method and
+// status
+type httpMetrics struct {
+	mu     sync.Mutex
+	series map[requestLabels]*latencyHistogram
+}
+
+func newHTTPMetrics() *httpMetrics {
+	return &httpMetrics{series: make(map[requestLabels]*latencyHistogram)}
+}
+
+// instrument measures the requests served by next, the route is the pattern
+// of the mux that matches the request
+func (m *httpMetrics) instrument(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		_, route := mux.Handler(r)
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		method := r.Method
+		if _, ok := knownMethods[method]; !ok {
+			method = "OTHER"
+		}
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		m.observe(requestLabels{route, method, status}, time.Since(start))
+	})
+}
+
+func (m *httpMetrics) observe(labels requestLabels, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	histogram := m.series[labels]
+	if histogram == nil {
+		histogram = &latencyHistogram{buckets: make([]uint64, len(latencyBuckets))}
+		m.series[labels] = histogram
+	}
+	seconds := elapsed.Seconds()
+	for idx, bound := range latencyBuckets {
+		if seconds <= bound {
+			histogram.buckets[idx]++
+		}
+	}
+	histogram.count++
+	histogram.sum += seconds
+}
+
+func (m *httpMetrics) write(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]requestLabels, 0, len(m.series))
+	for labels := range m.series {
+		keys = append(keys, labels)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].status < keys[j].status
+	})
+	writeMetricHeader(w, "carpooling_http_requests_total", "counter", "Requests served by route, method and status.")
+	for _, labels := range keys {
+		fmt.Fprintf(w, "carpooling_http_requests_total{%s} %d\n", labels, m.series[labels].count)
+	}
+	writeMetricHeader(w, "carpooling_http_request_duration_seconds", "histogram", "Latency of the requests by route, method and status.")
+	for _, labels := range keys {
+		histogram := m.series[labels]
+		for idx, bound := range latencyBuckets {
+			fmt.Fprintf(w, "carpooling_http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, formatFloat(bound), histogram.buckets[idx])
+		}
+		fmt.Fprintf(w, "carpooling_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, histogram.count)
+		fmt.Fprintf(w, "carpooling_http_request_duration_seconds_sum{%s} %s\n", labels, formatFloat(histogram.sum))
+		fmt.Fprintf(w, "carpooling_http_request_duration_seconds_count{%s} %d\n", labels, histogram.count)
+	}
+}
+
+func (labels requestLabels) String() string {
+	return fmt.Sprintf("route=%s,method=%s,status=\"%d\"", strconv.Quote(labels.route), strconv.Quote(labels.method), labels.status)
+}
+
+// writeDispatcherMetrics writes the gauges of the state of the dispatcher and
+// the counters of the assignments
+func writeDispatcherMetrics(w *bufio.Writer, stats DispatcherStats) {
+	writeMetricHeader(w, "carpooling_cars", "gauge", "Cars in service by free seats.")
+	for seats, cars := range stats.CarsByFreeSeats {
+		fmt.Fprintf(w, "carpooling_cars{free_seats=\"%d\"} %d\n", seats, cars)
+	}
+	writeMetricHeader(w, "carpooling_journeys", "gauge", "Groups travelling in a car.")
+	fmt.Fprintf(w, "carpooling_journeys %d\n", stats.Journeys)
+	writeMetricHeader(w, "carpooling_waiting_groups", "gauge", "Groups in the waiting list by people.")
+	for people := MinPeople; people <= MaxPeople; people++ {
+		fmt.Fprintf(w, "carpooling_waiting_groups{people=\"%d\"} %d\n", people, stats.WaitingByPeople[people])
+	}
+	writeMetricHeader(w, "carpooling_assignments_total", "counter", "Groups seated in a car, on arrival or from the waiting list.")
+	fmt.Fprintf(w, "carpooling_assignments_total{source=\"arrival\"} %d\n", stats.AssignedOnArrival)
+	fmt.Fprintf(w, "carpooling_assignments_total{source=\"waiting\"} %d\n", stats.AssignedFromWaiting)
+}
+
+func writeMetricHeader(w *bufio.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	handler := New("", NewDispatcher()).Handler
+	send := func(method, path, ctype, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", ctype)
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	send("PUT", "/cars", ContentTypeJSON, `[ { "id": 1, "seats": 4 }, { "id": 2, "seats": 6 } ]`)
+	send("POST", "/journey", ContentTypeJSON, `{ "id": 1, "people": 4 }`)
+	send("POST", "/journey", ContentTypeJSON, `{ "id": 2, "people": 5 }`)
+	send("POST", "/journey", ContentTypeJSON, `{ "id": 3, "people": 3 }`)
+	send("POST", "/journey", ContentTypeJSON, `{ "id": 4, "people": 2 }`)
+	send("POST", "/dropoff", ContentTypeURLENCODED, "ID=1")
+	send("GET", "/cars/7", "", "")
+	send("GET", "/cars/8", "", "")
+	send("BREW", "/status", "", "")
+
+	w := send("GET", "/metrics", "", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != ContentTypeMetrics {
+		t.Fatalf("(Expected) %d %s != %d %s (Returned)", http.StatusOK, ContentTypeMetrics, w.Code, w.Header().Get("Content-Type"))
+	}
+	expected := []string{
+		`# TYPE carpooling_http_requests_total counter`,
+		`carpooling_http_requests_total{route="/journey",method="POST",status="200"} 2`,
+		`carpooling_http_requests_total{route="/journey",method="POST",status="202"} 2`,
+		`carpooling_http_requests_total{route="/cars/",method="GET",status="404"} 2`,
+		`carpooling_http_requests_total{route="/status",method="OTHER",status="405"} 1`,
+		`# TYPE carpooling_http_request_duration_seconds histogram`,
+		`carpooling_http_request_duration_seconds_bucket{route="/dropoff",method="POST",status="200",le="+Inf"} 1`,
+		`carpooling_http_request_duration_seconds_count{route="/cars/",method="GET",status="404"} 2`,
+		// car 1 took the group of 3 after the dropoff and car 2 has the group
+		// of 5, the group of 2 does not fit in any of them
+		`carpooling_cars{free_seats="1"} 2`,
+		`carpooling_cars{free_seats="0"} 0`,
+		`carpooling_cars{free_seats="4"} 0`,
+		`carpooling_journeys 2`,
+		`carpooling_waiting_groups{people="2"} 1`,
+		`carpooling_waiting_groups{people="5"} 0`,
+		`carpooling_assignments_total{source="arrival"} 2`,
+		`carpooling_assignments_total{source="waiting"} 1`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Fatalf("%s is missing in\n%s", line, w.Body.String())
+		}
+	}
+}
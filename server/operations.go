@@ -0,0 +1,182 @@
+package server
+
+import "time"
+
+// ChangeKind is the kind of a single modification of the dispatcher state
+type ChangeKind string
+
+const (
+	// ChangeFleetReset removes every car, journey and waiting group
+	ChangeFleetReset ChangeKind = "fleet_reset"
+	// ChangeCarAdded puts a new empty car in service
+	ChangeCarAdded ChangeKind = "car_added"
+	// ChangeCarUpdated sets the seats and the status of a car
+	ChangeCarUpdated ChangeKind = "car_updated"
+	// ChangeCarRemoved deletes an empty car
+	ChangeCarRemoved ChangeKind = "car_removed"
+	// ChangeGroupQueued adds a group to the waiting list, at the start if Front
+	ChangeGroupQueued ChangeKind = "group_queued"
+	// ChangeGroupAssigned seats a new or waiting group in a car, Waited is set
+	// for the waiting ones
+	ChangeGroupAssigned ChangeKind = "group_assigned"
+	// ChangeGroupUnseated takes a group out of its car, it is queued next
+	ChangeGroupUnseated ChangeKind = "group_unseated"
+	// ChangeGroupDroppedOff unregisters a group, with the car it was in or 0
+	// and the free seats the car is left with
+	ChangeGroupDroppedOff ChangeKind = "group_dropped_off"
+)
+
+// Change is a single modification of the dispatcher state. Applying the
+// changes of every operation in order rebuilds the state without running the
+// car selection again
+type Change struct {
+	Kind   ChangeKind `json:"kind"`
+	Group  uint       `json:"group,omitempty"`
+	People uint       `json:"people,omitempty"`
+	Car    uint       `json:"car,omitempty"`
+	Seats  uint       `json:"seats,omitempty"`
+	Status CarStatus  `json:"status,omitempty"`
+	Front  bool       `json:"front,omitempty"`
+	Waited bool       `json:"waited,omitempty"`
+}
+
+// Operation is an accepted request that changed the state, such as a
+// journey or a dropoff, with every change it caused in order
+type Operation struct {
+	Seq     uint64    `json:"seq"`
+	Time    time.Time `json:"time"`
+	Name    string    `json:"op"`
+	Changes []Change  `json:"changes"`
+}
+
+// Observer is told about every operation that changed the state, in order.
+// It is called while the dispatcher is locked, so it must be fast and it
+// must not call the dispatcher
+type Observer func(op Operation)
+
+// WithObserver adds an observer of the operations
+func WithObserver(observer Observer) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.observers = append(d.observers, observer)
+	}
+}
+
+// addObserver adds an observer to a dispatcher that is already in use, such
+// as the event stream of a server. The returned function removes it
+func (d *Dispatcher) addObserver(observer Observer) (remove func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	idx := len(d.observers)
+	d.observers = append(d.observers, observer)
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		// the slot is emptied so the indexes of the other observers hold
+		d.observers[idx] = nil
+		for len(d.observers) > 0 && d.observers[len(d.observers)-1] == nil {
+			d.observers = d.observers[:len(d.observers)-1]
+		}
+	}
+}
+
+func (d *Dispatcher) record(change Change) {
+	d.pending = append(d.pending, change)
+}
+
+// commit numbers the changes recorded by the current operation and gives them
+// to the observers, it is deferred by every method that changes the state
+func (d *Dispatcher) commit(name string) {
+	if len(d.pending) == 0 {
+		return
+	}
+	d.seq++
+	op := Operation{Seq: d.seq, Time: d.now(), Name: name, Changes: d.pending}
+	d.writeToStore(d.seq, d.pending)
+	d.pending = nil
+	for _, observer := range d.observers {
+		if observer != nil {
+			observer(op)
+		}
+	}
+}
+
+// LastOperation returns the sequence number of the last operation applied
+func (d *Dispatcher) LastOperation() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.seq
+}
+
+// Apply replays an operation recorded by an observer. Operations already
+// applied are ignored, so a log can be replayed on top of a snapshot. The
+// observers are not told about replayed operations
+func (d *Dispatcher) Apply(op Operation) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if op.Seq <= d.seq {
+		return
+	}
+	for _, change := range op.Changes {
+		d.applyChange(change, op.Time)
+	}
+	if loadsFleet(op) {
+		d.markFleetLoaded()
+	}
+	// the records are read from the store, so a replica writes them too
+	d.writeToStore(op.Seq, op.Changes)
+	d.pending = nil
+	d.seq = op.Seq
+}
+
+// loadsFleet tells if the operation loaded a fleet, as the methods that
+// change the fleet do after they succeed. A PUT /cars rejected for a repeated
+// id is the only one to end with a reset after the cars it added
+func loadsFleet(op Operation) bool {
+	switch op.Name {
+	case "reset_cars":
+		count := len(op.Changes)
+		return count == 1 || (count > 1 && op.Changes[count-1].Kind != ChangeFleetReset)
+	case "reconcile_cars", "add_car":
+		return true
+	}
+	return false
+}
+
+func (d *Dispatcher) applyChange(change Change, at time.Time) {
+	switch change.Kind {
+	case ChangeFleetReset:
+		d.cleanJourneysAndCars()
+	case ChangeCarAdded:
+		d.addCar(Car{change.Car, change.Seats})
+	case ChangeCarUpdated:
+		if change.Seats != d.carsSize[change.Car] {
+			d.resizeCar(change.Car, change.Seats)
+		}
+		d.unindexCar(change.Car, d.carsMap[change.Car])
+		d.carsStatus[change.Car] = change.Status
+		d.indexCar(change.Car, d.carsMap[change.Car])
+	case ChangeCarRemoved:
+		d.removeCar(change.Car)
+	case ChangeGroupQueued:
+		d.groupsMap[change.Group] = change.People
+		d.journeysMap[change.Group] = 0
+		if change.Front {
+			d.waitingGroups.pushFront(change.Group, change.People, at)
+		} else {
+			d.waitingGroups.pushBack(change.Group, change.People, at)
+		}
+	case ChangeGroupAssigned:
+		d.skipFirstWaitingGroup(change.Group)
+		d.waitingGroups.remove(change.Group)
+		d.groupsMap[change.Group] = change.People
+		d.assignCar(change.Car, Group{change.Group, change.People})
+	case ChangeGroupUnseated:
+		d.unseatGroup(change.Car, change.Group)
+	case ChangeGroupDroppedOff:
+		if d.journeysMap[change.Group] != 0 {
+			d.removeGroup(change.Group)
+		} else {
+			d.deleteGroupWithoutCar(change.Group)
+		}
+	}
+}
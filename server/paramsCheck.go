@@ -1,15 +1,16 @@
 package server
 
 import (
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
 func isBodyEmpty(w http.ResponseWriter, r *http.Request) bool {
 	if r.Body == http.NoBody {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Body Required")
+		writeProblem(w, http.StatusBadRequest, ProblemBodyRequired, "Body Required")
 		return true
 	}
 	return false
@@ -19,8 +20,36 @@ func isContentJson(w http.ResponseWriter, r *http.Request) bool {
 	if r.Header.Get("Content-Type") == ContentTypeJSON {
 		return true
 	}
-	w.WriteHeader(http.StatusBadRequest)
-	fmt.Fprintf(w, "Content-Type must be \"%s\"", ContentTypeJSON)
+	writeProblem(w, http.StatusBadRequest, ProblemUnsupportedContent, fmt.Sprintf("Content-Type must be \"%s\"", ContentTypeJSON))
+	return false
+}
+
+// acceptsJSON tells if the Accept header lists application/json with a
+// quality over 0. The wildcards do not count, the clients of the challenge
+// API send them and expect an empty body
+func acceptsJSON(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(header, ",") {
+			params := strings.Split(mediaRange, ";")
+			if !strings.EqualFold(strings.TrimSpace(params[0]), ContentTypeJSON) {
+				continue
+			}
+			quality := 1.0
+			for _, param := range params[1:] {
+				name, value, _ := strings.Cut(param, "=")
+				if strings.EqualFold(strings.TrimSpace(name), "q") {
+					if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+						quality = q
+					} else {
+						quality = 0
+					}
+				}
+			}
+			if quality > 0 {
+				return true
+			}
+		}
+	}
 	return false
 }
 
@@ -28,45 +57,183 @@ func isContentURLENCODED(w http.ResponseWriter, r *http.Request) bool {
 	if r.Header.Get("Content-Type") == ContentTypeURLENCODED {
 		return true
 	}
-	w.WriteHeader(http.StatusBadRequest)
-	fmt.Fprintf(w, "Content-Type must be \"%s\"", ContentTypeURLENCODED)
+	writeProblem(w, http.StatusBadRequest, ProblemUnsupportedContent, fmt.Sprintf("Content-Type must be \"%s\"", ContentTypeURLENCODED))
 	return false
 }
 
-func isSameMethod(w http.ResponseWriter, r *http.Request, m string) bool {
-	if r.Method == m {
+func isValidCarsMode(w http.ResponseWriter, r *http.Request) bool {
+	mode := r.URL.Query().Get("mode")
+	if mode == "" || mode == CarsModeReconcile {
 		return true
 	}
-	w.WriteHeader(http.StatusMethodNotAllowed)
-	fmt.Fprintf(w, "Method not allowed")
+	writeProblem(w, http.StatusBadRequest, ProblemInvalidCarsMode, fmt.Sprintf("Invalid mode, the only valid mode is \"%s\"", CarsModeReconcile))
+	return false
+}
+
+func isSameMethod(w http.ResponseWriter, r *http.Request, m string) bool {
+	return isOneOfMethods(w, r, m)
+}
+
+func isOneOfMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeProblem(w, http.StatusMethodNotAllowed, ProblemMethodNotAllowed, "Method not allowed")
 	return false
 }
 
+// carIdFromPath reads the X of /cars/X
+func carIdFromPath(w http.ResponseWriter, r *http.Request, prefix string) (uint, bool) {
+	carId, ok := idFromPath(w, r, prefix, "", ProblemInvalidCarId, "Car ID must be a positive int")
+	logCar(r, carId)
+	return carId, ok
+}
+
+// groupIdFromPath reads the X of /v2/groups/X
+func groupIdFromPath(w http.ResponseWriter, r *http.Request, prefix, suffix string) (uint, bool) {
+	groupId, ok := idFromPath(w, r, prefix, suffix, ProblemInvalidGroupId, "Group ID must be a positive int")
+	logGroup(r, groupId)
+	return groupId, ok
+}
+
+func idFromPath(w http.ResponseWriter, r *http.Request, prefix, suffix string, code ProblemCode, detail string) (uint, bool) {
+	val, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, prefix), suffix), 10, 0)
+	if err != nil || val == 0 {
+		writeProblem(w, http.StatusBadRequest, code, detail)
+		return 0, false
+	}
+	return uint(val), true
+}
+
+// isValidCarUpdate checks the fields that are only required by some methods,
+// a new car needs seats and it starts in service
+func isValidCarUpdate(method string, update CarUpdate) error {
+	if method == "POST" && update.Seats == 0 {
+		return fmt.Errorf("seats is required")
+	}
+	if method == "POST" && update.Status != "" && update.Status != CarInService {
+		return fmt.Errorf("a new car must be \"%s\"", CarInService)
+	}
+	return nil
+}
+
 func urlEncReqHasValidSettings(w http.ResponseWriter, r *http.Request) bool {
 	if !isSameMethod(w, r, "POST") || isBodyEmpty(w, r) || !isContentURLENCODED(w, r) {
 		return false
 	}
 	r.ParseForm()
 	if len(r.PostForm) != 1 {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Multiple values detected, the only valid input is 1 \"ID=X\"")
+		writeProblem(w, http.StatusBadRequest, ProblemInvalidForm, "Multiple values detected, the only valid input is 1 \"ID=X\"")
 		return false
 	}
 	if _, ok := r.PostForm["ID"]; !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Invalid key detected, the only valid input is 1 \"ID=X\"")
+		writeProblem(w, http.StatusBadRequest, ProblemInvalidForm, "Invalid key detected, the only valid input is 1 \"ID=X\"")
 		return false
 	}
 	if len(r.PostForm["ID"]) != 1 {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Only one ID is allowed, and it must be an int")
+		writeProblem(w, http.StatusBadRequest, ProblemInvalidForm, "Only one ID is allowed, and it must be an int")
 		return false
 	}
 	val, err := strconv.Atoi(r.PostForm["ID"][0])
 	if err != nil || val < 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "ID must be a positive int")
+		writeProblem(w, http.StatusBadRequest, ProblemInvalidGroupId, "ID must be a positive int")
 		return false
 	}
 	return true
 }
+
+const defaultListLimit = 100
+const maxListLimit = 10000
+
+// HeaderNextCursor is the cursor of the next page of a listing
+const HeaderNextCursor = "X-Next-Cursor"
+
+// listQuery is the order and the page of a listing
+type listQuery struct {
+	sort  string
+	order ListOrder
+	after *ListCursor
+	limit int
+}
+
+// listQueryFromURL reads the sort, cursor and limit parameters of a listing.
+// sort is one of sortKeys, the first one by default, with a "-" prefix for
+// the descending order, and the page has defaultListLimit rows without a
+// limit parameter
+func listQueryFromURL(w http.ResponseWriter, r *http.Request, sortKeys []string) (listQuery, bool) {
+	query := r.URL.Query()
+	list := listQuery{sort: query.Get("sort"), limit: defaultListLimit}
+	if list.sort == "" {
+		list.sort = sortKeys[0]
+	}
+	list.order = ListOrder{Key: strings.TrimPrefix(list.sort, "-"), Desc: strings.HasPrefix(list.sort, "-")}
+	valid := false
+	for _, key := range sortKeys {
+		valid = valid || key == list.order.Key
+	}
+	if !valid {
+		writeProblem(w, http.StatusBadRequest, ProblemInvalidQuery, fmt.Sprintf("sort must be one of %s, with a \"-\" prefix to reverse it", strings.Join(sortKeys, ", ")))
+		return list, false
+	}
+	if limit := query.Get("limit"); limit != "" {
+		val, err := strconv.Atoi(limit)
+		if err != nil || val < 1 || val > maxListLimit {
+			writeProblem(w, http.StatusBadRequest, ProblemInvalidQuery, fmt.Sprintf("limit must be between 1 and %d", maxListLimit))
+			return list, false
+		}
+		list.limit = val
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		after, err := decodeCursor(list.sort, cursor)
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, ProblemInvalidCursor, err.Error())
+			return list, false
+		}
+		list.after = &after
+	}
+	return list, true
+}
+
+// uintFromQuery reads an optional filter, it is 0 when it is missing
+func uintFromQuery(w http.ResponseWriter, r *http.Request, name string) (uint, bool) {
+	param := r.URL.Query().Get(name)
+	if param == "" {
+		return 0, true
+	}
+	val, err := strconv.ParseUint(param, 10, 0)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, ProblemInvalidQuery, fmt.Sprintf("%s must be a positive int", name))
+		return 0, false
+	}
+	return uint(val), true
+}
+
+// The cursors are opaque to the clients, they keep the sort of the listing so
+// a cursor is not used with another one
+func encodeCursor(sort string, cursor ListCursor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%d:%d", sort, cursor.Key, cursor.Id)))
+}
+
+func decodeCursor(sort string, encoded string) (ListCursor, error) {
+	cursor := ListCursor{}
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor, fmt.Errorf("the cursor is not valid")
+	}
+	parts := strings.Split(string(decoded), ":")
+	if len(parts) != 3 {
+		return cursor, fmt.Errorf("the cursor is not valid")
+	}
+	if parts[0] != sort {
+		return cursor, fmt.Errorf("the cursor belongs to a listing sorted by %s", parts[0])
+	}
+	key, keyErr := strconv.ParseInt(parts[1], 10, 64)
+	id, idErr := strconv.ParseUint(parts[2], 10, 0)
+	if keyErr != nil || idErr != nil {
+		return cursor, fmt.Errorf("the cursor is not valid")
+	}
+	return ListCursor{Key: key, Id: uint(id)}, nil
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const ContentTypeProblemJSON = "application/problem+json"
+
+// ProblemCode is the stable identifier of an error, clients should use it
+// instead of the title or the detail
+type ProblemCode string
+
+const (
+	ProblemNotFound            ProblemCode = "not_found"
+	ProblemMethodNotAllowed    ProblemCode = "method_not_allowed"
+	ProblemBodyRequired        ProblemCode = "body_required"
+	ProblemUnsupportedContent  ProblemCode = "unsupported_content_type"
+	ProblemInvalidBody         ProblemCode = "invalid_body"
+	ProblemInvalidCarsMode     ProblemCode = "invalid_cars_mode"
+	ProblemInvalidForm         ProblemCode = "invalid_form"
+	ProblemInvalidGroupId      ProblemCode = "invalid_group_id"
+	ProblemInvalidCarId        ProblemCode = "invalid_car_id"
+	ProblemCarIdRepeated       ProblemCode = "car_id_repeated"
+	ProblemCarNotFound         ProblemCode = "car_not_found"
+	ProblemCarStatusTransition ProblemCode = "car_status_transition"
+	ProblemGroupIdRepeated     ProblemCode = "group_id_repeated"
+	ProblemGroupNotFound       ProblemCode = "group_not_found"
+	ProblemInvalidQuery        ProblemCode = "invalid_query"
+	ProblemInvalidCursor       ProblemCode = "invalid_cursor"
+	ProblemNotReady            ProblemCode = "not_ready"
+	ProblemUpgradeRequired     ProblemCode = "upgrade_required"
+	ProblemOriginNotAllowed    ProblemCode = "origin_not_allowed"
+	ProblemInternalError       ProblemCode = "internal_error"
+)
+
+var problemTitles = map[ProblemCode]string{
+	ProblemNotFound:            "Not found",
+	ProblemMethodNotAllowed:    "Method not allowed",
+	ProblemBodyRequired:        "Body required",
+	ProblemUnsupportedContent:  "Unsupported Content-Type",
+	ProblemInvalidBody:         "Bad Input(JSON) format",
+	ProblemInvalidCarsMode:     "Invalid mode",
+	ProblemInvalidForm:         "Bad Input(form) format",
+	ProblemInvalidGroupId:      "Invalid group ID",
+	ProblemInvalidCarId:        "Invalid car ID",
+	ProblemCarIdRepeated:       "Car ID repeated",
+	ProblemCarNotFound:         "Car not found",
+	ProblemCarStatusTransition: "Invalid car status transition",
+	ProblemGroupIdRepeated:     "Group ID repeated",
+	ProblemGroupNotFound:       "Group not found",
+	ProblemInvalidQuery:        "Invalid query parameter",
+	ProblemInvalidCursor:       "Invalid cursor",
+	ProblemNotReady:            "Service not ready",
+	ProblemUpgradeRequired:     "WebSocket upgrade required",
+	ProblemOriginNotAllowed:    "Origin not allowed",
+	ProblemInternalError:       "Internal error",
+}
+
+// dispatcherProblems gives the code of the errors of the dispatcher
+var dispatcherProblems = map[error]ProblemCode{
+	ErrCarIdRepeated:       ProblemCarIdRepeated,
+	ErrCarNotFound:         ProblemCarNotFound,
+	ErrCarStatusTransition: ProblemCarStatusTransition,
+	ErrGroupIdRepeated:     ProblemGroupIdRepeated,
+	ErrGroupNotFound:       ProblemGroupNotFound,
+}
+
+// Problem is the body of every error response, as described by RFC 7807
+type Problem struct {
+	Type   string      `json:"type"`
+	Title  string      `json:"title"`
+	Status int         `json:"status"`
+	Detail string      `json:"detail,omitempty"`
+	Code   ProblemCode `json:"code"`
+}
+
+// writeProblem writes the error response with the given status and code
+func writeProblem(w http.ResponseWriter, status int, code ProblemCode, detail string) {
+	w.Header().Set("Content-Type", ContentTypeProblemJSON)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Problem{
+		Type:   "/problems/" + strings.ReplaceAll(string(code), "_", "-"),
+		Title:  problemTitles[code],
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	})
+}
+
+// writeError writes an error of the dispatcher, or of the validation of the
+// body when it is not one of them
+func writeError(w http.ResponseWriter, status int, err error) {
+	code, ok := dispatcherProblems[err]
+	if !ok && status >= http.StatusInternalServerError {
+		code = ProblemInternalError
+	} else if !ok {
+		code = ProblemInvalidBody
+	}
+	writeProblem(w, status, code, err.Error())
+}
+
+// errorStatus is the status of an error of the dispatcher when it is not
+// caused by the body of the request
+func errorStatus(err error) int {
+	switch err {
+	case ErrCarNotFound, ErrGroupNotFound:
+		return http.StatusNotFound
+	case ErrCarIdRepeated, ErrCarStatusTransition:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
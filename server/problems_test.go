@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProblems(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		ctype   string
+		body    string
+		problem Problem
+		allow   string
+	}{
+		{"UnknownPath", "GET", "/cars/3/seats", "", "", Problem{"/problems/invalid-car-id", "Invalid car ID", 400, "Car ID must be a positive int", ProblemInvalidCarId}, ""},
+		{"UnknownRoute", "GET", "/groups", "", "", Problem{"/problems/not-found", "Not found", 404, "/groups does not exist", ProblemNotFound}, ""},
+		{"MethodNotAllowed", "GET", "/dropoff", "", "", Problem{"/problems/method-not-allowed", "Method not allowed", 405, "Method not allowed", ProblemMethodNotAllowed}, "POST"},
+		{"CarMethodNotAllowed", "PUT", "/cars/1", "", "", Problem{"/problems/method-not-allowed", "Method not allowed", 405, "Method not allowed", ProblemMethodNotAllowed}, "GET, POST, PATCH, DELETE"},
+		{"InvalidBody", "POST", "/journey", ContentTypeJSON, `{ "id": 1 }`, Problem{"/problems/invalid-body", "Bad Input(JSON) format", 400, "id and people are required for all groups", ProblemInvalidBody}, ""},
+		{"GroupNotFound", "POST", "/locate", ContentTypeURLENCODED, "ID=9", Problem{"/problems/group-not-found", "Group not found", 404, "group not found", ProblemGroupNotFound}, ""},
+		{"GroupIdRepeated", "POST", "/journey", ContentTypeJSON, `{ "id": 1, "people": 2 }`, Problem{"/problems/group-id-repeated", "Group ID repeated", 500, "group Id already exists", ProblemGroupIdRepeated}, ""},
+	}
+	handler := New("", NewDispatcher()).Handler
+	for _, args := range []reqArgs{
+		{`[ { "id": 1, "seats": 4 } ]`, "PUT", "/cars", nil, ContentTypeJSON},
+		{`{ "id": 1, "people": 2 }`, "POST", "/journey", nil, ContentTypeJSON},
+	} {
+		req := httptest.NewRequest(args.method, args.path, strings.NewReader(args.body))
+		req.Header.Set("Content-Type", args.ctype)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.body == "" {
+				req = httptest.NewRequest(tt.method, tt.path, nil)
+			}
+			req.Header.Set("Content-Type", tt.ctype)
+			handler.ServeHTTP(w, req)
+			if w.Header().Get("Content-Type") != ContentTypeProblemJSON {
+				t.Fatalf("(Expected) %s != %s (Returned)", ContentTypeProblemJSON, w.Header().Get("Content-Type"))
+			}
+			problem := Problem{}
+			if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+				t.Fatalf("the body is not a problem: %v", err)
+			}
+			if problem != tt.problem || w.Code != tt.problem.Status {
+				t.Fatalf("(Expected) %v != %v (Returned)", tt.problem, problem)
+			}
+			if w.Header().Get("Allow") != tt.allow {
+				t.Fatalf("(Expected) %s != %s (Returned)", tt.allow, w.Header().Get("Allow"))
+			}
+		})
+	}
+}
+
+func TestJourneyResponse(t *testing.T) {
+	h := &handlers{dispatcher: NewDispatcher()}
+	simulateTestCall(t, reqArgs{`[ { "id": 1, "seats": 4 } ]`, "PUT", "/cars", h.carsHandler, ContentTypeJSON})
+	tests := []struct {
+		body     string
+		accept   string
+		status   int
+		expected string
+	}{
+		{`{ "id": 1, "people": 3 }`, ContentTypeJSON, http.StatusOK, `{"id":1,"people":3,"status":"travelling","car":{"id":1,"seats":4,"free_seats":1}}`},
+		{`{ "id": 2, "people": 3 }`, "", http.StatusAccepted, ""},
+		{`{ "id": 3, "people": 2 }`, "*/*", http.StatusAccepted, ""},
+		{`{ "id": 4, "people": 6 }`, "text/html, Application/JSON; q=0.5", http.StatusAccepted, `{"id":4,"people":6,"status":"waiting","position":3,"size_position":1}`},
+		{`{ "id": 5, "people": 5 }`, "application/json;q=0", http.StatusAccepted, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/journey", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", ContentTypeJSON)
+		req.Header.Set("Accept", tt.accept)
+		h.journeyHandler(w, req)
+		if w.Code != tt.status || strings.TrimSpace(w.Body.String()) != tt.expected {
+			t.Fatalf("(Expected) %d %s != %d %s (Returned)", tt.status, tt.expected, w.Code, w.Body.String())
+		}
+		if ctype := w.Header().Get("Content-Type"); tt.expected != "" && ctype != ContentTypeJSON {
+			t.Fatalf("(Expected) %s != %s (Returned)", ContentTypeJSON, ctype)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+// fenwick is a binary indexed tree of counts that grows one slot at a time,
+// slots are 1-based and tree[0] is not used
+type fenwick struct {
+	tree []int
+}
+
+// grow appends an empty slot and returns its index
+func (f *fenwick) grow() int {
+	if len(f.tree) == 0 {
+		f.tree = []int{0}
+	}
+	idx := len(f.tree)
+	// the new node covers the slots (idx-lowbit(idx), idx], all of them
+	// already known but the new one
+	f.tree = append(f.tree, f.prefix(idx-1)-f.prefix(idx-idx&-idx))
+	return idx
+}
+
+func (f *fenwick) add(idx, delta int) {
+	for ; idx < len(f.tree); idx += idx & -idx {
+		f.tree[idx] += delta
+	}
+}
+
+// prefix is the sum of the slots 1..idx
+func (f *fenwick) prefix(idx int) int {
+	sum := 0
+	for ; idx > 0; idx -= idx & -idx {
+		sum += f.tree[idx]
+	}
+	return sum
+}
+
+// fill makes a tree of count slots that are all 1, in O(n)
+func (f *fenwick) fill(count int) {
+	f.tree = make([]int, count+1)
+	for idx := 1; idx <= count; idx++ {
+		f.tree[idx] = idx & -idx
+	}
+}
+
+// minRankSlots is the number of slots left by the groups that left the queue
+// that is always kept before renumbering the keys
+const minRankSlots = 64
+
+// rankIndex gives the rank of a group in a waiting queue in O(log n). Every
+// group gets a key, the groups pushed to the back get 0, 1, 2... and the ones
+// pushed to the front get -1, -2... so the order of the keys is the order of
+// the queue. The keys are not reused, the queue renumbers its groups with
+// renumber once most of the slots belong to groups that left
+type rankIndex struct {
+	front, back fenwick
+	count       int
+}
+
+// pushBack returns the key of a group added at the end of the queue
+func (x *rankIndex) pushBack() int64 {
+	idx := x.back.grow()
+	x.back.add(idx, 1)
+	x.count++
+	return int64(idx - 1)
+}
+
+// pushFront returns the key of a group added at the start of the queue
+func (x *rankIndex) pushFront() int64 {
+	idx := x.front.grow()
+	x.front.add(idx, 1)
+	x.count++
+	return -int64(idx)
+}
+
+func (x *rankIndex) remove(key int64) {
+	if key >= 0 {
+		x.back.add(int(key)+1, -1)
+	} else {
+		x.front.add(int(-key), -1)
+	}
+	x.count--
+	if x.count == 0 {
+		*x = rankIndex{}
+	}
+}
+
+// sparse tells if most of the slots belong to groups that left
+func (x *rankIndex) sparse() bool {
+	return len(x.front.tree)+len(x.back.tree) > 2*x.count+minRankSlots
+}
+
+// renumber forgets every key, the caller gives the keys 0, 1, 2... to the
+// groups of the queue in their order
+func (x *rankIndex) renumber() {
+	x.front = fenwick{}
+	x.back.fill(x.count)
+}
+
+// before counts the groups in the queue with a lower key
+func (x *rankIndex) before(key int64) int {
+	inFront := x.front.prefix(len(x.front.tree) - 1)
+	if key >= 0 {
+		return inFront + x.back.prefix(int(key))
+	}
+	return inFront - x.front.prefix(int(-key))
+}
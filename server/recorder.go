@@ -0,0 +1,365 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRecordedBody is the size of the longest body written to a capture, the
+// handlers always get the whole body
+const maxRecordedBody = 1 << 20
+
+// RecorderConfig configures a Recorder
+type RecorderConfig struct {
+	// Path is the capture being written, the rotated ones are Path.1,
+	// Path.2... with Path.1 the newest
+	Path string
+	// MaxBytes is the size that rotates the capture, 0 never rotates it
+	MaxBytes int64
+	// MaxFiles is the number of rotated captures kept
+	MaxFiles int
+	// Sample is the fraction of the requests recorded, 1 records them all and
+	// 0 none
+	Sample float64
+	// Seed of the sampling, 0 uses the current time
+	Seed int64
+	// Redact lists the json fields and form keys whose values are replaced by
+	// pseudonyms. The same value always gets the same pseudonym, so the
+	// capture can still be replayed. With "id" the ids in the paths are
+	// replaced too
+	Redact []string
+	// RedactKey is the secret of the pseudonyms, empty uses a random one
+	RedactKey string
+}
+
+// Recorder writes the requests served by the routes to a capture that the
+// replay command reads, see CapturedRequest. Its Middleware is given to New
+type Recorder struct {
+	mu     sync.Mutex
+	config RecorderConfig
+	file   *os.File
+	size   int64
+	random *mathrand.Rand
+	redact map[string]struct{}
+	key    []byte
+	// pseudonyms and originals map the redacted values to their pseudonyms
+	// and back, a value that collides with another one is hashed again
+	pseudonyms map[string]string
+	originals  map[string]string
+}
+
+// NewRecorder opens the capture at config.Path, appending to it if it exists
+func NewRecorder(config RecorderConfig) (*Recorder, error) {
+	if config.Sample < 0 || config.Sample > 1 {
+		return nil, fmt.Errorf("the sample must be between 0 and 1")
+	}
+	rec := &Recorder{
+		config:     config,
+		redact:     map[string]struct{}{},
+		key:        []byte(config.RedactKey),
+		pseudonyms: map[string]string{},
+		originals:  map[string]string{},
+	}
+	if config.Seed == 0 {
+		config.Seed = time.Now().UnixNano()
+	}
+	rec.random = mathrand.New(mathrand.NewSource(config.Seed))
+	for _, field := range config.Redact {
+		rec.redact[strings.ToLower(field)] = struct{}{}
+	}
+	if len(rec.key) == 0 {
+		rec.key = make([]byte, 32)
+		if _, err := rand.Read(rec.key); err != nil {
+			return nil, err
+		}
+	}
+	if err := rec.open(); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (rec *Recorder) open() error {
+	file, err := os.OpenFile(rec.config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rec.file, rec.size = file, info.Size()
+	return nil
+}
+
+// statusWriter keeps the status written by the handler and the size of the
+// body. streamed tells that the handler flushed its response, as /events
+// does, or upgraded the connection
+type statusWriter struct {
+	http.ResponseWriter
+	status   int
+	written  int64
+	streamed bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// Flush lets the handlers stream their response, such as /events
+func (w *statusWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.streamed = true
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the handlers upgrade the connection, such as the WebSockets
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the connection can not be hijacked")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	w.streamed = true
+	return hijacker.Hijack()
+}
+
+// Middleware records the sampled requests with the status of their response.
+// The streams, such as /events, are not recorded, a replay would wait for
+// their end forever. Neither are the upgrades to a WebSocket, even the
+// refused ones, a replay does not send the headers of the handshake
+func (rec *Recorder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if headerHasToken(r.Header, "Upgrade", "websocket") || !rec.sampled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		captured := CapturedRequest{
+			Time:        time.Now().UTC(),
+			Method:      r.Method,
+			Path:        r.URL.RequestURI(),
+			ContentType: r.Header.Get("Content-Type"),
+			Accept:      r.Header.Get("Accept"),
+		}
+		// an empty body is left as it is, the handlers compare it with
+		// http.NoBody
+		if r.Body != nil && r.Body != http.NoBody {
+			body, err := io.ReadAll(r.Body)
+			r.Body.Close()
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			if err == nil && len(body) <= maxRecordedBody {
+				captured.Body = string(body)
+			}
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.streamed {
+			return
+		}
+		captured.Status = sw.status
+		if captured.Status == 0 {
+			captured.Status = http.StatusOK
+		}
+		rec.write(rec.redacted(captured))
+	})
+}
+
+func (rec *Recorder) sampled() bool {
+	if rec.config.Sample == 0 || rec.config.Sample == 1 {
+		return rec.config.Sample == 1
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.random.Float64() < rec.config.Sample
+}
+
+func (rec *Recorder) write(captured CapturedRequest) {
+	line, err := json.Marshal(captured)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.file == nil {
+		return
+	}
+	if rec.config.MaxBytes > 0 && rec.size > 0 && rec.size+int64(len(line)) > rec.config.MaxBytes {
+		if err := rec.rotate(); err != nil {
+			return
+		}
+	}
+	n, _ := rec.file.Write(line)
+	rec.size += int64(n)
+}
+
+// rotate renames the capture to Path.1, moving the older ones up and
+// removing the oldest, then it starts a new capture
+func (rec *Recorder) rotate() error {
+	rec.file.Close()
+	rec.file = nil
+	path := rec.config.Path
+	os.Remove(fmt.Sprintf("%s.%d", path, rec.config.MaxFiles))
+	for idx := rec.config.MaxFiles - 1; idx >= 1; idx-- {
+		os.Rename(fmt.Sprintf("%s.%d", path, idx), fmt.Sprintf("%s.%d", path, idx+1))
+	}
+	if rec.config.MaxFiles > 0 {
+		if err := os.Rename(path, path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(path); err != nil {
+		return err
+	}
+	return rec.open()
+}
+
+// Close closes the capture, the requests served after it are not recorded
+func (rec *Recorder) Close() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.file == nil {
+		return nil
+	}
+	err := rec.file.Close()
+	rec.file = nil
+	return err
+}
+
+func (rec *Recorder) redacted(captured CapturedRequest) CapturedRequest {
+	if len(rec.redact) == 0 {
+		return captured
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if _, ok := rec.redact["id"]; ok {
+		segments := strings.Split(captured.Path, "/")
+		for idx, segment := range segments {
+			if _, err := strconv.ParseUint(segment, 10, 64); err == nil {
+				segments[idx] = rec.pseudonym(segment)
+			}
+		}
+		captured.Path = strings.Join(segments, "/")
+	}
+	if captured.Body == "" {
+		return captured
+	}
+	decoder := json.NewDecoder(strings.NewReader(captured.Body))
+	decoder.UseNumber()
+	var body any
+	if err := decoder.Decode(&body); err == nil {
+		if redacted, err := json.Marshal(rec.redactJSON(body)); err == nil {
+			captured.Body = string(redacted)
+		}
+	} else if form, err := url.ParseQuery(captured.Body); err == nil {
+		for key, values := range form {
+			if _, ok := rec.redact[strings.ToLower(key)]; ok {
+				for idx := range values {
+					values[idx] = rec.pseudonym(values[idx])
+				}
+			}
+		}
+		captured.Body = form.Encode()
+	}
+	return captured
+}
+
+func (rec *Recorder) redactJSON(value any) any {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, field := range value {
+			if _, ok := rec.redact[strings.ToLower(key)]; ok {
+				value[key] = rec.pseudonymJSON(field)
+			} else {
+				value[key] = rec.redactJSON(field)
+			}
+		}
+	case []any:
+		for idx := range value {
+			value[idx] = rec.redactJSON(value[idx])
+		}
+	}
+	return value
+}
+
+func (rec *Recorder) pseudonymJSON(value any) any {
+	switch value := value.(type) {
+	case json.Number:
+		return json.Number(rec.pseudonym(value.String()))
+	case string:
+		return rec.pseudonym(value)
+	case nil:
+		return nil
+	}
+	return "redacted"
+}
+
+// pseudonym replaces the value with a keyed hash. A positive int stays a
+// positive int, so the ids of the capture are still valid ids. The hash is
+// short, when the pseudonym is already taken by another value the value is
+// hashed again with the next round, so two values never share a pseudonym.
+// rec.mu must be held
+func (rec *Recorder) pseudonym(value string) string {
+	if pseudonym, ok := rec.pseudonyms[value]; ok {
+		return pseudonym
+	}
+	pseudonym := rec.hashed(value, 0)
+	for round := 1; ; round++ {
+		if _, taken := rec.originals[pseudonym]; !taken {
+			break
+		}
+		pseudonym = rec.hashed(value, round)
+	}
+	rec.pseudonyms[value] = pseudonym
+	rec.originals[pseudonym] = value
+	return pseudonym
+}
+
+// hashed is the keyed hash of the value in the given round of pseudonym
+func (rec *Recorder) hashed(value string, round int) string {
+	mac := hmac.New(sha256.New, rec.key)
+	mac.Write([]byte(value))
+	if round > 0 {
+		mac.Write([]byte("#" + strconv.Itoa(round)))
+	}
+	sum := mac.Sum(nil)
+	if _, err := strconv.ParseUint(value, 10, 64); err == nil {
+		return strconv.FormatUint(uint64(binary.BigEndian.Uint32(sum)&0x7fffffff)+1, 10)
+	}
+	return "redacted-" + hex.EncodeToString(sum[:6])
+}
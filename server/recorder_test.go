@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// recordTraffic serves a few requests through a recorder and returns the
+// capture it wrote
+func recordTraffic(t *testing.T, config RecorderConfig, journeys int) []CapturedRequest {
+	t.Helper()
+	rec, err := NewRecorder(config)
+	if err != nil {
+		t.Fatalf("NewRecorder() error = %v", err)
+	}
+	handler := New("", NewDispatcher(), rec.Middleware).Handler
+	send := func(method, path, ctype, body string) {
+		captured := CapturedRequest{Method: method, Path: path, ContentType: ctype, Body: body}
+		req, _ := captured.NewRequest("http://localhost")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	send("GET", "/status", "", "")
+	send("PUT", "/cars", ContentTypeJSON, `[ { "id": 1, "seats": 4 }, { "id": 2, "seats": 6 } ]`)
+	for groupId := 1; groupId <= journeys; groupId++ {
+		send("POST", "/journey", ContentTypeJSON, fmt.Sprintf(`{ "id": %d, "people": 4 }`, groupId))
+	}
+	send("POST", "/locate", ContentTypeURLENCODED, "ID=1")
+	send("POST", "/dropoff", ContentTypeURLENCODED, "ID=1")
+	send("GET", "/cars/2", "", "")
+	send("POST", "/journey", ContentTypeJSON, "")
+	rec.Close()
+
+	file, err := os.Open(config.Path)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer file.Close()
+	requests, err := ReadCapture(file)
+	if err != nil {
+		t.Fatalf("ReadCapture() error = %v", err)
+	}
+	return requests
+}
+
+// assertReplays sends the capture to a new server and checks every status
+func assertReplays(t *testing.T, requests []CapturedRequest) {
+	t.Helper()
+	handler := New("", NewDispatcher()).Handler
+	for idx, captured := range requests {
+		req, _ := captured.NewRequest("http://localhost")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		body, _ := io.ReadAll(w.Result().Body)
+		if !captured.Matches(w.Code, string(body)) {
+			t.Fatalf("request %d %s %s: (Expected) %d != %d (Returned)", idx+1, captured.Method, captured.Path, captured.Status, w.Code)
+		}
+	}
+}
+
+func TestRecorder_Replayable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	requests := recordTraffic(t, RecorderConfig{Path: path, Sample: 1}, 3)
+	if len(requests) != 9 {
+		t.Fatalf("(Expected) %d != %d (Returned)", 9, len(requests))
+	}
+	expected := []int{200, 200, 200, 200, 202, 200, 200, 200, 400}
+	for idx, status := range expected {
+		if requests[idx].Status != status {
+			t.Fatalf("request %d: (Expected) %d != %d (Returned)", idx+1, status, requests[idx].Status)
+		}
+	}
+	if requests[1].Body != `[ { "id": 1, "seats": 4 }, { "id": 2, "seats": 6 } ]` || requests[1].ContentType != ContentTypeJSON {
+		t.Fatalf("the body or the content type of %v were not recorded", requests[1])
+	}
+	if requests[0].Time.IsZero() {
+		t.Fatalf("the time of the request was not recorded")
+	}
+	assertReplays(t, requests)
+}
+
+func TestRecorder_Streams(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	rec, err := NewRecorder(RecorderConfig{Path: path, Sample: 1})
+	if err != nil {
+		t.Fatalf("NewRecorder() error = %v", err)
+	}
+	handler := New("", NewDispatcher(), rec.Middleware).Handler
+	// the stream ends at once with the request
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stream, _ := http.NewRequestWithContext(ctx, "GET", "http://localhost/events", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), stream)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/events?group=x", nil))
+	upgrade := httptest.NewRequest("GET", "/v2/groups/x/ws", nil)
+	upgrade.Header.Set("Connection", "Upgrade")
+	upgrade.Header.Set("Upgrade", "websocket")
+	handler.ServeHTTP(httptest.NewRecorder(), upgrade)
+	rec.Close()
+
+	file, _ := os.Open(path)
+	defer file.Close()
+	requests, _ := ReadCapture(file)
+	if len(requests) != 1 || requests[0].Status != http.StatusBadRequest {
+		t.Fatalf("(Expected) only the 400 of /events?group=x != %+v (Returned)", requests)
+	}
+}
+
+func TestRecorder_Rotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "capture.jsonl")
+	recordTraffic(t, RecorderConfig{Path: path, Sample: 1, MaxBytes: 1024, MaxFiles: 2}, 20)
+	for _, name := range []string{"capture.jsonl", "capture.jsonl.1", "capture.jsonl.2"} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Stat(%s) error = %v", name, err)
+		}
+		if info.Size() > 1024 {
+			t.Fatalf("%s has %d bytes, more than the limit", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("only 2 rotated captures should be kept")
+	}
+}
+
+func TestRecorder_Sample(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	requests := recordTraffic(t, RecorderConfig{Path: path, Sample: 0.5, Seed: 1}, 200)
+	if len(requests) < 60 || len(requests) > 150 {
+		t.Fatalf("%d of 207 requests recorded with a sample of 0.5", len(requests))
+	}
+	// a sample of 0 records nothing
+	requests = recordTraffic(t, RecorderConfig{Path: filepath.Join(t.TempDir(), "none.jsonl"), Sample: 0}, 20)
+	if len(requests) != 0 {
+		t.Fatalf("%d requests recorded with a sample of 0", len(requests))
+	}
+	if _, err := NewRecorder(RecorderConfig{Path: path, Sample: 2}); err == nil {
+		t.Fatalf("NewRecorder() should fail with a sample over 1")
+	}
+}
+
+func TestRecorder_Redact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	requests := recordTraffic(t, RecorderConfig{Path: path, Sample: 1, Redact: []string{"id"}, RedactKey: "secret"}, 3)
+	for _, captured := range requests {
+		if strings.Contains(captured.Body, `"id":1,`) || strings.Contains(captured.Body, `"id":1}`) ||
+			captured.Body == "ID=1" || captured.Path == "/cars/2" {
+			t.Fatalf("%s %s %s was not redacted", captured.Method, captured.Path, captured.Body)
+		}
+	}
+	// the same id gets the same pseudonym, the journey of the group 1 and
+	// its dropoff still match
+	if !strings.Contains(requests[2].Body, strings.TrimPrefix(requests[6].Body, "ID=")) {
+		t.Fatalf("the pseudonyms of %s and %s differ", requests[2].Body, requests[6].Body)
+	}
+	if requests[2].Body == requests[3].Body {
+		t.Fatalf("different ids got the same pseudonym")
+	}
+	if !strings.Contains(requests[2].Body, `"people":4`) {
+		t.Fatalf("only the redacted fields are replaced, %s", requests[2].Body)
+	}
+	// the car ids of the paths and of the cars list match too
+	assertReplays(t, requests)
+}
+
+func TestRecorder_PseudonymCollision(t *testing.T) {
+	rec, err := NewRecorder(RecorderConfig{Path: filepath.Join(t.TempDir(), "capture.jsonl"), Redact: []string{"id"}, RedactKey: "secret"})
+	if err != nil {
+		t.Fatalf("NewRecorder() error = %v", err)
+	}
+	defer rec.Close()
+	// the ids are hashed to 31 bits, a collision shows up after some tens of
+	// thousands of ids
+	first, second := "", ""
+	hashes := map[string]string{}
+	for id := 1; id <= 1<<20 && second == ""; id++ {
+		value := strconv.Itoa(id)
+		hash := rec.hashed(value, 0)
+		if other, ok := hashes[hash]; ok {
+			first, second = other, value
+		}
+		hashes[hash] = value
+	}
+	if second == "" {
+		t.Skip("no collision among the ids")
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	pseudonym := rec.pseudonym(first)
+	if other := rec.pseudonym(second); other == pseudonym {
+		t.Fatalf("the ids %s and %s got the same pseudonym %s", first, second, pseudonym)
+	}
+	if _, err := strconv.ParseUint(rec.pseudonym(second), 10, 64); err != nil {
+		t.Fatalf("the pseudonym of an id must be an int, %s", rec.pseudonym(second))
+	}
+	if rec.pseudonym(first) != pseudonym || rec.originals[rec.pseudonym(second)] != second {
+		t.Fatalf("an id must keep its pseudonym")
+	}
+}
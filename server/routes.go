@@ -4,17 +4,76 @@ import (
 	"net/http"
 )
 
-func initRoutes() {
+// Middleware wraps the handler of the routes, such as a traffic recorder
+type Middleware func(next http.Handler) http.Handler
+
+// initRoutes registers the endpoints in a new mux, so several servers can
+// live in the same process. The first middleware is the outermost one
+func initRoutes(h *handlers, middlewares ...Middleware) http.Handler {
+	mux := http.NewServeMux()
 	// Done
 
 	// Performance test and improves required
-	http.HandleFunc("/status", statusHandler)
+	mux.HandleFunc("/status", h.statusHandler)
+
+	mux.HandleFunc("/live", h.liveHandler)
+
+	mux.HandleFunc("/ready", h.readyHandler)
+
+	mux.HandleFunc("/metrics", h.metricsHandler)
+
+	if h.events != nil {
+		mux.HandleFunc("/events", h.eventsHandler)
+	}
+
+	mux.HandleFunc("/cars", h.carsHandler)
+
+	mux.HandleFunc("/cars/", h.carHandler)
+
+	mux.HandleFunc("/journey", h.journeyHandler)
+
+	mux.HandleFunc("/locate", h.locateHandler)
 
-	http.HandleFunc("/cars", carsHandler)
+	mux.HandleFunc("/dropoff", h.dropoffHandler)
 
-	http.HandleFunc("/journey", journeyHandler)
+	mux.HandleFunc("/v2/groups", h.groupsV2Handler)
 
-	http.HandleFunc("/locate", locateHandler)
+	mux.HandleFunc("/v2/groups/", h.groupV2Handler)
+
+	mux.HandleFunc("/v2/cars", h.carsV2Handler)
+
+	mux.HandleFunc("/v2/cars/", h.carV2Handler)
+
+	mux.HandleFunc("/v2/journeys", h.journeysV2Handler)
+
+	mux.HandleFunc("/v2/waiting", h.waitingV2Handler)
+
+	mux.HandleFunc("/", h.notFoundHandler)
+
+	var handler http.Handler = h.recoveryGate(mux)
+	if h.metrics != nil {
+		handler = h.metrics.instrument(mux, handler)
+	}
+	for idx := len(middlewares) - 1; idx >= 0; idx-- {
+		handler = middlewares[idx](handler)
+	}
+	return handler
+}
+
+// operationalPaths answer while the state is being recovered
+var operationalPaths = map[string]struct{}{
+	"/status": {}, "/live": {}, "/ready": {}, "/metrics": {},
+}
 
-	http.HandleFunc("/dropoff", dropoffHandler)
+// recoveryGate answers 503 to the requests of the API while the state of the
+// dispatcher is being recovered, so they do not change a partial state
+func (h *handlers) recoveryGate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := operationalPaths[r.URL.Path]; !ok && h.dispatcher.Recovering() {
+			w.Header().Set("Retry-After", "1")
+			writeProblem(w, http.StatusServiceUnavailable, ProblemNotReady, "the state is being recovered")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
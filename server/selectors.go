@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// FreeSeats is the read only view of the fleet given to a CarSelector, the
+// cars are grouped by their amount of free seats
+type FreeSeats interface {
+	// Count returns how many cars have exactly freeSeats free seats
+	Count(freeSeats uint) int
+	// Lowest returns the lowest car id with exactly freeSeats free seats, or 0
+	Lowest(freeSeats uint) uint
+	// At returns the i-th car with exactly freeSeats free seats, the order is
+	// stable between calls but otherwise unspecified. It returns 0 if i is
+	// out of range
+	At(freeSeats uint, i int) uint
+}
+
+// CarSelector chooses the car for a group among the cars with enough free
+// seats. It returns the car id, or 0 if no car can take the group
+type CarSelector interface {
+	SelectCar(cars FreeSeats, people uint) uint
+}
+
+// BestFit takes the car with the fewest free seats that can take the group,
+// it keeps the emptier cars for the bigger groups
+type BestFit struct{}
+
+func (BestFit) SelectCar(cars FreeSeats, people uint) uint {
+	for freeSeats := people; freeSeats <= MaxSeats; freeSeats++ {
+		if cars.Count(freeSeats) > 0 {
+			return cars.Lowest(freeSeats)
+		}
+	}
+	return 0
+}
+
+// WorstFit takes the car with the most free seats, it spreads the groups
+// between the cars
+type WorstFit struct{}
+
+func (WorstFit) SelectCar(cars FreeSeats, people uint) uint {
+	for freeSeats := MaxSeats; freeSeats >= people && freeSeats > 0; freeSeats-- {
+		if cars.Count(freeSeats) > 0 {
+			return cars.Lowest(freeSeats)
+		}
+	}
+	return 0
+}
+
+// FirstFit takes the car with the lowest id that can take the group
+type FirstFit struct{}
+
+func (FirstFit) SelectCar(cars FreeSeats, people uint) uint {
+	var chosen uint
+	for freeSeats := people; freeSeats <= MaxSeats; freeSeats++ {
+		if carId := cars.Lowest(freeSeats); carId != 0 && (chosen == 0 || carId < chosen) {
+			chosen = carId
+		}
+	}
+	return chosen
+}
+
+// RandomFit takes any car that can take the group with the same probability.
+// Two RandomFit with the same seed choose the same cars for the same requests
+type RandomFit struct {
+	rnd *rand.Rand
+}
+
+func NewRandomFit(src rand.Source) *RandomFit {
+	return &RandomFit{rand.New(src)}
+}
+
+func (s *RandomFit) SelectCar(cars FreeSeats, people uint) uint {
+	total := 0
+	for freeSeats := people; freeSeats <= MaxSeats; freeSeats++ {
+		total += cars.Count(freeSeats)
+	}
+	if total == 0 {
+		return 0
+	}
+	chosen := s.rnd.Intn(total)
+	for freeSeats := people; freeSeats <= MaxSeats; freeSeats++ {
+		if chosen < cars.Count(freeSeats) {
+			return cars.At(freeSeats, chosen)
+		}
+		chosen -= cars.Count(freeSeats)
+	}
+	return 0
+}
+
+var carSelectors = map[string]func(seed int64) CarSelector{
+	"best-fit":  func(seed int64) CarSelector { return BestFit{} },
+	"worst-fit": func(seed int64) CarSelector { return WorstFit{} },
+	"first-fit": func(seed int64) CarSelector { return FirstFit{} },
+	"random":    func(seed int64) CarSelector { return NewRandomFit(rand.NewSource(seed)) },
+}
+
+// CarSelectorByName returns the strategy with the given name, it is used to
+// choose the strategy from the configuration. The seed is only used by the
+// random strategy, if it is 0 the current time is used instead. Every other
+// strategy breaks ties by the lowest car id, so they are always deterministic
+func CarSelectorByName(name string, seed int64) (CarSelector, error) {
+	newSelector, ok := carSelectors[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown car selection strategy %q, valid ones are %v", name, CarSelectorNames())
+	}
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return newSelector(seed), nil
+}
+
+func CarSelectorNames() []string {
+	names := make([]string, 0, len(carSelectors))
+	for name := range carSelectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
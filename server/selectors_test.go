@@ -0,0 +1,128 @@
+package server
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestCarSelectors(t *testing.T) {
+	// free seats: car 1 -> 6, car 2 -> 4, car 3 -> 5, car 4 -> 4, car 5 -> 2
+	fleet := []Car{{5, 4}, {1, 6}, {4, 4}, {3, 5}, {2, 6}}
+	d := NewDispatcher()
+	d.ResetCars(fleet)
+	d.assignCar(2, Group{100, 2})
+	d.assignCar(5, Group{101, 2})
+	tests := []struct {
+		name     string
+		selector CarSelector
+		people   uint
+		want     uint
+	}{
+		{"BestFitSmallGroup", BestFit{}, 1, 5},
+		{"BestFitExactSeats", BestFit{}, 4, 2},
+		{"BestFitBigGroup", BestFit{}, 6, 1},
+		{"BestFitNoCar", BestFit{}, 7, 0},
+		{"WorstFitSmallGroup", WorstFit{}, 1, 1},
+		{"WorstFitBigGroup", WorstFit{}, 6, 1},
+		{"FirstFitSmallGroup", FirstFit{}, 1, 1},
+		{"FirstFitMediumGroup", FirstFit{}, 3, 1},
+		{"FirstFitNoCar", FirstFit{}, 7, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.selector.SelectCar(d.capacitiesMap, tt.people); got != tt.want {
+				t.Errorf("SelectCar(%d) = %d, want %d", tt.people, got, tt.want)
+			}
+		})
+	}
+	t.Run("RandomFit", func(t *testing.T) {
+		selector := NewRandomFit(rand.NewSource(1))
+		for i := 0; i < 100; i++ {
+			carId := selector.SelectCar(d.capacitiesMap, 5)
+			if carId != 1 && carId != 3 {
+				t.Fatalf("SelectCar(5) = %d, the car does not have 5 free seats", carId)
+			}
+		}
+		if got := selector.SelectCar(d.capacitiesMap, 7); got != 0 {
+			t.Errorf("SelectCar(7) = %d, want 0", got)
+		}
+	})
+}
+
+func TestCarSelectorByName(t *testing.T) {
+	for _, name := range CarSelectorNames() {
+		if _, err := CarSelectorByName(name, 0); err != nil {
+			t.Errorf("CarSelectorByName(%q) error = %v", name, err)
+		}
+	}
+	if _, err := CarSelectorByName("smallest", 0); err == nil {
+		t.Errorf("CarSelectorByName() accepted an unknown strategy")
+	}
+}
+
+func Test_capacityIndex(t *testing.T) {
+	capacities := make(capacityIndex)
+	for _, carId := range []uint{7, 3, 9, 1, 5} {
+		capacities.add(4, carId)
+	}
+	capacities.add(4, 3)
+	capacities.remove(4, 1)
+	capacities.remove(4, 8)
+	capacities.remove(6, 1)
+	if capacities.Count(4) != 4 || capacities.Lowest(4) != 3 {
+		t.Fatalf("Count(4), Lowest(4) = %d, %d want 4, 3", capacities.Count(4), capacities.Lowest(4))
+	}
+	if capacities.Count(6) != 0 || capacities.Lowest(6) != 0 || capacities.At(6, 0) != 0 {
+		t.Fatalf("empty capacity returned a car")
+	}
+	seen := map[uint]bool{}
+	for i := 0; i < capacities.Count(4); i++ {
+		seen[capacities.At(4, i)] = true
+	}
+	if len(seen) != 4 || seen[1] {
+		t.Fatalf("At() returned %v", seen)
+	}
+}
+
+// The same requests must produce the same journeys, so incidents can be
+// replayed
+func TestCarSelectors_Deterministic(t *testing.T) {
+	const seed = 42
+	replay := func(strategy string) map[uint]uint {
+		selector, err := CarSelectorByName(strategy, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := NewDispatcher(WithCarSelector(selector))
+		rnd := rand.New(rand.NewSource(seed))
+		fleet := []Car{}
+		for carId := uint(1); carId <= 50; carId++ {
+			fleet = append(fleet, Car{carId, uint(rnd.Intn(3) + 4)})
+		}
+		d.ResetCars(fleet)
+		for groupId := uint(0); groupId < 300; groupId++ {
+			d.RequestJourney(Group{groupId, uint(rnd.Intn(6) + 1)})
+			if groupId%3 == 0 {
+				d.Dropoff(uint(rnd.Intn(int(groupId) + 1)))
+			}
+		}
+		journeys := map[uint]uint{}
+		for groupId := uint(0); groupId < 300; groupId++ {
+			if car, assigned, err := d.Locate(groupId); err == nil && assigned {
+				journeys[groupId] = car.Id
+			}
+		}
+		return journeys
+	}
+	for _, strategy := range CarSelectorNames() {
+		t.Run(strategy, func(t *testing.T) {
+			first := replay(strategy)
+			for i := 0; i < 5; i++ {
+				if again := replay(strategy); !reflect.DeepEqual(first, again) {
+					t.Fatalf("the same requests produced different journeys")
+				}
+			}
+		})
+	}
+}
@@ -8,6 +8,10 @@ import (
 
 const ContentTypeJSON = "application/json"
 const ContentTypeURLENCODED = "application/x-www-form-urlencoded"
+const ContentTypeEventStream = "text/event-stream"
+
+// PUT /cars?mode=reconcile replaces the fleet without resetting the journeys
+const CarsModeReconcile = "reconcile"
 
 const MinSeats uint = 4
 const MaxSeats uint = 6
@@ -15,13 +19,6 @@ const MaxSeats uint = 6
 const MinPeople uint = 1
 const MaxPeople uint = 6
 
-var carsMap map[uint]uint
-var carsSize map[uint]uint
-var groupsMap map[uint]uint
-var capacitiesMap map[uint]map[uint]struct{}
-var journeysMap map[uint]uint
-var waitingGroups []uint
-
 // Cars
 type Car struct {
 	Id    uint `json:"id"`
@@ -42,11 +39,7 @@ func (car *Car) UnmarshalJSON(data []byte) (err error) {
 	} else if *required.Id == 0 {
 		err = fmt.Errorf("id must be different from 0")
 		return err
-	} else if *required.Seats < MinSeats {
-		err = fmt.Errorf("seats must be > %d", MinSeats-1)
-		return err
-	} else if *required.Seats > MaxSeats {
-		err = fmt.Errorf("seats must be < %d", MaxSeats+1)
+	} else if err = validateSeats(*required.Seats); err != nil {
 		return err
 	}
 
@@ -55,6 +48,118 @@ func (car *Car) UnmarshalJSON(data []byte) (err error) {
 	return
 }
 
+func validateSeats(seats uint) error {
+	if seats < MinSeats {
+		return fmt.Errorf("seats must be > %d", MinSeats-1)
+	} else if seats > MaxSeats {
+		return fmt.Errorf("seats must be < %d", MaxSeats+1)
+	}
+	return nil
+}
+
+// CarStatus tells if a car can take new groups
+type CarStatus string
+
+const (
+	// CarInService takes new groups
+	CarInService CarStatus = "in_service"
+	// CarPaused keeps its groups, but it does not take new ones
+	CarPaused CarStatus = "paused"
+	// CarOutOfService has no groups, the ones it had go back to the waiting list
+	CarOutOfService CarStatus = "out_of_service"
+)
+
+// carStatusTransitions lists the statuses a car can move to from each status
+var carStatusTransitions = map[CarStatus][]CarStatus{
+	CarInService:    {CarPaused, CarOutOfService},
+	CarPaused:       {CarInService, CarOutOfService},
+	CarOutOfService: {CarInService},
+}
+
+func (status CarStatus) canMoveTo(next CarStatus) bool {
+	if status == next {
+		return true
+	}
+	for _, allowed := range carStatusTransitions[status] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// CarUpdate is the body of POST and PATCH /cars/{id}, the id is in the path.
+// A zero value field is not changed
+type CarUpdate struct {
+	Seats  uint      `json:"seats"`
+	Status CarStatus `json:"status"`
+}
+
+func (update *CarUpdate) UnmarshalJSON(data []byte) (err error) {
+	required := struct {
+		Seats  *uint      `json:"seats"`
+		Status *CarStatus `json:"status"`
+	}{}
+	err = json.Unmarshal(data, &required)
+	if err != nil {
+		return err
+	} else if required.Seats == nil && required.Status == nil {
+		return fmt.Errorf("seats or status is required")
+	}
+	if required.Seats != nil {
+		if err = validateSeats(*required.Seats); err != nil {
+			return err
+		}
+		update.Seats = *required.Seats
+	}
+	if required.Status != nil {
+		if _, ok := carStatusTransitions[*required.Status]; !ok {
+			return fmt.Errorf("status must be \"%s\", \"%s\" or \"%s\"", CarInService, CarPaused, CarOutOfService)
+		}
+		update.Status = *required.Status
+	}
+	return nil
+}
+
+// CarDetail is the state of a car returned by GET /cars/{id}
+type CarDetail struct {
+	Id        uint      `json:"id"`
+	Seats     uint      `json:"seats"`
+	FreeSeats uint      `json:"free_seats"`
+	Status    CarStatus `json:"status"`
+	Groups    []uint    `json:"groups"`
+}
+
+// JourneyStatus tells if a group is travelling or waiting for a car
+type JourneyStatus string
+
+const (
+	JourneyTravelling JourneyStatus = "travelling"
+	JourneyWaiting    JourneyStatus = "waiting"
+)
+
+// JourneyCar is the car of a travelling group
+type JourneyCar struct {
+	Id        uint `json:"id"`
+	Seats     uint `json:"seats"`
+	FreeSeats uint `json:"free_seats"`
+}
+
+// JourneyDetail is the state of the journey of a group returned by POST
+// /journey. Car is nil while the group waits, then Position is its place in
+// the waiting list and SizePosition among the groups of its size, starting at
+// 1. EstimatedWait is in seconds rounded up, it is left out until the dropoff
+// rate is known
+type JourneyDetail struct {
+	Id            uint          `json:"id"`
+	People        uint          `json:"people"`
+	Status        JourneyStatus `json:"status"`
+	Car           *JourneyCar   `json:"car,omitempty"`
+	Position      int           `json:"position,omitempty"`
+	SizePosition  int           `json:"size_position,omitempty"`
+	EstimatedWait int           `json:"estimated_wait_seconds,omitempty"`
+}
+
 // groups
 type Group struct {
 	Id     uint `json:"id"`
@@ -91,23 +196,22 @@ func (group *Group) UnmarshalJSON(data []byte) (err error) {
 	return nil
 }
 
-// Service variables
-
-func startStorage() {
-	carsMap = make(map[uint]uint)
-	carsSize = make(map[uint]uint)
-	groupsMap = make(map[uint]uint)
-	capacitiesMap = make(map[uint]map[uint]struct{})
-	journeysMap = make(map[uint]uint)
-	waitingGroups = []uint{}
-}
-
-func New(addr string) *http.Server {
-	startStorage()
-	initRoutes()
-	return &http.Server{
-		Addr: addr,
+// New returns the http server of the service, every request is served by the
+// given dispatcher after going through the middlewares
+func New(addr string, dispatcher *Dispatcher, middlewares ...Middleware) *http.Server {
+	events := newEventHub(eventHistory)
+	removeObserver := dispatcher.addObserver(events.observe)
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: initRoutes(&handlers{dispatcher: dispatcher, metrics: newHTTPMetrics(), events: events}, middlewares...),
 	}
+	// the streams of /events never end by themselves, and the hub stops
+	// observing the dispatcher, which may outlive the server
+	srv.RegisterOnShutdown(func() {
+		removeObserver()
+		events.close()
+	})
+	return srv
 }
 
 //check if adding a variable to group to store car can save the journey Map
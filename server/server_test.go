@@ -3,8 +3,10 @@ package server
 import (
 	"context"
 	"net/http"
-	"reflect"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCar_UnmarshalJSON(t *testing.T) {
@@ -70,19 +72,71 @@ func TestNew(t *testing.T) {
 	tests := []struct {
 		name string
 		args args
-		want *http.Server
 	}{
-		// TODO: Add test cases.
-		{"NewServerOK", args{":9091"}, &http.Server{Addr: ":9091"}},
+		{"NewServerOK", args{":9091"}},
+		{"NewServerTwice", args{":9092"}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ctx := context.Background()
-			got := New(tt.args.addr)
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("New() = %v, want %v", got, tt.want)
+			got := New(tt.args.addr, NewDispatcher())
+			if got.Addr != tt.args.addr {
+				t.Errorf("New().Addr = %v, want %v", got.Addr, tt.args.addr)
+			}
+			if got.Handler == nil {
+				t.Errorf("New().Handler is nil, the routes would be served by http.DefaultServeMux")
 			}
 			got.Shutdown(ctx)
 		})
 	}
 }
+
+func TestNew_IndependentServers(t *testing.T) {
+	first := httptest.NewServer(New("", NewDispatcher()).Handler)
+	defer first.Close()
+	second := httptest.NewServer(New("", NewDispatcher()).Handler)
+	defer second.Close()
+
+	res, err := http.Post(first.URL+"/journey", ContentTypeJSON, strings.NewReader(`{ "id": 1, "people": 4 }`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("(Expected) %d != %d (Returned)", http.StatusAccepted, res.StatusCode)
+	}
+	for _, tt := range []struct {
+		url    string
+		status int
+	}{
+		{first.URL, http.StatusNoContent},
+		{second.URL, http.StatusNotFound},
+	} {
+		res, err := http.Post(tt.url+"/locate", ContentTypeURLENCODED, strings.NewReader("ID=1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.status {
+			t.Fatalf("(Expected) %d != %d (Returned)", tt.status, res.StatusCode)
+		}
+	}
+}
+
+func TestNew_ShutdownRemovesObserver(t *testing.T) {
+	dispatcher := NewDispatcher()
+	for i := 0; i < 3; i++ {
+		New("", dispatcher).Shutdown(context.Background())
+	}
+	// the shutdown hooks run in their own goroutines
+	observers := -1
+	for wait := 0; wait < 100 && observers != 0; wait++ {
+		time.Sleep(time.Millisecond)
+		dispatcher.mu.Lock()
+		observers = len(dispatcher.observers)
+		dispatcher.mu.Unlock()
+	}
+	if observers != 0 {
+		t.Fatalf("(Expected) 0 != %d (Returned) observers", observers)
+	}
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// SnapshotVersion is the version of the snapshot file format, it changes
+// every time the format changes in a way older versions can not read
+const SnapshotVersion = 1
+
+// Snapshot is the whole state of the dispatcher, it is saved as json
+type Snapshot struct {
+	Version int       `json:"version"`
+	TakenAt time.Time `json:"taken_at"`
+	// LastOperation is the sequence number of the last operation included
+	LastOperation uint64                 `json:"last_operation"`
+	Cars          []SnapshotCar          `json:"cars"`
+	Waiting       []SnapshotWaitingGroup `json:"waiting"`
+}
+
+// SnapshotCar is a car with the groups travelling in it in boarding order
+type SnapshotCar struct {
+	Id     uint      `json:"id"`
+	Seats  uint      `json:"seats"`
+	Status CarStatus `json:"status"`
+	Groups []Group   `json:"groups"`
+}
+
+// SnapshotWaitingGroup is a group of the waiting list, the list is saved in
+// arrival order
+type SnapshotWaitingGroup struct {
+	Id     uint      `json:"id"`
+	People uint      `json:"people"`
+	Since  time.Time `json:"since"`
+	Skips  int       `json:"skips"`
+}
+
+// Snapshot copies the state of the dispatcher
+func (d *Dispatcher) Snapshot() Snapshot {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	snapshot := Snapshot{Version: SnapshotVersion, TakenAt: d.now(), LastOperation: d.seq, Cars: []SnapshotCar{}, Waiting: []SnapshotWaitingGroup{}}
+	for carId, seats := range d.carsSize {
+		car := SnapshotCar{carId, seats, d.carsStatus[carId], []Group{}}
+		for _, groupId := range d.carGroups[carId] {
+			car.Groups = append(car.Groups, Group{groupId, d.groupsMap[groupId]})
+		}
+		snapshot.Cars = append(snapshot.Cars, car)
+	}
+	sort.Slice(snapshot.Cars, func(i, j int) bool { return snapshot.Cars[i].Id < snapshot.Cars[j].Id })
+	d.waitingGroups.each(func(group *waitingGroup) bool {
+		snapshot.Waiting = append(snapshot.Waiting, SnapshotWaitingGroup{group.id, group.people, group.since, group.skips})
+		return true
+	})
+	return snapshot
+}
+
+// Restore replaces the state of the dispatcher with the snapshot. If the
+// snapshot is not valid nothing changes
+func (d *Dispatcher) Restore(snapshot Snapshot) error {
+	if err := snapshot.validate(); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cleanJourneysAndCars()
+	for _, car := range snapshot.Cars {
+		d.carsMap[car.Id] = car.Seats
+		d.carsSize[car.Id] = car.Seats
+		d.carsStatus[car.Id] = car.Status
+		for _, group := range car.Groups {
+			d.groupsMap[group.Id] = group.People
+			d.carsMap[car.Id] -= group.People
+			d.journeysMap[group.Id] = car.Id
+			d.carGroups[car.Id] = append(d.carGroups[car.Id], group.Id)
+			d.lists.board(car.Id, group.Id, group.People)
+		}
+		d.indexCar(car.Id, d.carsMap[car.Id])
+	}
+	for _, group := range snapshot.Waiting {
+		d.groupsMap[group.Id] = group.People
+		d.journeysMap[group.Id] = 0
+		d.waitingGroups.pushBack(group.Id, group.People, group.Since)
+		d.waitingGroups.groups[group.Id].skips = group.Skips
+	}
+	d.pending = nil
+	d.seq = snapshot.LastOperation
+	if len(snapshot.Cars) > 0 || snapshot.LastOperation > 0 {
+		d.markFleetLoaded()
+	}
+	return d.syncStore()
+}
+
+func (snapshot Snapshot) validate() error {
+	if snapshot.Version != SnapshotVersion {
+		return fmt.Errorf("snapshot version %d is not supported, the supported version is %d", snapshot.Version, SnapshotVersion)
+	}
+	cars := map[uint]struct{}{}
+	groups := map[uint]struct{}{}
+	validGroup := func(group Group) error {
+		if _, ok := groups[group.Id]; ok {
+			return fmt.Errorf("snapshot group %d is repeated", group.Id)
+		}
+		groups[group.Id] = struct{}{}
+		if group.People < MinPeople || group.People > MaxPeople {
+			return fmt.Errorf("snapshot group %d has %d people", group.Id, group.People)
+		}
+		return nil
+	}
+	for _, car := range snapshot.Cars {
+		if _, ok := cars[car.Id]; ok || car.Id == 0 {
+			return fmt.Errorf("snapshot car %d is repeated or 0", car.Id)
+		}
+		cars[car.Id] = struct{}{}
+		if err := validateSeats(car.Seats); err != nil {
+			return fmt.Errorf("snapshot car %d: %s", car.Id, err.Error())
+		}
+		if _, ok := carStatusTransitions[car.Status]; !ok {
+			return fmt.Errorf("snapshot car %d has an unknown status %q", car.Id, car.Status)
+		}
+		occupied := uint(0)
+		for _, group := range car.Groups {
+			if err := validGroup(group); err != nil {
+				return err
+			}
+			occupied += group.People
+		}
+		if occupied > car.Seats || (car.Status == CarOutOfService && occupied > 0) {
+			return fmt.Errorf("snapshot car %d can not take its groups", car.Id)
+		}
+	}
+	for _, group := range snapshot.Waiting {
+		if err := validGroup(Group{group.Id, group.People}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteSnapshot writes the state of the dispatcher as json
+func (d *Dispatcher) WriteSnapshot(w io.Writer) error {
+	return json.NewEncoder(w).Encode(d.Snapshot())
+}
+
+// ReadSnapshot restores the state of the dispatcher from the json written by
+// WriteSnapshot
+func (d *Dispatcher) ReadSnapshot(r io.Reader) error {
+	snapshot := Snapshot{}
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return err
+	}
+	return d.Restore(snapshot)
+}
+
+// SaveSnapshot writes the snapshot to a temporary file and renames it, so the
+// file at path is always a complete snapshot even if the process dies
+func (d *Dispatcher) SaveSnapshot(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = d.WriteSnapshot(tmp); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadSnapshot restores the snapshot saved at path, a missing file is not an
+// error, the dispatcher just starts empty
+func (d *Dispatcher) LoadSnapshot(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	return d.ReadSnapshot(file)
+}
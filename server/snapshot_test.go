@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the clock is fixed, so the snapshots taken at different moments are equal
+func snapshotTestClock() time.Time {
+	return time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func newSnapshotTestDispatcher() *Dispatcher {
+	d := NewDispatcher(WithClock(snapshotTestClock))
+	d.ResetCars([]Car{{1, 6}, {2, 4}, {3, 5}})
+	d.RequestJourney(Group{1, 4})
+	d.RequestJourney(Group{2, 2})
+	d.RequestJourney(Group{3, 6})
+	d.RequestJourney(Group{4, 5})
+	d.RequestJourney(Group{5, 6})
+	d.RequestJourney(Group{6, 1})
+	d.SetCarStatus(3, CarPaused)
+	return d
+}
+
+func TestDispatcher_SnapshotRoundTrip(t *testing.T) {
+	d := newSnapshotTestDispatcher()
+	var buf bytes.Buffer
+	if err := d.WriteSnapshot(&buf); err != nil {
+		t.Fatalf("WriteSnapshot() error = %v", err)
+	}
+	restored := NewDispatcher(WithClock(snapshotTestClock))
+	if err := restored.ReadSnapshot(&buf); err != nil {
+		t.Fatalf("ReadSnapshot() error = %v", err)
+	}
+	if !reflect.DeepEqual(d.Snapshot(), restored.Snapshot()) {
+		t.Fatalf("Snapshot() = %v, want %v", restored.Snapshot(), d.Snapshot())
+	}
+	for groupId := uint(1); groupId <= 6; groupId++ {
+		want, _, _ := d.Locate(groupId)
+		assertLocate(t, restored, groupId, want.Id)
+	}
+
+	// the restored dispatcher keeps working, a dropoff serves the waiting
+	// groups in the same order
+	d.Dropoff(3)
+	restored.Dropoff(3)
+	if !reflect.DeepEqual(d.Snapshot(), restored.Snapshot()) {
+		t.Fatalf("the restored dispatcher diverged after a dropoff")
+	}
+}
+
+func TestDispatcher_RestoreInvalidSnapshot(t *testing.T) {
+	tests := []struct {
+		name     string
+		snapshot string
+	}{
+		{"UnknownVersion", `{ "version": 2, "cars": [], "waiting": [] }`},
+		{"RepeatedCar", `{ "version": 1, "cars": [ { "id": 1, "seats": 4, "status": "in_service" }, { "id": 1, "seats": 4, "status": "in_service" } ] }`},
+		{"InvalidSeats", `{ "version": 1, "cars": [ { "id": 1, "seats": 9, "status": "in_service" } ] }`},
+		{"UnknownStatus", `{ "version": 1, "cars": [ { "id": 1, "seats": 4, "status": "broken" } ] }`},
+		{"TooManyPeople", `{ "version": 1, "cars": [ { "id": 1, "seats": 4, "status": "in_service", "groups": [ { "id": 1, "people": 3 }, { "id": 2, "people": 2 } ] } ] }`},
+		{"OutOfServiceWithGroups", `{ "version": 1, "cars": [ { "id": 1, "seats": 4, "status": "out_of_service", "groups": [ { "id": 1, "people": 3 } ] } ] }`},
+		{"RepeatedGroup", `{ "version": 1, "cars": [ { "id": 1, "seats": 4, "status": "in_service", "groups": [ { "id": 1, "people": 3 } ] } ], "waiting": [ { "id": 1, "people": 2 } ] }`},
+		{"InvalidJson", `{ "version": 1, `},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newSnapshotTestDispatcher()
+			before := d.Snapshot()
+			if err := d.ReadSnapshot(strings.NewReader(tt.snapshot)); err == nil {
+				t.Fatalf("ReadSnapshot() accepted an invalid snapshot")
+			}
+			if !reflect.DeepEqual(before, d.Snapshot()) {
+				t.Fatalf("an invalid snapshot changed the dispatcher")
+			}
+		})
+	}
+}
+
+func TestDispatcher_RestoreForgetsDropoffs(t *testing.T) {
+	now := snapshotTestClock()
+	d := NewDispatcher(WithClock(func() time.Time { return now }))
+	d.ResetCars([]Car{{1, 4}})
+	for groupId := uint(1); groupId <= 4; groupId++ {
+		d.RequestJourney(Group{groupId, 4})
+	}
+	// two dropoffs a minute apart give an estimate to the waiting groups
+	for groupId := uint(1); groupId <= 2; groupId++ {
+		now = now.Add(time.Minute)
+		d.Dropoff(groupId)
+	}
+	if journey, _ := d.Journey(4); journey.EstimatedWait == 0 {
+		t.Fatalf("(Expected) an estimated wait != %+v (Returned)", journey)
+	}
+	if err := d.Restore(d.Snapshot()); err != nil {
+		t.Fatal(err)
+	}
+	if journey, _ := d.Journey(4); journey.EstimatedWait != 0 {
+		t.Fatalf("(Expected) no estimated wait after the restore != %+v (Returned)", journey)
+	}
+}
+
+func TestDispatcher_SaveLoadSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dispatcher.json")
+	restored := NewDispatcher(WithClock(snapshotTestClock))
+	if err := restored.LoadSnapshot(path); err != nil {
+		t.Fatalf("LoadSnapshot() of a missing file error = %v", err)
+	}
+	d := newSnapshotTestDispatcher()
+	if err := d.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot() error = %v", err)
+	}
+	if err := restored.LoadSnapshot(path); err != nil {
+		t.Fatalf("LoadSnapshot() error = %v", err)
+	}
+	if !reflect.DeepEqual(d.Snapshot(), restored.Snapshot()) {
+		t.Fatalf("Snapshot() = %v, want %v", restored.Snapshot(), d.Snapshot())
+	}
+	if files, _ := filepath.Glob(path + ".tmp*"); len(files) != 0 {
+		t.Fatalf("temporary files were left behind: %v", files)
+	}
+}
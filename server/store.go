@@ -0,0 +1,286 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StoredCar is the record of a car in a Store
+type StoredCar struct {
+	Id     uint      `json:"id"`
+	Seats  uint      `json:"seats"`
+	Status CarStatus `json:"status"`
+}
+
+// StoredGroup is the record of a group in a Store. Order sorts the groups of
+// the same car by boarding, or the waiting groups by arrival
+type StoredGroup struct {
+	Id     uint `json:"id"`
+	People uint `json:"people"`
+	// Car is 0 while the group waits
+	Car   uint      `json:"car"`
+	Order int64     `json:"order"`
+	Since time.Time `json:"since,omitempty"`
+	Skips int       `json:"skips,omitempty"`
+}
+
+// StoreBatch is every write of one operation, a Store applies it at once.
+// With Reset every record is removed before the other writes
+type StoreBatch struct {
+	Reset         bool          `json:"reset,omitempty"`
+	Cars          []StoredCar   `json:"cars,omitempty"`
+	DeletedCars   []uint        `json:"deleted_cars,omitempty"`
+	Groups        []StoredGroup `json:"groups,omitempty"`
+	DeletedGroups []uint        `json:"deleted_groups,omitempty"`
+	LastOperation uint64        `json:"last_operation"`
+}
+
+// StoreState is every record of a Store, sorted by id
+type StoreState struct {
+	Cars          []StoredCar
+	Groups        []StoredGroup
+	LastOperation uint64
+}
+
+// Store keeps the records of the cars and the groups of a dispatcher. The
+// dispatcher writes every operation to the store as one batch when it
+// commits, and it reads the records of the cars and the groups from the
+// store. Its maps and indexes only serve the dispatch logic, the choice of the
+// cars and the waiting list, and they are rebuilt from the store on startup
+type Store interface {
+	Update(batch StoreBatch) error
+	Load() (StoreState, error)
+	// Car and Group return a record, false if it does not exist
+	Car(carId uint) (StoredCar, bool)
+	Group(groupId uint) (StoredGroup, bool)
+	Close() error
+}
+
+var storeNames = []string{"file", "memory"}
+
+// OpenStore opens the store with the given name, path, policy and interval
+// are only used by the file store. It is used to choose the store from the
+// configuration
+func OpenStore(name string, path string, policy SyncPolicy, interval time.Duration) (Store, error) {
+	switch name {
+	case "memory":
+		return NewMemoryStore(), nil
+	case "file":
+		if path == "" {
+			return nil, fmt.Errorf("the file store needs a path")
+		}
+		return OpenFileStore(path, policy, interval)
+	}
+	return nil, fmt.Errorf("unknown store %q, valid ones are %v", name, StoreNames())
+}
+
+func StoreNames() []string {
+	return append([]string{}, storeNames...)
+}
+
+// MemoryStore keeps the records in maps, nothing survives a restart. It is
+// the store of a dispatcher by default, and it holds the records of the
+// FileStore
+type MemoryStore struct {
+	mu            sync.Mutex
+	cars          map[uint]StoredCar
+	groups        map[uint]StoredGroup
+	lastOperation uint64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{cars: make(map[uint]StoredCar), groups: make(map[uint]StoredGroup)}
+}
+
+func (s *MemoryStore) Update(batch StoreBatch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if batch.Reset {
+		s.cars = make(map[uint]StoredCar)
+		s.groups = make(map[uint]StoredGroup)
+	}
+	for _, carId := range batch.DeletedCars {
+		delete(s.cars, carId)
+	}
+	for _, car := range batch.Cars {
+		s.cars[car.Id] = car
+	}
+	for _, groupId := range batch.DeletedGroups {
+		delete(s.groups, groupId)
+	}
+	for _, group := range batch.Groups {
+		s.groups[group.Id] = group
+	}
+	s.lastOperation = batch.LastOperation
+	return nil
+}
+
+func (s *MemoryStore) Load() (StoreState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := StoreState{Cars: []StoredCar{}, Groups: []StoredGroup{}, LastOperation: s.lastOperation}
+	for _, car := range s.cars {
+		state.Cars = append(state.Cars, car)
+	}
+	for _, group := range s.groups {
+		state.Groups = append(state.Groups, group)
+	}
+	sort.Slice(state.Cars, func(i, j int) bool { return state.Cars[i].Id < state.Cars[j].Id })
+	sort.Slice(state.Groups, func(i, j int) bool { return state.Groups[i].Id < state.Groups[j].Id })
+	return state, nil
+}
+
+func (s *MemoryStore) Car(carId uint) (StoredCar, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	car, ok := s.cars[carId]
+	return car, ok
+}
+
+func (s *MemoryStore) Group(groupId uint) (StoredGroup, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	group, ok := s.groups[groupId]
+	return group, ok
+}
+
+// records counts the cars and the groups
+func (s *MemoryStore) records() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.cars) + len(s.groups)
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// WithStore replaces the MemoryStore of the dispatcher. LoadStore restores
+// the state saved in it
+func WithStore(store Store) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.store = store
+	}
+}
+
+// writeToStore writes the cars and the groups touched by the changes of the
+// operation seq. A failed write is logged, the store keeps working with the
+// next operations
+func (d *Dispatcher) writeToStore(seq uint64, changes []Change) {
+	batch := StoreBatch{LastOperation: seq}
+	cars := map[uint]struct{}{}
+	groups := map[uint]struct{}{}
+	touchCarGroups := func(carId uint) {
+		for _, groupId := range d.carGroups[carId] {
+			groups[groupId] = struct{}{}
+		}
+	}
+	for _, change := range changes {
+		switch change.Kind {
+		case ChangeFleetReset:
+			batch.Reset = true
+		case ChangeCarAdded, ChangeCarUpdated, ChangeCarRemoved:
+			cars[change.Car] = struct{}{}
+		case ChangeGroupQueued, ChangeGroupAssigned:
+			groups[change.Group] = struct{}{}
+		case ChangeGroupUnseated, ChangeGroupDroppedOff:
+			groups[change.Group] = struct{}{}
+			// the groups that boarded later move forward in the car
+			touchCarGroups(change.Car)
+		}
+	}
+	// a seated group can add a skip to the first waiting group
+	if first := d.waitingGroups.head; first != nil {
+		groups[first.id] = struct{}{}
+	}
+	for carId := range cars {
+		if seats, ok := d.carsSize[carId]; ok {
+			batch.Cars = append(batch.Cars, StoredCar{carId, seats, d.carsStatus[carId]})
+		} else if !batch.Reset {
+			batch.DeletedCars = append(batch.DeletedCars, carId)
+		}
+	}
+	for groupId := range groups {
+		if group, ok := d.storedGroup(groupId); ok {
+			batch.Groups = append(batch.Groups, group)
+		} else if !batch.Reset {
+			batch.DeletedGroups = append(batch.DeletedGroups, groupId)
+		}
+	}
+	if err := d.store.Update(batch); err != nil {
+		log.Printf("writing operation %d to the store: %v", seq, err)
+	}
+}
+
+func (d *Dispatcher) storedGroup(groupId uint) (StoredGroup, bool) {
+	people, ok := d.groupsMap[groupId]
+	if !ok {
+		return StoredGroup{}, false
+	}
+	group := StoredGroup{Id: groupId, People: people, Car: d.journeysMap[groupId]}
+	if group.Car == 0 {
+		node := d.waitingGroups.groups[groupId]
+		group.Order, group.Since, group.Skips = node.arrival, node.since, node.skips
+		return group, true
+	}
+	for idx, boarded := range d.carGroups[group.Car] {
+		if boarded == groupId {
+			group.Order = int64(idx)
+		}
+	}
+	return group, true
+}
+
+// LoadStore restores the state saved in the store, then it rewrites the
+// store with the restored state
+func (d *Dispatcher) LoadStore() error {
+	state, err := d.store.Load()
+	if err != nil {
+		return err
+	}
+	snapshot := Snapshot{Version: SnapshotVersion, LastOperation: state.LastOperation, Cars: []SnapshotCar{}, Waiting: []SnapshotWaitingGroup{}}
+	carIdx := map[uint]int{}
+	for _, car := range state.Cars {
+		carIdx[car.Id] = len(snapshot.Cars)
+		snapshot.Cars = append(snapshot.Cars, SnapshotCar{car.Id, car.Seats, car.Status, []Group{}})
+	}
+	groups := append([]StoredGroup{}, state.Groups...)
+	sort.SliceStable(groups, func(i, j int) bool { return groups[i].Order < groups[j].Order })
+	for _, group := range groups {
+		if group.Car == 0 {
+			snapshot.Waiting = append(snapshot.Waiting, SnapshotWaitingGroup{group.Id, group.People, group.Since, group.Skips})
+			continue
+		}
+		idx, ok := carIdx[group.Car]
+		if !ok {
+			return fmt.Errorf("stored group %d is in the car %d that does not exist", group.Id, group.Car)
+		}
+		snapshot.Cars[idx].Groups = append(snapshot.Cars[idx].Groups, Group{group.Id, group.People})
+	}
+	// Restore rewrites the store, the restored waiting list numbers the
+	// arrivals again
+	return d.Restore(snapshot)
+}
+
+// SyncStore replaces every record of the store with the current state, it is
+// used after replaying a log
+func (d *Dispatcher) SyncStore() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.syncStore()
+}
+
+func (d *Dispatcher) syncStore() error {
+	batch := StoreBatch{Reset: true, LastOperation: d.seq}
+	for carId, seats := range d.carsSize {
+		batch.Cars = append(batch.Cars, StoredCar{carId, seats, d.carsStatus[carId]})
+	}
+	for groupId := range d.groupsMap {
+		group, _ := d.storedGroup(groupId)
+		batch.Groups = append(batch.Groups, group)
+	}
+	return d.store.Update(batch)
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// storeFactory opens a store and opens it again after closing it, the memory
+// store is opened again as the same store
+type storeFactory struct {
+	open   func(t *testing.T) Store
+	reopen func(t *testing.T, store Store) Store
+}
+
+var storeFactories = map[string]storeFactory{
+	"memory": {
+		open:   func(t *testing.T) Store { return NewMemoryStore() },
+		reopen: func(t *testing.T, store Store) Store { return store },
+	},
+	"file": {
+		open: func(t *testing.T) Store {
+			store, err := OpenFileStore(filepath.Join(t.TempDir(), "store.log"), SyncAlways, 0)
+			if err != nil {
+				t.Fatalf("OpenFileStore() error = %v", err)
+			}
+			return store
+		},
+		reopen: func(t *testing.T, store Store) Store {
+			path := store.(*FileStore).path
+			store.Close()
+			reopened, err := OpenFileStore(path, SyncAlways, 0)
+			if err != nil {
+				t.Fatalf("OpenFileStore() error = %v", err)
+			}
+			return reopened
+		},
+	},
+}
+
+// TestStoreConformance runs the same checks on every store
+func TestStoreConformance(t *testing.T) {
+	since := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		batches []StoreBatch
+		want    StoreState
+	}{
+		{"empty", nil, StoreState{Cars: []StoredCar{}, Groups: []StoredGroup{}}},
+		{"puts", []StoreBatch{{
+			Cars:          []StoredCar{{2, 4, CarInService}, {1, 6, CarPaused}},
+			Groups:        []StoredGroup{{Id: 3, People: 4, Car: 2}, {Id: 1, People: 6, Order: -1, Since: since, Skips: 2}},
+			LastOperation: 1,
+		}}, StoreState{
+			Cars:          []StoredCar{{1, 6, CarPaused}, {2, 4, CarInService}},
+			Groups:        []StoredGroup{{Id: 1, People: 6, Order: -1, Since: since, Skips: 2}, {Id: 3, People: 4, Car: 2}},
+			LastOperation: 1,
+		}},
+		{"overwrites and deletes", []StoreBatch{
+			{Cars: []StoredCar{{1, 6, CarInService}, {2, 4, CarInService}}, Groups: []StoredGroup{{Id: 1, People: 2, Car: 1}, {Id: 2, People: 3}}, LastOperation: 1},
+			{Cars: []StoredCar{{1, 5, CarOutOfService}}, DeletedCars: []uint{2}, Groups: []StoredGroup{{Id: 2, People: 3, Car: 1}}, DeletedGroups: []uint{1, 7}, LastOperation: 2},
+		}, StoreState{
+			Cars:          []StoredCar{{1, 5, CarOutOfService}},
+			Groups:        []StoredGroup{{Id: 2, People: 3, Car: 1}},
+			LastOperation: 2,
+		}},
+		{"reset", []StoreBatch{
+			{Cars: []StoredCar{{1, 6, CarInService}, {2, 4, CarInService}}, Groups: []StoredGroup{{Id: 1, People: 2, Car: 1}}, LastOperation: 4},
+			{Reset: true, Cars: []StoredCar{{3, 5, CarInService}}, LastOperation: 5},
+		}, StoreState{
+			Cars:          []StoredCar{{3, 5, CarInService}},
+			Groups:        []StoredGroup{},
+			LastOperation: 5,
+		}},
+	}
+	for name, factory := range storeFactories {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				store := factory.open(t)
+				for _, batch := range tt.batches {
+					if err := store.Update(batch); err != nil {
+						t.Fatalf("Update() error = %v", err)
+					}
+				}
+				for _, reopened := range []bool{false, true} {
+					if reopened {
+						store = factory.reopen(t, store)
+					}
+					got, err := store.Load()
+					if err != nil {
+						t.Fatalf("Load() error = %v", err)
+					}
+					if !reflect.DeepEqual(got, tt.want) {
+						t.Fatalf("Load() after reopening %v = %v, want %v", reopened, got, tt.want)
+					}
+				}
+				store.Close()
+			})
+		}
+	}
+}
+
+// TestStoreConformance_Dispatcher checks that a dispatcher restored from every
+// store has the state of the dispatcher that wrote it
+func TestStoreConformance_Dispatcher(t *testing.T) {
+	for name, factory := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			store := factory.open(t)
+			d := NewDispatcher(WithClock(snapshotTestClock), WithStore(store))
+			runLoggedOperations(d)
+			d.Dropoff(3)
+			d.SetCarStatus(1, CarPaused)
+
+			store = factory.reopen(t, store)
+			restored := NewDispatcher(WithClock(snapshotTestClock), WithStore(store))
+			if err := restored.LoadStore(); err != nil {
+				t.Fatalf("LoadStore() error = %v", err)
+			}
+			if !reflect.DeepEqual(d.Snapshot(), restored.Snapshot()) {
+				t.Fatalf("Snapshot() = %v, want %v", restored.Snapshot(), d.Snapshot())
+			}
+
+			// the restored dispatcher keeps writing to the store
+			d.store = NewMemoryStore()
+			d.SyncStore()
+			d.RequestJourney(Group{20, 2})
+			restored.RequestJourney(Group{20, 2})
+			store = factory.reopen(t, store)
+			again := NewDispatcher(WithClock(snapshotTestClock), WithStore(store))
+			if err := again.LoadStore(); err != nil {
+				t.Fatalf("LoadStore() error = %v", err)
+			}
+			if !reflect.DeepEqual(d.Snapshot(), again.Snapshot()) {
+				t.Fatalf("Snapshot() = %v, want %v", again.Snapshot(), d.Snapshot())
+			}
+			store.Close()
+		})
+	}
+}
+
+func TestFileStore_Compaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.log")
+	store, _ := OpenFileStore(path, SyncNever, 0)
+	for seq := uint64(1); seq <= 3*compactMinRecords; seq++ {
+		store.Update(StoreBatch{Cars: []StoredCar{{1, MinSeats + uint(seq%2), CarInService}}, LastOperation: seq})
+	}
+	// the goroutine of the store compacts the file, the batches written while
+	// it compacts are kept
+	written := func() int {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return store.written
+	}
+	for wait := 0; written() > 2*compactMinRecords && wait < 100; wait++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if written() > 2*compactMinRecords {
+		t.Fatalf("the store was not compacted, %d records written", written())
+	}
+	compacted := make(chan error)
+	go func() { compacted <- store.Compact() }()
+	for seq := uint64(1); seq <= 100; seq++ {
+		store.Update(StoreBatch{Cars: []StoredCar{{2, MinSeats, CarInService}}, LastOperation: 3*compactMinRecords + seq})
+	}
+	if err := <-compacted; err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	store.Close()
+	store, _ = OpenFileStore(path, SyncAlways, 0)
+	got, _ := store.Load()
+	want := StoreState{Cars: []StoredCar{{1, MinSeats, CarInService}, {2, MinSeats, CarInService}}, Groups: []StoredGroup{}, LastOperation: 3*compactMinRecords + 100}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Load() = %v, want %v", got, want)
+	}
+	store.Close()
+}
+
+func TestFileStore_TornAndCorruptedLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.log")
+	os.WriteFile(path, []byte(`{"cars":[{"id":1,"seats":4,"status":"in_service"}],"last_operation":1}
+{"cars":[{"id":2,"se`), 0644)
+	store, err := OpenFileStore(path, SyncAlways, 0)
+	if err != nil {
+		t.Fatalf("OpenFileStore() error = %v", err)
+	}
+	if got, _ := store.Load(); len(got.Cars) != 1 || got.LastOperation != 1 {
+		t.Fatalf("Load() = %v, want the first batch", got)
+	}
+	store.Close()
+
+	os.WriteFile(path, []byte("not json\n{\"last_operation\":1}\n"), 0644)
+	if _, err := OpenFileStore(path, SyncAlways, 0); err == nil {
+		t.Fatalf("OpenFileStore() should fail with a corrupted line")
+	}
+}
+
+func TestOpenStore(t *testing.T) {
+	for _, name := range StoreNames() {
+		store, err := OpenStore(name, filepath.Join(t.TempDir(), "store.log"), SyncAlways, 0)
+		if err != nil {
+			t.Fatalf("OpenStore(%q) error = %v", name, err)
+		}
+		if _, memory := store.(*MemoryStore); memory != (name == "memory") {
+			t.Fatalf("OpenStore(%q) = %T", name, store)
+		}
+		store.Close()
+	}
+	if _, err := OpenStore("postgres", "", SyncAlways, 0); err == nil {
+		t.Fatalf("OpenStore() should fail with an unknown name")
+	}
+	if _, err := OpenStore("file", "", SyncAlways, 0); err == nil {
+		t.Fatalf("OpenStore() should fail without a path")
+	}
+}
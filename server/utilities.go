@@ -1,150 +1,170 @@
 package server
 
-import (
-	"encoding/json"
-	"fmt"
-	"net/http"
-)
-
-func populateCarsList(w http.ResponseWriter, r *http.Request) error {
-	var carsArr []Car = []Car{}
-	err := json.NewDecoder(r.Body).Decode(&carsArr)
-	if err != nil {
-		return err
-	}
+func (d *Dispatcher) populateCarsList(carsArr []Car) error {
 	for _, car := range carsArr {
-		// To Do Add checking for unique ID
-		if _, ok := carsMap[car.Id]; ok {
-			//do something here
-			cleanJourneysAndCars()
-			err = fmt.Errorf("cars Ids must be unique")
-			return err
-		}
-		carsMap[car.Id] = car.Seats
-		carsSize[car.Id] = car.Seats
-		if capacitiesMap[car.Seats] == nil {
-			capacitiesMap[car.Seats] = make(map[uint]struct{})
+		if _, ok := d.carsMap[car.Id]; ok {
+			d.cleanJourneysAndCars()
+			return ErrCarIdRepeated
 		}
-		capacitiesMap[car.Seats][car.Id] = struct{}{}
+		d.addCar(car)
 	}
 	return nil
 }
 
-func cleanJourneysAndCars() {
-	for k := range carsMap {
-		delete(carsMap, k)
-		delete(carsSize, k)
+func (d *Dispatcher) cleanJourneysAndCars() {
+	d.record(Change{Kind: ChangeFleetReset})
+	for k := range d.carsMap {
+		delete(d.carsMap, k)
+		delete(d.carsSize, k)
+		delete(d.carsStatus, k)
 	}
-	for k := range capacitiesMap {
-		delete(capacitiesMap, k)
+	for k := range d.capacitiesMap {
+		delete(d.capacitiesMap, k)
 	}
-	for k := range groupsMap {
-		delete(groupsMap, k)
+	for seats := range d.capacitiesBySize {
+		d.capacitiesBySize[seats] = make(capacityIndex)
 	}
-	for k := range journeysMap {
-		delete(journeysMap, k)
+	d.lists = newListIndex()
+	// the dropoffs of the old journeys do not tell how fast the new ones end
+	d.dropoffs = dropoffRate{}
+	for k := range d.groupsMap {
+		delete(d.groupsMap, k)
 	}
-	waitingGroups = []uint{}
-}
-
-func searchValidCapacity(people uint) uint {
-	var validCars = capacitiesMap[people]
-	if len(validCars) != 0 {
-		return people
-	} else {
-		for freeCap := range capacitiesMap {
-			if freeCap > people && len(capacitiesMap[freeCap]) > 0 {
-				return freeCap
-			}
-		}
+	for k := range d.journeysMap {
+		delete(d.journeysMap, k)
+	}
+	for k := range d.carGroups {
+		delete(d.carGroups, k)
 	}
-	return 0
+	d.waitingGroups = newWaitingList()
 }
 
-func addNewGroup(group Group) int {
-	// To Do Add checking for unique ID
-	groupsMap[group.Id] = group.People
-	availableCarSize := searchValidCapacity(group.People)
-	if availableCarSize == 0 {
-		journeysMap[group.Id] = 0
-		waitingGroups = append(waitingGroups, group.Id)
-		return http.StatusAccepted
-	}
-	for firstCarId := range capacitiesMap[availableCarSize] {
-		assignCar(firstCarId, group)
-		delete(capacitiesMap[availableCarSize], firstCarId)
-		break
+func (d *Dispatcher) addNewGroup(group Group) bool {
+	d.groupsMap[group.Id] = group.People
+	chosenCarId := d.selector.SelectCar(d.availableCars(), group.People)
+	if chosenCarId == 0 {
+		d.record(Change{Kind: ChangeGroupQueued, Group: group.Id, People: group.People})
+		d.journeysMap[group.Id] = 0
+		d.waitingGroups.pushBack(group.Id, group.People, d.now())
+		return false
 	}
-	return http.StatusOK
+	d.skipFirstWaitingGroup(group.Id)
+	d.assignCar(chosenCarId, group)
+	d.assignedOnArrival++
+	return true
 }
 
-func assignCar(chosenCarID uint, group Group) {
-	newFreeCap := carsMap[chosenCarID] - group.People
-	carsMap[chosenCarID] = carsMap[chosenCarID] - group.People
-	if capacitiesMap[newFreeCap] == nil {
-		capacitiesMap[newFreeCap] = make(map[uint]struct{})
-	}
-	capacitiesMap[newFreeCap][chosenCarID] = struct{}{}
-	journeysMap[group.Id] = chosenCarID
+func (d *Dispatcher) assignCar(chosenCarID uint, group Group) {
+	// a waiting group is already in journeysMap without car
+	_, waited := d.journeysMap[group.Id]
+	d.record(Change{Kind: ChangeGroupAssigned, Group: group.Id, People: group.People, Car: chosenCarID, Waited: waited})
+	d.unindexCar(chosenCarID, d.carsMap[chosenCarID])
+	newFreeCap := d.carsMap[chosenCarID] - group.People
+	d.carsMap[chosenCarID] = newFreeCap
+	d.indexCar(chosenCarID, newFreeCap)
+	d.journeysMap[group.Id] = chosenCarID
+	d.carGroups[chosenCarID] = append(d.carGroups[chosenCarID], group.Id)
+	d.lists.board(chosenCarID, group.Id, group.People)
 }
 
-func checkOrDeleteGroupWithoutCar(groupId uint, w http.ResponseWriter) bool {
-	if _, exists := groupsMap[groupId]; !exists {
-		w.WriteHeader(http.StatusNotFound)
-		return true
-	}
-	if journeysMap[groupId] == 0 {
-		delete(journeysMap, groupId)
-		delete(groupsMap, groupId)
-		found := false
-		if len(waitingGroups) != 0 {
-			if len(waitingGroups) == 1 {
-				if waitingGroups[0] == groupId {
-					waitingGroups = waitingGroups[:0]
-				}
-			} else {
-				for idx := 0; idx < len(waitingGroups) && !found; idx++ {
-					if waitingGroups[idx] == groupId {
-						waitingGroups = append(waitingGroups[:idx], waitingGroups[idx+1:]...)
-						found = true
-					}
-				}
-			}
-		}
-		w.WriteHeader(http.StatusNoContent)
-		return true
-	}
-	return false
+func (d *Dispatcher) deleteGroupWithoutCar(groupId uint) {
+	d.record(Change{Kind: ChangeGroupDroppedOff, Group: groupId, People: d.groupsMap[groupId]})
+	delete(d.journeysMap, groupId)
+	delete(d.groupsMap, groupId)
+	d.waitingGroups.remove(groupId)
 }
 
-func removeGroup(groupId uint) (uint, uint) {
-	// We won't update the waiting list, since it is a expensive operation untill
-	// we assign a new group
-	carId := journeysMap[groupId]
-	delete(journeysMap, groupId)
+func (d *Dispatcher) removeGroup(groupId uint) (uint, uint) {
+	carId := d.journeysMap[groupId]
+	delete(d.journeysMap, groupId)
+	d.leaveCar(carId, groupId)
 
-	currCarSeats := carsMap[carId]
-	delete(capacitiesMap[currCarSeats], carId)
+	currCarSeats := d.carsMap[carId]
+	d.unindexCar(carId, currCarSeats)
 
-	carsMap[carId] = carsMap[carId] + groupsMap[groupId]
+	d.carsMap[carId] = d.carsMap[carId] + d.groupsMap[groupId]
 
-	newFreeSeats := carsMap[carId]
-	capacitiesMap[newFreeSeats][carId] = struct{}{}
+	newFreeSeats := d.carsMap[carId]
+	d.indexCar(carId, newFreeSeats)
 
-	delete(groupsMap, groupId)
+	d.record(Change{Kind: ChangeGroupDroppedOff, Group: groupId, People: d.groupsMap[groupId], Car: carId, Seats: newFreeSeats})
+	delete(d.groupsMap, groupId)
 	return carId, newFreeSeats
 }
 
-func tryAssignWaitingGroupsToCar(carId uint, newFreeSeats uint) {
-	for idx := 0; idx < len(waitingGroups) && newFreeSeats > 0; idx++ {
-		groupId := waitingGroups[idx]
-		//check for dropped groups
-		if groupsMap[groupId] <= newFreeSeats {
-			assignCar(carId, Group{groupId, groupsMap[groupId]})
-			waitingGroups = append(waitingGroups[:idx], waitingGroups[idx+1:]...)
-			newFreeSeats -= groupsMap[groupId]
+// tryAssignWaitingGroupsToCar seats the waiting groups in arrival order, a
+// group that does not fit is skipped unless the fairness policy reserves the
+// seats for the first waiting group
+func (d *Dispatcher) tryAssignWaitingGroupsToCar(carId uint, newFreeSeats uint) {
+	if d.carsStatus[carId] != CarInService {
+		return
+	}
+	servedBlockingGroup := false
+	for newFreeSeats > 0 {
+		next := d.waitingGroups.earliestFitting(newFreeSeats)
+		if next == nil {
+			break
+		}
+		blocking := d.blockingGroup()
+		if blocking != nil && blocking != next && d.seatsReservedFor(blocking, carId) {
+			break
+		}
+		servedBlockingGroup = servedBlockingGroup || blocking == next
+		d.skipFirstWaitingGroup(next.id)
+		d.waitingGroups.remove(next.id)
+		d.assignCar(carId, Group{next.id, next.people})
+		d.assignedFromWaiting++
+		newFreeSeats -= next.people
+	}
+	if servedBlockingGroup {
+		d.serveWaitingGroups()
+	}
+}
+
+// unseatGroup takes the group out of its car and frees its seats, the group
+// is left without car and it is not added to the waiting list
+func (d *Dispatcher) unseatGroup(carId uint, groupId uint) {
+	d.record(Change{Kind: ChangeGroupUnseated, Group: groupId, Car: carId})
+	d.leaveCar(carId, groupId)
+	d.journeysMap[groupId] = 0
+	d.unindexCar(carId, d.carsMap[carId])
+	d.carsMap[carId] += d.groupsMap[groupId]
+	d.indexCar(carId, d.carsMap[carId])
+}
+
+// leaveCar removes the group from the passengers of the car, a car has a few
+// groups so a linear search is enough
+func (d *Dispatcher) leaveCar(carId uint, groupId uint) {
+	groups := d.carGroups[carId]
+	for idx, travelling := range groups {
+		if travelling == groupId {
+			groups = append(groups[:idx], groups[idx+1:]...)
+			break
 		}
 	}
+	d.lists.leave(carId, groupId, d.groupsMap[groupId], groups, d.groupsMap)
+	if len(groups) == 0 {
+		delete(d.carGroups, carId)
+		return
+	}
+	d.carGroups[carId] = groups
+}
+
+// indexCar lists the car and makes it available for new groups, unless it is
+// not in service
+func (d *Dispatcher) indexCar(carId uint, freeSeats uint) {
+	d.lists.addCar(carListKey{d.carsStatus[carId], d.carsSize[carId], freeSeats}, carId)
+	if d.carsStatus[carId] != CarInService {
+		return
+	}
+	d.capacitiesMap.add(freeSeats, carId)
+	d.capacitiesBySize[d.carsSize[carId]].add(freeSeats, carId)
+}
+
+func (d *Dispatcher) unindexCar(carId uint, freeSeats uint) {
+	d.lists.removeCar(carListKey{d.carsStatus[carId], d.carsSize[carId], freeSeats}, carId)
+	d.capacitiesMap.remove(freeSeats, carId)
+	d.capacitiesBySize[d.carsSize[carId]].remove(freeSeats, carId)
 }
 
 /*
@@ -0,0 +1,38 @@
+package server
+
+import "time"
+
+// dropoffRateWeight is the weight of the newest interval in the average
+const dropoffRateWeight = 0.2
+
+// dropoffRate keeps an exponential moving average of the time between the
+// dropoffs of travelling groups, every dropoff frees seats that the waiting
+// groups can take
+type dropoffRate struct {
+	last     time.Time
+	interval time.Duration
+	samples  int
+}
+
+func (r *dropoffRate) observe(at time.Time) {
+	if !r.last.IsZero() && at.After(r.last) {
+		elapsed := at.Sub(r.last)
+		if r.samples == 0 {
+			r.interval = elapsed
+		} else {
+			r.interval += time.Duration(dropoffRateWeight * float64(elapsed-r.interval))
+		}
+		r.samples++
+	}
+	r.last = at
+}
+
+// estimate returns the expected wait of the group at the given position of
+// the waiting list, assuming a dropoff serves a group. It returns false until
+// two dropoffs were seen
+func (r *dropoffRate) estimate(position int) (time.Duration, bool) {
+	if r.samples == 0 || position <= 0 {
+		return 0, false
+	}
+	return time.Duration(position) * r.interval, true
+}
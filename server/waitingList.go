@@ -0,0 +1,205 @@
+package server
+
+import "time"
+
+// waitingGroup is a node of the waiting list, it is linked at the same time
+// in the arrival order list and in the list of the groups of its size
+type waitingGroup struct {
+	id     uint
+	people uint
+	// arrival orders the group in the list, it does not change while the
+	// group waits so it is the key of the cursors and of the store
+	arrival int64
+	// rank and sizeRank are the keys of the group in the ranks of the list and
+	// of the queue of its size
+	rank, sizeRank int64
+	since          time.Time
+	// skips counts the groups seated while this one was the first
+	skips int
+
+	prev, next         *waitingGroup
+	prevSize, nextSize *waitingGroup
+}
+
+type waitingQueue struct {
+	head, tail *waitingGroup
+	ranks      rankIndex
+}
+
+// waitingList keeps the groups without car. Every group is in a FIFO with the
+// groups of the same size and in a list with all the groups by arrival order,
+// so a group is removed in O(1) and the earliest group that fits in a car is
+// found looking only at the head of MaxPeople queues
+type waitingList struct {
+	groups     map[uint]*waitingGroup
+	head, tail *waitingGroup
+	bySize     [MaxPeople + 1]waitingQueue
+	// ranks gives the positions in the list
+	ranks rankIndex
+	// firstArrival and nextArrival are the arrivals of the groups pushed to
+	// the front and to the back, they start again when the list is empty
+	firstArrival, nextArrival int64
+}
+
+func newWaitingList() *waitingList {
+	return &waitingList{groups: make(map[uint]*waitingGroup)}
+}
+
+func (l *waitingList) len() int {
+	return len(l.groups)
+}
+
+func (l *waitingList) contains(groupId uint) bool {
+	_, ok := l.groups[groupId]
+	return ok
+}
+
+// pushBack adds the group at the end of the list
+func (l *waitingList) pushBack(groupId uint, people uint, since time.Time) {
+	node := &waitingGroup{id: groupId, people: people, arrival: l.nextArrival, rank: l.ranks.pushBack(), since: since}
+	l.nextArrival++
+	l.groups[groupId] = node
+
+	node.prev = l.tail
+	if l.tail != nil {
+		l.tail.next = node
+	} else {
+		l.head = node
+	}
+	l.tail = node
+
+	queue := &l.bySize[people]
+	node.sizeRank = queue.ranks.pushBack()
+	node.prevSize = queue.tail
+	if queue.tail != nil {
+		queue.tail.nextSize = node
+	} else {
+		queue.head = node
+	}
+	queue.tail = node
+	l.compact(queue)
+}
+
+// pushFront adds the group at the start of the list, as if it arrived
+// before every waiting group
+func (l *waitingList) pushFront(groupId uint, people uint, since time.Time) {
+	l.firstArrival--
+	node := &waitingGroup{id: groupId, people: people, arrival: l.firstArrival, rank: l.ranks.pushFront(), since: since}
+	l.groups[groupId] = node
+
+	node.next = l.head
+	if l.head != nil {
+		l.head.prev = node
+	} else {
+		l.tail = node
+	}
+	l.head = node
+
+	queue := &l.bySize[people]
+	node.sizeRank = queue.ranks.pushFront()
+	node.nextSize = queue.head
+	if queue.head != nil {
+		queue.head.prevSize = node
+	} else {
+		queue.tail = node
+	}
+	queue.head = node
+	l.compact(queue)
+}
+
+// remove takes the group out of the list, it returns false if the group was
+// not waiting
+func (l *waitingList) remove(groupId uint) bool {
+	node, ok := l.groups[groupId]
+	if !ok {
+		return false
+	}
+	delete(l.groups, groupId)
+	l.ranks.remove(node.rank)
+	if len(l.groups) == 0 {
+		l.firstArrival, l.nextArrival = 0, 0
+	}
+
+	if node.prev != nil {
+		node.prev.next = node.next
+	} else {
+		l.head = node.next
+	}
+	if node.next != nil {
+		node.next.prev = node.prev
+	} else {
+		l.tail = node.prev
+	}
+
+	queue := &l.bySize[node.people]
+	queue.ranks.remove(node.sizeRank)
+	if node.prevSize != nil {
+		node.prevSize.nextSize = node.nextSize
+	} else {
+		queue.head = node.nextSize
+	}
+	if node.nextSize != nil {
+		node.nextSize.prevSize = node.prevSize
+	} else {
+		queue.tail = node.prevSize
+	}
+	node.prev, node.next, node.prevSize, node.nextSize = nil, nil, nil, nil
+	l.compact(queue)
+	return true
+}
+
+// compact renumbers the ranks of the list or of the queue once most of their
+// slots belong to groups that left, so the ranks do not grow with every group
+// that ever waited. It takes O(n) once every n changes at least, the arrivals
+// are not changed
+func (l *waitingList) compact(queue *waitingQueue) {
+	if l.ranks.sparse() {
+		l.ranks.renumber()
+		key := int64(0)
+		for node := l.head; node != nil; node = node.next {
+			node.rank = key
+			key++
+		}
+	}
+	if queue.ranks.sparse() {
+		queue.ranks.renumber()
+		key := int64(0)
+		for node := queue.head; node != nil; node = node.nextSize {
+			node.sizeRank = key
+			key++
+		}
+	}
+}
+
+// position returns the place of the group in the list and among the groups
+// of its size, starting at 1. It returns false if the group is not waiting
+func (l *waitingList) position(groupId uint) (int, int, bool) {
+	node, ok := l.groups[groupId]
+	if !ok {
+		return 0, 0, false
+	}
+	queue := &l.bySize[node.people]
+	return l.ranks.before(node.rank) + 1, queue.ranks.before(node.sizeRank) + 1, true
+}
+
+// earliestFitting returns the group that arrived first among the groups with
+// at most freeSeats people, or nil if there is none
+func (l *waitingList) earliestFitting(freeSeats uint) *waitingGroup {
+	var earliest *waitingGroup
+	for people := MinPeople; people <= freeSeats && people <= MaxPeople; people++ {
+		candidate := l.bySize[people].head
+		if candidate != nil && (earliest == nil || candidate.arrival < earliest.arrival) {
+			earliest = candidate
+		}
+	}
+	return earliest
+}
+
+// each calls fn for every group in arrival order until fn returns false
+func (l *waitingList) each(fn func(group *waitingGroup) bool) {
+	for node := l.head; node != nil; node = node.next {
+		if !fn(node) {
+			return
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func Test_waitingList(t *testing.T) {
+	l := newWaitingList()
+	arrivals := []Group{{1, 6}, {2, 2}, {3, 4}, {4, 2}, {5, 1}, {6, 6}}
+	for _, group := range arrivals {
+		l.pushBack(group.Id, group.People, time.Time{})
+	}
+	if l.len() != len(arrivals) || !l.contains(4) || l.contains(7) {
+		t.Fatalf("len() = %d, the groups were not added", l.len())
+	}
+	tests := []struct {
+		name      string
+		freeSeats uint
+		want      uint
+	}{
+		{"NoSeats", 0, 0},
+		{"OnlyTheGroupOf1Fits", 1, 5},
+		{"EarliestSmallGroup", 3, 2},
+		{"EarliestBeforeSmaller", 4, 2},
+		{"EarliestGroup", 6, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := l.earliestFitting(tt.freeSeats)
+			if (got == nil && tt.want != 0) || (got != nil && got.id != tt.want) {
+				t.Fatalf("earliestFitting(%d) = %v, want group %d", tt.freeSeats, got, tt.want)
+			}
+		})
+	}
+
+	if !l.remove(1) || !l.remove(4) || !l.remove(6) || l.remove(6) {
+		t.Fatalf("remove() did not remove every group once")
+	}
+	if got := l.earliestFitting(6); got.id != 2 {
+		t.Fatalf("earliestFitting(6) = %d after removing the head, want 2", got.id)
+	}
+	order := []uint{}
+	l.each(func(group *waitingGroup) bool {
+		order = append(order, group.id)
+		return true
+	})
+	if len(order) != 3 || order[0] != 2 || order[1] != 3 || order[2] != 5 {
+		t.Fatalf("each() = %v, want [2 3 5]", order)
+	}
+	for _, groupId := range order {
+		l.remove(groupId)
+	}
+	if l.head != nil || l.tail != nil || l.earliestFitting(MaxSeats) != nil {
+		t.Fatalf("the list is not empty after removing every group")
+	}
+}
+
+func Test_waitingListPushFront(t *testing.T) {
+	l := newWaitingList()
+	l.pushBack(1, 2, time.Time{})
+	l.pushFront(2, 2, time.Time{})
+	l.pushFront(3, 4, time.Time{})
+	order := []uint{}
+	l.each(func(group *waitingGroup) bool {
+		order = append(order, group.id)
+		return true
+	})
+	if len(order) != 3 || order[0] != 3 || order[1] != 2 || order[2] != 1 {
+		t.Fatalf("each() = %v, want [3 2 1]", order)
+	}
+	if got := l.earliestFitting(6); got.id != 3 {
+		t.Fatalf("earliestFitting(6) = %d, want 3", got.id)
+	}
+	if got := l.earliestFitting(2); got.id != 2 {
+		t.Fatalf("earliestFitting(2) = %d, want 2", got.id)
+	}
+}
+
+func Test_waitingListPosition(t *testing.T) {
+	l := newWaitingList()
+	for groupId := uint(1); groupId <= 20; groupId++ {
+		l.pushBack(groupId, 2, time.Time{})
+	}
+	l.pushFront(21, 2, time.Time{})
+	l.pushFront(22, 2, time.Time{})
+	for groupId := uint(2); groupId <= 20; groupId += 2 {
+		l.remove(groupId)
+	}
+	l.remove(21)
+	l.pushBack(23, 4, time.Time{})
+	// the list is 22 1 3 5 ... 19 23, only 23 has 4 people
+	expected := []uint{22, 1, 3, 5, 7, 9, 11, 13, 15, 17, 19}
+	for idx, groupId := range expected {
+		if position, sizePosition, ok := l.position(groupId); !ok || position != idx+1 || sizePosition != idx+1 {
+			t.Fatalf("position(%d): (Expected) %d != %d %d (Returned)", groupId, idx+1, position, sizePosition)
+		}
+	}
+	if position, sizePosition, _ := l.position(23); position != 12 || sizePosition != 1 {
+		t.Fatalf("position(23): (Expected) 12 1 != %d %d (Returned)", position, sizePosition)
+	}
+	l.remove(23)
+	if _, _, ok := l.position(2); ok {
+		t.Fatalf("position(2) should fail after removing the group")
+	}
+	for _, groupId := range expected {
+		l.remove(groupId)
+	}
+	l.pushBack(30, 2, time.Time{})
+	if position, _, _ := l.position(30); position != 1 || l.groups[30].arrival != 0 {
+		t.Fatalf("the arrivals are not restarted when the list is empty")
+	}
+}
+
+// Test_waitingListCompact serves the first group and queues a new one many
+// times, the ranks must keep the size of the list
+func Test_waitingListCompact(t *testing.T) {
+	l := newWaitingList()
+	rnd := rand.New(rand.NewSource(1))
+	live := []uint{}
+	for groupId := uint(1); groupId <= 10000; groupId++ {
+		if groupId%7 == 0 {
+			l.pushFront(groupId, uint(rnd.Intn(int(MaxPeople))+1), time.Time{})
+			live = append([]uint{groupId}, live...)
+		} else {
+			l.pushBack(groupId, uint(rnd.Intn(int(MaxPeople))+1), time.Time{})
+			live = append(live, groupId)
+		}
+		if len(live) > 20 {
+			l.remove(live[0])
+			live = live[1:]
+		}
+	}
+	slots := len(l.ranks.front.tree) + len(l.ranks.back.tree)
+	if slots > 2*len(live)+minRankSlots {
+		t.Fatalf("(Expected) at most %d != %d (Returned) slots", 2*len(live)+minRankSlots, slots)
+	}
+	sizePositions := map[uint]int{}
+	for idx, groupId := range live {
+		node := l.groups[groupId]
+		sizePositions[node.people]++
+		position, sizePosition, ok := l.position(groupId)
+		if !ok || position != idx+1 || sizePosition != sizePositions[node.people] {
+			t.Fatalf("position(%d): (Expected) %d %d != %d %d (Returned)", groupId, idx+1, sizePositions[node.people], position, sizePosition)
+		}
+		if idx > 0 && l.groups[live[idx-1]].arrival >= node.arrival {
+			t.Fatalf("the arrivals of %d and %d are not in order", live[idx-1], groupId)
+		}
+	}
+}
+
+const benchmarkWaitingGroups = 150000
+
+func newBenchmarkWaitingList() *waitingList {
+	l := newWaitingList()
+	rnd := rand.New(rand.NewSource(1))
+	for groupId := uint(0); groupId < benchmarkWaitingGroups; groupId++ {
+		l.pushBack(groupId, uint(rnd.Intn(int(MaxPeople))+1), time.Time{})
+	}
+	return l
+}
+
+func BenchmarkWaitingList_Remove(b *testing.B) {
+	l := newBenchmarkWaitingList()
+	rnd := rand.New(rand.NewSource(2))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		groupId := uint(rnd.Intn(benchmarkWaitingGroups))
+		if l.contains(groupId) {
+			people := l.groups[groupId].people
+			l.remove(groupId)
+			l.pushBack(groupId, people, time.Time{})
+		}
+	}
+}
+
+func BenchmarkWaitingList_EarliestFitting(b *testing.B) {
+	l := newBenchmarkWaitingList()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.earliestFitting(uint(i%int(MaxSeats)) + 1)
+	}
+}
+
+// Every dropoff frees 4 seats while 10^5 groups of 5 and 6 people are waiting,
+// none of them fits, so the old slice had to be scanned completely each time
+func BenchmarkDispatcher_DropoffWithWaitingGroups(b *testing.B) {
+	const cars = 1000
+	d := NewDispatcher()
+	fleet := make([]Car, 0, cars)
+	for carId := uint(1); carId <= cars; carId++ {
+		fleet = append(fleet, Car{carId, 4})
+	}
+	d.ResetCars(fleet)
+	travelling := make([]uint, 0, cars)
+	for groupId := uint(1); groupId <= cars; groupId++ {
+		d.RequestJourney(Group{groupId, 4})
+		travelling = append(travelling, groupId)
+	}
+	for groupId := uint(cars + 1); groupId <= cars+benchmarkWaitingGroups; groupId++ {
+		d.RequestJourney(Group{groupId, 5 + groupId%2})
+	}
+	nextGroupId := uint(cars + benchmarkWaitingGroups + 1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.Dropoff(travelling[i%cars])
+		d.RequestJourney(Group{nextGroupId, 4})
+		travelling[i%cars] = nextGroupId
+		nextGroupId++
+	}
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrLogGap = errors.New("the log is missing operations")
+
+// SyncPolicy decides when the log is flushed to the disk. Every operation is
+// written to the file before the request is answered, so a crash of the
+// process loses nothing, the policy only matters when the machine crashes
+type SyncPolicy int
+
+const (
+	// SyncAlways flushes the file after every operation, nothing is lost
+	SyncAlways SyncPolicy = iota
+	// SyncInterval flushes the file periodically, the operations of the last
+	// interval may be lost
+	SyncInterval
+	// SyncNever leaves the flushes to the operating system
+	SyncNever
+)
+
+var syncPolicies = map[string]SyncPolicy{
+	"always":   SyncAlways,
+	"interval": SyncInterval,
+	"never":    SyncNever,
+}
+
+// SyncPolicyByName returns the policy with the given name, it is used to
+// choose the policy from the configuration
+func SyncPolicyByName(name string) (SyncPolicy, error) {
+	policy, ok := syncPolicies[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown log sync policy %q, valid ones are %v", name, SyncPolicyNames())
+	}
+	return policy, nil
+}
+
+func SyncPolicyNames() []string {
+	names := make([]string, 0, len(syncPolicies))
+	for name := range syncPolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WriteAheadLog appends every operation of a dispatcher to a file as a json
+// line. Its Observe method is registered with WithObserver
+type WriteAheadLog struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	policy SyncPolicy
+	dirty  bool
+	// err is the first write error, the log stops writing after it because
+	// a log with a hole can not be replayed
+	err  error
+	stop chan struct{}
+	done chan struct{}
+}
+
+// OpenWriteAheadLog opens the log at path to append to it, creating it if it
+// does not exist. A line cut by a crash at the end of the file is removed.
+// The interval is only used by SyncInterval
+func OpenWriteAheadLog(path string, policy SyncPolicy, interval time.Duration) (*WriteAheadLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := truncateTornLine(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		file.Close()
+		return nil, err
+	}
+	w := &WriteAheadLog{path: path, file: file, policy: policy}
+	if policy == SyncInterval {
+		w.stop = make(chan struct{})
+		w.done = make(chan struct{})
+		go w.syncEvery(interval)
+	}
+	return w, nil
+}
+
+// truncateTornLine cuts the file after its last new line
+func truncateTornLine(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	end := info.Size()
+	chunk := make([]byte, 4096)
+	for end > 0 {
+		start := end - int64(len(chunk))
+		if start < 0 {
+			start = 0
+		}
+		n, err := file.ReadAt(chunk[:end-start], start)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if idx := bytes.LastIndexByte(chunk[:n], '\n'); idx >= 0 {
+			end = start + int64(idx) + 1
+			break
+		}
+		end = start
+	}
+	if end == info.Size() {
+		return nil
+	}
+	return file.Truncate(end)
+}
+
+// Observe appends the operation to the log
+func (w *WriteAheadLog) Observe(op Operation) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return
+	}
+	line, err := json.Marshal(op)
+	if err == nil {
+		_, err = w.file.Write(append(line, '\n'))
+	}
+	if err == nil && w.policy == SyncAlways {
+		err = w.file.Sync()
+	}
+	w.dirty = true
+	if err != nil {
+		w.err = err
+		log.Printf("write-ahead log %s stopped at operation %d: %v", w.path, op.Seq, err)
+	}
+}
+
+// Err returns the error that stopped the log, if any
+func (w *WriteAheadLog) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+func (w *WriteAheadLog) syncEvery(interval time.Duration) {
+	defer close(w.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Sync()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// Sync flushes the operations written since the last flush to the disk
+func (w *WriteAheadLog) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	return w.file.Sync()
+}
+
+// Close flushes the log and closes the file
+func (w *WriteAheadLog) Close() error {
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.file.Sync()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Compact removes the operations up to the sequence number upTo, they are
+// already included in a saved snapshot. The kept operations are copied to a
+// temporary file that replaces the log
+func (w *WriteAheadLog) Compact(upTo uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(w.path), filepath.Base(w.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = copyOperationsAfter(w.path, upTo, tmp); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), w.path); err != nil {
+		return err
+	}
+	w.file.Close()
+	w.dirty = false
+	w.file, err = os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		w.err = err
+	}
+	return err
+}
+
+func copyOperationsAfter(path string, upTo uint64, w io.Writer) error {
+	return readOperations(path, func(seq uint64, line []byte) error {
+		if seq <= upTo {
+			return nil
+		}
+		_, err := w.Write(line)
+		return err
+	})
+}
+
+// readOperations calls fn with the sequence number and the json line of every
+// operation of the log. A line without its new line is the last one and it
+// was cut by a crash, it is ignored. Any other line that is not valid is an
+// error
+func readOperations(path string, fn func(seq uint64, line []byte) error) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		op := struct {
+			Seq uint64 `json:"seq"`
+		}{}
+		if err := json.Unmarshal(line, &op); err != nil || op.Seq == 0 {
+			return fmt.Errorf("log %s is corrupted at line %d", path, lineNumber)
+		}
+		if err := fn(op.Seq, line); err != nil {
+			return err
+		}
+	}
+}
+
+// ReplayLog applies the operations of the log at path that are newer than
+// the state, usually restored from a snapshot first. It returns how many
+// operations were applied, a missing log is not an error
+func (d *Dispatcher) ReplayLog(path string) (int, error) {
+	applied := 0
+	err := readOperations(path, func(seq uint64, line []byte) error {
+		last := d.LastOperation()
+		if seq <= last {
+			return nil
+		}
+		if seq != last+1 {
+			return fmt.Errorf("%w: operation %d follows %d", ErrLogGap, seq, last)
+		}
+		op := Operation{}
+		if err := json.Unmarshal(line, &op); err != nil {
+			return fmt.Errorf("log %s operation %d: %v", path, seq, err)
+		}
+		d.Apply(op)
+		applied++
+		return nil
+	})
+	return applied, err
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func openTestLog(t *testing.T, path string) *WriteAheadLog {
+	t.Helper()
+	wal, err := OpenWriteAheadLog(path, SyncAlways, 0)
+	if err != nil {
+		t.Fatalf("OpenWriteAheadLog() error = %v", err)
+	}
+	return wal
+}
+
+// runLoggedOperations changes the state in every possible way, the groups are
+// seated, queued, unseated and requeued
+func runLoggedOperations(d *Dispatcher) {
+	d.ResetCars([]Car{{1, 6}, {2, 4}, {3, 5}})
+	for groupId := uint(1); groupId <= 8; groupId++ {
+		d.RequestJourney(Group{groupId, groupId%MaxPeople + 1})
+	}
+	d.Dropoff(2)
+	d.SetCarStatus(3, CarOutOfService)
+	d.AddCar(Car{4, 6})
+	d.UpdateCar(Car{1, 4})
+	d.RemoveCar(2)
+	d.Dropoff(7)
+	d.SetCarStatus(3, CarInService)
+	d.ReconcileCars([]Car{{1, 5}, {3, 6}, {5, 4}})
+}
+
+func TestWriteAheadLog_Replay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	wal := openTestLog(t, path)
+	// the random strategy shows that the replay does not choose the cars again
+	d := NewDispatcher(WithClock(snapshotTestClock), WithCarSelector(NewRandomFit(rand.NewSource(7))), WithObserver(wal.Observe))
+	runLoggedOperations(d)
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	replayed := NewDispatcher(WithClock(snapshotTestClock))
+	applied, err := replayed.ReplayLog(path)
+	if err != nil {
+		t.Fatalf("ReplayLog() error = %v", err)
+	}
+	if applied != int(d.LastOperation()) {
+		t.Fatalf("(Expected) %d != %d (Returned)", d.LastOperation(), applied)
+	}
+	if !reflect.DeepEqual(d.Snapshot(), replayed.Snapshot()) {
+		t.Fatalf("Snapshot() = %v, want %v", replayed.Snapshot(), d.Snapshot())
+	}
+}
+
+func TestWriteAheadLog_ReplayOnSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "wal.log")
+	snapshotPath := filepath.Join(dir, "snapshot.json")
+	wal := openTestLog(t, logPath)
+	d := NewDispatcher(WithClock(snapshotTestClock), WithObserver(wal.Observe))
+	d.ResetCars([]Car{{1, 6}, {2, 4}})
+	d.RequestJourney(Group{1, 4})
+	d.RequestJourney(Group{2, 5})
+	d.RequestJourney(Group{3, 6})
+
+	upTo := d.LastOperation()
+	if err := d.SaveSnapshot(snapshotPath); err != nil {
+		t.Fatalf("SaveSnapshot() error = %v", err)
+	}
+	if err := wal.Compact(upTo); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	d.Dropoff(1)
+	d.AddCar(Car{3, 6})
+	d.RequestJourney(Group{4, 2})
+	wal.Close()
+
+	ops := 0
+	readOperations(logPath, func(seq uint64, line []byte) error {
+		ops++
+		return nil
+	})
+	if ops != int(d.LastOperation()-upTo) {
+		t.Fatalf("(Expected) %d != %d (Returned)", d.LastOperation()-upTo, ops)
+	}
+
+	recovered := NewDispatcher(WithClock(snapshotTestClock))
+	if err := recovered.LoadSnapshot(snapshotPath); err != nil {
+		t.Fatalf("LoadSnapshot() error = %v", err)
+	}
+	if _, err := recovered.ReplayLog(logPath); err != nil {
+		t.Fatalf("ReplayLog() error = %v", err)
+	}
+	if !reflect.DeepEqual(d.Snapshot(), recovered.Snapshot()) {
+		t.Fatalf("Snapshot() = %v, want %v", recovered.Snapshot(), d.Snapshot())
+	}
+
+	// without the snapshot the compacted log starts with a gap
+	_, err := NewDispatcher().ReplayLog(logPath)
+	if !errors.Is(err, ErrLogGap) {
+		t.Fatalf("(Expected) %v != %v (Returned)", ErrLogGap, err)
+	}
+}
+
+func TestWriteAheadLog_TornLastLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	wal := openTestLog(t, path)
+	d := NewDispatcher(WithClock(snapshotTestClock), WithObserver(wal.Observe))
+	d.ResetCars([]Car{{1, 4}})
+	d.RequestJourney(Group{1, 4})
+	wal.Close()
+
+	// a crash in the middle of a write leaves half a line
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	file.WriteString(`{"seq":3,"op":"dropo`)
+	file.Close()
+
+	replayed := NewDispatcher(WithClock(snapshotTestClock))
+	if _, err := replayed.ReplayLog(path); err != nil {
+		t.Fatalf("ReplayLog() error = %v", err)
+	}
+	assertLocate(t, replayed, 1, 1)
+
+	// the half line is removed before appending again
+	wal = openTestLog(t, path)
+	replayed.observers = append(replayed.observers, wal.Observe)
+	replayed.Dropoff(1)
+	wal.Close()
+	again := NewDispatcher(WithClock(snapshotTestClock))
+	if _, err := again.ReplayLog(path); err != nil {
+		t.Fatalf("ReplayLog() error = %v", err)
+	}
+	if !reflect.DeepEqual(replayed.Snapshot(), again.Snapshot()) {
+		t.Fatalf("Snapshot() = %v, want %v", again.Snapshot(), replayed.Snapshot())
+	}
+}
+
+func TestWriteAheadLog_CorruptedLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	content := `{"seq":1,"op":"reset_cars","changes":[{"kind":"fleet_reset"}]}
+not json
+{"seq":2,"op":"add_car","changes":[{"kind":"car_added","car":1,"seats":4}]}
+`
+	os.WriteFile(path, []byte(content), 0644)
+	_, err := NewDispatcher().ReplayLog(path)
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("ReplayLog() error = %v, want the corrupted line", err)
+	}
+}
+
+func TestWriteAheadLog_MissingLog(t *testing.T) {
+	applied, err := NewDispatcher().ReplayLog(filepath.Join(t.TempDir(), "missing.log"))
+	if err != nil || applied != 0 {
+		t.Fatalf("ReplayLog() = %d, %v, want 0, nil", applied, err)
+	}
+}
+
+func TestSyncPolicyByName(t *testing.T) {
+	for _, name := range SyncPolicyNames() {
+		if _, err := SyncPolicyByName(name); err != nil {
+			t.Fatalf("SyncPolicyByName(%q) error = %v", name, err)
+		}
+	}
+	if _, err := SyncPolicyByName("sometimes"); err == nil {
+		t.Fatalf("SyncPolicyByName() should fail with an unknown name")
+	}
+}
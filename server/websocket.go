@@ -0,0 +1,282 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The WebSockets are written by hand following RFC 6455, so the service keeps
+// no dependencies. The server only sends text messages, the messages of the
+// clients are read to answer the pings and the closes and then dropped
+
+// websocketGUID is appended to the key of the client to accept the upgrade
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsText  byte = 0x1
+	wsClose byte = 0x8
+	wsPing  byte = 0x9
+	wsPong  byte = 0xA
+)
+
+const (
+	wsCloseNormal        = 1000
+	wsCloseGoingAway     = 1001
+	wsCloseProtocolError = 1002
+	wsCloseTooBig        = 1009
+)
+
+// maxWebSocketFrame is the longest frame read from a client
+const maxWebSocketFrame = 4096
+
+// websocketWriteTimeout is the longest write of a frame, a client that does
+// not read is disconnected
+const websocketWriteTimeout = 10 * time.Second
+
+// websocketCloseWait is the wait for the close of the client after the close
+// of the server
+const websocketCloseWait = time.Second
+
+type webSocketError struct {
+	code   uint16
+	reason string
+}
+
+func (err webSocketError) Error() string {
+	return err.reason
+}
+
+// webSocket is an upgraded connection. The writes are serialized, the reads
+// are done by readLoop
+type webSocket struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	mu        sync.Mutex
+	closeSent bool
+	// closed is closed when readLoop ends, after the close of the client or
+	// an error of the connection
+	closed chan struct{}
+}
+
+// upgradeWebSocket answers the handshake of a WebSocket. The headers already
+// set in w, such as the request id, are kept in the response. It writes a
+// problem and returns false when the request is not a valid upgrade
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*webSocket, bool) {
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		writeProblem(w, http.StatusUpgradeRequired, ProblemUpgradeRequired, "the request must be a WebSocket upgrade")
+		return nil, false
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeProblem(w, http.StatusUpgradeRequired, ProblemUpgradeRequired, "the WebSocket version must be 13")
+		return nil, false
+	}
+	if !sameOrigin(r) {
+		writeProblem(w, http.StatusForbidden, ProblemOriginNotAllowed, "the Origin must be the host of the server")
+		return nil, false
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		writeProblem(w, http.StatusBadRequest, ProblemUpgradeRequired, "Sec-WebSocket-Key must be 16 bytes in base64")
+		return nil, false
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		writeProblem(w, http.StatusInternalServerError, ProblemInternalError, "the connection can not be upgraded")
+		return nil, false
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		writeProblem(w, http.StatusInternalServerError, ProblemInternalError, err.Error())
+		return nil, false
+	}
+	accept := sha1.Sum([]byte(key + websocketGUID))
+	header := w.Header().Clone()
+	header.Del("Content-Type")
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "Upgrade")
+	header.Set("Sec-WebSocket-Accept", base64.StdEncoding.EncodeToString(accept[:]))
+	conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+	buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	header.Write(buffered)
+	buffered.WriteString("\r\n")
+	if err := buffered.Flush(); err != nil {
+		conn.Close()
+		return nil, false
+	}
+	return &webSocket{conn: conn, reader: buffered.Reader, closed: make(chan struct{})}, true
+}
+
+// sameOrigin tells if the page that opens the socket is served by this host.
+// The browsers always send the Origin, so another site can not open the
+// socket of a rider. A request without Origin is rejected, the other clients
+// must send the one of the host
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	parsed, err := url.Parse(origin)
+	return err == nil && parsed.Host != "" && strings.EqualFold(parsed.Host, r.Host)
+}
+
+// headerHasToken tells if one of the comma separated values of the header is
+// the token, ignoring the case
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (ws *webSocket) writeFrame(opcode byte, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.writeFrameLocked(opcode, payload)
+}
+
+func (ws *webSocket) writeFrameLocked(opcode byte, payload []byte) error {
+	if ws.closeSent {
+		return fmt.Errorf("the WebSocket is closed")
+	}
+	frame := []byte{0x80 | opcode}
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+	frame = append(frame, payload...)
+	if opcode == wsClose {
+		ws.closeSent = true
+	}
+	ws.conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+func (ws *webSocket) writeJSON(message any) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return ws.writeFrame(wsText, payload)
+}
+
+func closePayload(code uint16, reason string) []byte {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	return append(payload, reason...)
+}
+
+// close starts the closing handshake, it waits a little for the close of the
+// client before closing the connection
+func (ws *webSocket) close(code uint16, reason string) {
+	ws.writeFrame(wsClose, closePayload(code, reason))
+	timer := time.NewTimer(websocketCloseWait)
+	defer timer.Stop()
+	select {
+	case <-ws.closed:
+	case <-timer.C:
+	}
+	ws.conn.Close()
+}
+
+// readLoop answers the pings and the close of the client until the
+// connection ends. A client that sends nothing, not even the pongs of the
+// pings of the server, for idle is disconnected
+func (ws *webSocket) readLoop(idle time.Duration) {
+	defer close(ws.closed)
+	for {
+		ws.conn.SetReadDeadline(time.Now().Add(idle))
+		opcode, payload, err := ws.readFrame()
+		if wsErr, ok := err.(webSocketError); ok {
+			ws.writeFrame(wsClose, closePayload(wsErr.code, wsErr.reason))
+			return
+		} else if err != nil {
+			return
+		}
+		switch opcode {
+		case wsPing:
+			ws.writeFrame(wsPong, payload)
+		case wsClose:
+			// the close of the client is echoed unless the server closed first
+			ws.mu.Lock()
+			if !ws.closeSent {
+				code := []byte{}
+				if len(payload) >= 2 {
+					code = payload[:2]
+				}
+				ws.writeFrameLocked(wsClose, code)
+			}
+			ws.mu.Unlock()
+			return
+		}
+	}
+}
+
+// readFrame reads a frame of the client, the frames of the clients are always
+// masked
+func (ws *webSocket) readFrame() (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(ws.reader, header); err != nil {
+		return 0, nil, err
+	}
+	final, opcode, masked := header[0]&0x80 != 0, header[0]&0x0F, header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(ws.reader, extended); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(ws.reader, extended); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if !masked {
+		return 0, nil, webSocketError{wsCloseProtocolError, "the frames of a client must be masked"}
+	}
+	if opcode >= wsClose && (length > 125 || !final) {
+		return 0, nil, webSocketError{wsCloseProtocolError, "invalid control frame"}
+	}
+	if length > maxWebSocketFrame {
+		return 0, nil, webSocketError{wsCloseTooBig, "the frame is too big"}
+	}
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(ws.reader, mask); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	for idx := range payload {
+		payload[idx] ^= mask[idx%4]
+	}
+	return opcode, payload, nil
+}